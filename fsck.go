@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/merkletree"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// fsckProblem is printed as one line of JSON for every problem that is found
+type fsckProblem struct {
+	// Ciphertext path relative to CIPHERDIR
+	Path string
+	// Machine-readable problem class, see the fsckProblem* constants
+	Problem string
+	// Human-readable details
+	Detail string
+}
+
+const (
+	fsckProblemDirIV     = "diriv"
+	fsckProblemName      = "name"
+	fsckProblemLongName  = "longname"
+	fsckProblemOrphan    = "orphan"
+	fsckProblemHeader    = "header"
+	fsckProblemBlock     = "block"
+	fsckProblemSymlink   = "symlink"
+	fsckProblemReadError = "read"
+	fsckProblemHashTree  = "hashtree"
+)
+
+type fsckObj struct {
+	args          fusefrontend.Args
+	contentEnc    *contentenc.ContentEnc
+	nameTransform *nametransform.NameTransform
+	// Number of problems found so far
+	problems int
+	// Number of files and directories checked
+	checked int
+}
+
+// report - print a problem as one line of JSON on stdout
+func (ck *fsckObj) report(relPath string, problem string, detail string) {
+	ck.problems++
+	js, _ := json.Marshal(fsckProblem{Path: relPath, Problem: problem, Detail: detail})
+	fmt.Println(string(js))
+}
+
+// dirIV - read and verify gocryptfs.diriv in directory "relPath".
+// Returns nil if DirIV is disabled or the file is invalid.
+func (ck *fsckObj) dirIV(relPath string) []byte {
+	if !ck.args.DirIV {
+		return nil
+	}
+	iv, err := nametransform.ReadDirIV(filepath.Join(ck.args.Cipherdir, relPath))
+	if err != nil {
+		ck.report(filepath.Join(relPath, nametransform.DirIVFilename), fsckProblemDirIV, err.Error())
+		return nil
+	}
+	return iv
+}
+
+// checkName - verify that the file name "cName" in directory "relDir" decrypts
+func (ck *fsckObj) checkName(relDir string, cName string, iv []byte) {
+	relPath := filepath.Join(relDir, cName)
+	if !ck.args.DirIV {
+		// Old filesystems encrypt the whole path without IV
+		_, err := ck.nameTransform.DecryptPathNoIV(relPath)
+		if err != nil {
+			ck.report(relPath, fsckProblemName, err.Error())
+		}
+		return
+	}
+	if iv == nil {
+		// Already reported as a DirIV problem
+		return
+	}
+	if nametransform.IsLongContent(cName) {
+		cNameLong, err := nametransform.ReadLongName(filepath.Join(ck.args.Cipherdir, relPath))
+		if err != nil {
+			ck.report(relPath, fsckProblemLongName, err.Error())
+			return
+		}
+		if nametransform.HashLongName(cNameLong) != cName {
+			ck.report(relPath, fsckProblemLongName, "hash does not match "+nametransform.LongNameSuffix+" file")
+			return
+		}
+		cName = cNameLong
+	}
+	_, err := ck.nameTransform.DecryptName(cName, iv)
+	if err != nil {
+		ck.report(relPath, fsckProblemName, err.Error())
+	}
+}
+
+// checkFile - verify the header and all blocks of regular file "relPath"
+func (ck *fsckObj) checkFile(relPath string) {
+	fd, err := os.Open(filepath.Join(ck.args.Cipherdir, relPath))
+	if err != nil {
+		ck.report(relPath, fsckProblemReadError, err.Error())
+		return
+	}
+	defer fd.Close()
+	buf := make([]byte, ck.contentEnc.HeaderLen())
+	n, err := fd.ReadAt(buf, 0)
+	if n == 0 && err == io.EOF {
+		// Empty file
+		return
+	}
+	if err != nil {
+		ck.report(relPath, fsckProblemHeader, err.Error())
+		return
+	}
+	header, err := ck.contentEnc.DecryptHeader(buf)
+	if err != nil {
+		ck.report(relPath, fsckProblemHeader, err.Error())
+		return
+	}
+	if header.Version == contentenc.HeaderVersion3 {
+		fi, err := fd.Stat()
+		if err != nil {
+			ck.report(relPath, fsckProblemReadError, err.Error())
+			return
+		}
+		cipherPlainSize := ck.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))
+		if header.PlainSize > cipherPlainSize {
+			ck.report(relPath, fsckProblemHeader,
+				fmt.Sprintf("authenticated size %d exceeds the content size %d", header.PlainSize, cipherPlainSize))
+		}
+	}
+	// Integrity mode: rebuild the hash tree over the blocks up to the
+	// authenticated size
+	var tree *merkletree.Tree
+	var treeEnd uint64
+	if header.Root != nil {
+		tree = &merkletree.Tree{}
+		treeEnd = ck.contentEnc.PlainSizeToCipherSize(header.PlainSize)
+	}
+	buf = make([]byte, ck.contentEnc.CipherBS())
+	for blockNo := uint64(0); ; blockNo++ {
+		off := ck.contentEnc.BlockNoToCipherOff(blockNo)
+		n, err := fd.ReadAt(buf, int64(off))
+		if n == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			ck.report(relPath, fsckProblemReadError, err.Error())
+			return
+		}
+		_, err = ck.contentEnc.DecryptFileBlock(buf[:n], blockNo, header.Id)
+		if err != nil {
+			ck.report(relPath, fsckProblemBlock,
+				fmt.Sprintf("block #%d (cipherOff=%d): %v", blockNo, off, err))
+		}
+		if tree != nil && off < treeEnd {
+			block := buf[:contentenc.MinUint64(uint64(n), treeEnd-off)]
+			tree.Set(blockNo, merkletree.Leaf(blockNo, block))
+		}
+	}
+	if tree != nil && !bytes.Equal(tree.Root(), header.Root) {
+		ck.report(relPath, fsckProblemHashTree, "root mismatch: stale, reordered or missing blocks")
+	}
+}
+
+// checkSymlink - verify that the target of symlink "relPath" decrypts
+func (ck *fsckObj) checkSymlink(relPath string) {
+	cTarget, err := os.Readlink(filepath.Join(ck.args.Cipherdir, relPath))
+	if err != nil {
+		ck.report(relPath, fsckProblemReadError, err.Error())
+		return
+	}
+	if ck.args.PlaintextNames {
+		return
+	}
+	// Old filesystem: symlinks are encrypted like paths (CBC)
+	if !ck.args.DirIV {
+		_, err = ck.nameTransform.DecryptPathNoIV(cTarget)
+	} else {
+		var cBinTarget []byte
+		cBinTarget, err = base64.URLEncoding.DecodeString(cTarget)
+		if err == nil {
+			_, err = ck.contentEnc.DecryptBlock(cBinTarget, 0, nil)
+		}
+	}
+	if err != nil {
+		ck.report(relPath, fsckProblemSymlink, err.Error())
+	}
+}
+
+// checkDir - recursively check directory "relPath"
+func (ck *fsckObj) checkDir(relPath string) {
+	ck.checked++
+	iv := ck.dirIV(relPath)
+	fd, err := os.Open(filepath.Join(ck.args.Cipherdir, relPath))
+	if err != nil {
+		ck.report(relPath, fsckProblemReadError, err.Error())
+		return
+	}
+	entries, err := fd.Readdir(-1)
+	fd.Close()
+	if err != nil {
+		ck.report(relPath, fsckProblemReadError, err.Error())
+		return
+	}
+	// Remember the long name content files to find orphaned .name files
+	longContent := make(map[string]bool)
+	for _, e := range entries {
+		if nametransform.IsLongContent(e.Name()) {
+			longContent[e.Name()] = true
+		}
+	}
+	for _, e := range entries {
+		cName := e.Name()
+		childPath := filepath.Join(relPath, cName)
+		if relPath == "" && cName == configfile.ConfDefaultName {
+			continue
+		}
+		if ck.args.DirIV && cName == nametransform.DirIVFilename {
+			continue
+		}
+		if ck.args.DirIV && strings.HasPrefix(cName, nametransform.DirIVFilename+".rmdir.") {
+			ck.report(childPath, fsckProblemOrphan, "leftover from interrupted rmdir")
+			continue
+		}
+		if !ck.args.PlaintextNames {
+			if nametransform.NameType(cName) == nametransform.LongNameFilename {
+				content := strings.TrimSuffix(cName, nametransform.LongNameSuffix)
+				if !longContent[content] {
+					ck.report(childPath, fsckProblemOrphan, "no matching "+content)
+				}
+				continue
+			}
+			ck.checkName(relPath, cName, iv)
+		}
+		if e.IsDir() {
+			ck.checkDir(childPath)
+			continue
+		}
+		ck.checked++
+		if e.Mode()&os.ModeSymlink != 0 {
+			ck.checkSymlink(childPath)
+		} else if e.Mode().IsRegular() {
+			ck.checkFile(childPath)
+		}
+	}
+}
+
+// fsck - check CIPHERDIR for corruption and print every problem found.
+// Exits with ERREXIT_FSCK if there were any problems.
+func fsck(args *argContainer) {
+	masterkey, confFile := getMasterKey(args)
+	frontendArgs := initFrontendArgs(masterkey, *args, confFile)
+	cryptoCore := cryptocore.New(masterkey, frontendArgs.AEADType(), frontendArgs.GCMIV128, frontendArgs.HKDF)
+	ck := fsckObj{
+		args:          frontendArgs,
+		contentEnc:    contentenc.New(cryptoCore, frontendArgs.PlainBS, frontendArgs.HeaderV3, frontendArgs.Integrity, frontendArgs.Compress),
+		nameTransform: nametransform.New(cryptoCore, frontendArgs.EMENames, frontendArgs.LongNames),
+	}
+	// Corrupt blocks and names are reported as problems, no need to spam the
+	// log as well
+	toggledlog.Warn.Enabled = false
+	ck.checkDir("")
+	toggledlog.Warn.Enabled = true
+	fmt.Fprintf(os.Stderr, "fsck: checked %d files and directories, found %d problems\n",
+		ck.checked, ck.problems)
+	if ck.problems > 0 {
+		os.Exit(ERREXIT_FSCK)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// info - print information about a config file and exit.
+// The master key stays encrypted, so no password is needed.
+func info(filename string) {
+	cf, err := configfile.Load(filename)
+	if err != nil {
+		toggledlog.Fatal.Println(colorRed + err.Error() + colorReset)
+		os.Exit(ERREXIT_LOADCONF)
+	}
+	fmt.Printf("Creator:      %s\n", cf.Creator)
+	fmt.Printf("Version:      %d\n", cf.Version)
+	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
+	fmt.Printf("BlockSize:    %d\n", cf.PlainBS())
+	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
+	for _, ks := range cf.Keyslots {
+		fmt.Printf("Keyslot:      %s (%s)\n", ks.Label, ks.KdfString())
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,74 @@
+package configfile
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+const (
+	// Defaults as recommended by RFC 9106, second choice:
+	// 3 passes over 64 MiB of memory using 4 lanes
+	Argon2idDefaultTime    = 3
+	Argon2idDefaultMemory  = 64 * 1024 // KiB
+	Argon2idDefaultThreads = 4
+)
+
+type argon2idKdf struct {
+	Salt []byte
+	// Number of passes over the memory
+	Time uint32
+	// Memory size in KiB
+	Memory uint32
+	// Degree of parallelism
+	Threads uint8
+	KeyLen  uint32
+}
+
+// NewArgon2idKdf - create a new Argon2id KDF with random salt. Calls
+// os.Exit if the parameters do not make sense.
+func NewArgon2idKdf(time uint32, memory uint32, threads uint8) argon2idKdf {
+	var a argon2idKdf
+	a.Salt = cryptocore.RandBytes(cryptocore.KeyLen)
+	a.Time = time
+	a.Memory = memory
+	a.Threads = threads
+	a.KeyLen = cryptocore.KeyLen
+	if err := a.validate(); err != nil {
+		toggledlog.Fatal.Printf("Error: %v. Aborting.", err)
+		os.Exit(1)
+	}
+	return a
+}
+
+// validate - check that the parameters are usable. A config file with bogus
+// parameters would otherwise make argon2 panic.
+func (a *argon2idKdf) validate() error {
+	if a.Time < 1 {
+		return fmt.Errorf("argon2id time parameter must be at least 1")
+	}
+	if a.Threads < 1 {
+		return fmt.Errorf("argon2id threads parameter must be at least 1")
+	}
+	// Argon2 needs at least 8 KiB per lane
+	if a.Memory < 8*uint32(a.Threads) {
+		return fmt.Errorf("argon2id memory parameter must be at least %d KiB", 8*uint32(a.Threads))
+	}
+	if a.KeyLen != cryptocore.KeyLen {
+		return fmt.Errorf("argon2id key length must be %d", cryptocore.KeyLen)
+	}
+	return nil
+}
+
+func (a *argon2idKdf) DeriveKey(pw string) []byte {
+	return argon2.IDKey([]byte(pw), a.Salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+}
+
+func (a *argon2idKdf) String() string {
+	return fmt.Sprintf("argon2id Salt=%dB Time=%d Memory=%dKiB Threads=%d KeyLen=%d",
+		len(a.Salt), a.Time, a.Memory, a.Threads, a.KeyLen)
+}
@@ -15,6 +15,9 @@ const (
 	// The dot "." is not used in base64url (RFC4648), hence
 	// we can never clash with an encrypted file.
 	ConfDefaultName = "gocryptfs.conf"
+	// In reverse mode, the config file gets stored next to the plain-text
+	// files. Make it hidden (start with dot) to not annoy the user.
+	ConfReverseName = ".gocryptfs.reverse.conf"
 )
 
 type ConfFile struct {
@@ -22,10 +25,17 @@ type ConfFile struct {
 	// This only documents the config file for humans who look at it. The actual
 	// technical info is contained in FeatureFlags.
 	Creator string
-	// Encrypted AES key, unlocked using a password hashed with scrypt
+	// Encrypted AES key, unlocked using a password hashed with scrypt.
+	// Copy of the first keyslot for compatibility with older versions.
 	EncryptedKey []byte
-	// Stores parameters for scrypt hashing (key derivation)
+	// Stores parameters for scrypt hashing (key derivation).
+	// Copy of the first keyslot for compatibility with older versions. Empty
+	// if the first keyslot uses Argon2id.
 	ScryptObject scryptKdf
+	// Every keyslot holds the master key encrypted with a different password.
+	// Config files written by older versions do not have this field, their
+	// EncryptedKey and ScryptObject are loaded as the only keyslot.
+	Keyslots []Keyslot `json:",omitempty"`
 	// The On-Disk-Format version this filesystem uses
 	Version uint16
 	// List of feature flags this filesystem has enabled.
@@ -33,71 +43,201 @@ type ConfFile struct {
 	// mounting. This mechanism is analogous to the ext4 feature flags that are
 	// stored in the superblock.
 	FeatureFlags []string
+	// Plaintext block size in bytes. Only set, together with the BlockSize
+	// feature flag, if it differs from contentenc.DefaultBS.
+	BlockSize uint64 `json:",omitempty"`
 	// File the config is saved to. Not exported to JSON.
 	filename string
+	// Index of the keyslot that was unlocked by LoadConfFile, -1 if none.
+	// Not exported to JSON.
+	unlockedSlot int
+}
+
+// CreateArgs - settings for a new filesystem, see CreateConfFile
+type CreateArgs struct {
+	// Config file to write
+	Filename string
+	// Password for the default keyslot
+	Password string
+	// KDF and its cost for the default keyslot
+	Kdf KdfParams
+	// Stored in the config for humans, usually the gocryptfs version
+	Creator string
+	// Do not encrypt file names
+	PlaintextNames bool
+	// Enable encrypted extended attributes
+	Xattr bool
+	// Plaintext block size of the file contents
+	BlockSize uint64
+	// Use XChaCha20-Poly1305 instead of AES-GCM for the file contents
+	XChaCha20Poly1305 bool
+	// Use AES-SIV instead of AES-GCM for the file contents
+	AESSIV bool
+	// Derive independent subkeys from the master key using HKDF
+	HKDF bool
+	// Use version 3 file headers that store the authenticated plaintext size
+	HeaderV3 bool
+	// Verify all blocks against a per-file hash tree, requires HeaderV3
+	Integrity bool
+	// Compress the file contents before encryption, requires HeaderV3
+	Compress bool
 }
 
 // CreateConfFile - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func CreateConfFile(filename string, password string, plaintextNames bool, logN int, creator string) error {
+// the password and write it to disk.
+func CreateConfFile(args *CreateArgs) error {
+	err := contentenc.CheckBS(args.BlockSize)
+	if err != nil {
+		return err
+	}
+	if args.XChaCha20Poly1305 && args.AESSIV {
+		return fmt.Errorf("XChaCha20-Poly1305 and AES-SIV are mutually exclusive")
+	}
+	if args.Integrity && !args.HeaderV3 {
+		return fmt.Errorf("Integrity mode requires version 3 file headers")
+	}
+	if args.Compress && !args.HeaderV3 {
+		return fmt.Errorf("Compression mode requires version 3 file headers")
+	}
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = args.Filename
+	cf.unlockedSlot = -1
+	cf.Creator = args.Creator
 	cf.Version = contentenc.CurrentVersion
 
 	// Generate new random master key
 	key := cryptocore.RandBytes(cryptocore.KeyLen)
 
 	// Encrypt it using the password
-	// This sets ScryptObject and EncryptedKey
-	cf.EncryptKey(key, password, logN)
+	// This creates the default keyslot and sets ScryptObject and EncryptedKey
+	cf.EncryptKey(key, args.Password, args.Kdf)
 
 	// Set feature flags
-	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
-	if plaintextNames {
+	if args.XChaCha20Poly1305 {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXChaCha20Poly1305])
+	} else {
+		// AES-SIV uses 128-bit nonces as well
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
+	}
+	if args.AESSIV {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
+	}
+	if args.HKDF {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
+	}
+	if args.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagEMENames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
 	}
+	if args.Xattr {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXattr])
+	}
+	if args.BlockSize != contentenc.DefaultBS {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagBlockSize])
+		cf.BlockSize = args.BlockSize
+	}
+	if args.HeaderV3 {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHeaderV3])
+	}
+	if args.Integrity {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagIntegrity])
+	}
+	if args.Compress {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagCompress])
+	}
 
 	// Write file to disk
 	return cf.WriteFile()
 }
 
 // LoadConfFile - read config file from disk and decrypt the
-// contained key using password.
+// contained key using password. Every keyslot is tried until one unlocks.
 //
 // Returns the decrypted key and the ConfFile object
 func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
+	cf, err := Load(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range cf.Keyslots {
+		key, err := cf.Keyslots[i].unlock(password)
+		if err != nil {
+			toggledlog.Debug.Printf("keyslot %q: %v", cf.Keyslots[i].Label, err)
+			continue
+		}
+		toggledlog.Debug.Printf("unlocked keyslot %q", cf.Keyslots[i].Label)
+		cf.unlockedSlot = i
+		return key, cf, nil
+	}
+	toggledlog.Warn.Printf("failed to unlock master key: no keyslot matches the password")
+	return nil, nil, fmt.Errorf("Password incorrect.")
+}
+
+// Load - read config file from disk and check that we support the on-disk
+// format and all feature flags. Prints a warning for deprecated filesystems.
+// The master key stays encrypted, so this does not need the password.
+func Load(filename string) (*ConfFile, error) {
 	var cf ConfFile
 	cf.filename = filename
+	cf.unlockedSlot = -1
 
 	// Read from disk
 	js, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Unmarshal
 	err = json.Unmarshal(js, &cf)
 	if err != nil {
 		toggledlog.Warn.Printf("Failed to unmarshal config file")
-		return nil, nil, err
+		return nil, err
 	}
 
 	if cf.Version != contentenc.CurrentVersion {
-		return nil, nil, fmt.Errorf("Unsupported on-disk format %d", cf.Version)
+		return nil, fmt.Errorf("Unsupported on-disk format %d", cf.Version)
+	}
+
+	// Config files from before keyslots were introduced have a single password
+	if len(cf.Keyslots) == 0 {
+		s := cf.ScryptObject
+		cf.Keyslots = []Keyslot{{
+			Label:        DefaultKeyslotLabel,
+			EncryptedKey: cf.EncryptedKey,
+			ScryptObject: &s,
+		}}
 	}
 
 	// Check that all set feature flags are known
 	for _, flag := range cf.FeatureFlags {
 		if !cf.isFeatureFlagKnown(flag) {
-			return nil, nil, fmt.Errorf("Unsupported feature flag %q", flag)
+			return nil, fmt.Errorf("Unsupported feature flag %q", flag)
+		}
+	}
+
+	// Older versions ignore the BlockSize field, the feature flag makes them
+	// refuse to mount
+	if cf.IsFeatureFlagSet(FlagBlockSize) {
+		err = contentenc.CheckBS(cf.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+	} else if cf.BlockSize != 0 {
+		return nil, fmt.Errorf("BlockSize is set but feature flag %q is missing", knownFlags[FlagBlockSize])
+	}
+	for _, flag := range []flagIota{FlagIntegrity, FlagCompress} {
+		if cf.IsFeatureFlagSet(flag) && !cf.IsFeatureFlagSet(FlagHeaderV3) {
+			return nil, fmt.Errorf("Feature flag %q requires %q", knownFlags[flag], knownFlags[FlagHeaderV3])
 		}
 	}
+	if cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) && cf.IsFeatureFlagSet(FlagAESSIV) {
+		return nil, fmt.Errorf("Feature flags %q and %q are mutually exclusive",
+			knownFlags[FlagXChaCha20Poly1305], knownFlags[FlagAESSIV])
+	}
 
 	// Check that all required feature flags are set
 	var requiredFlags []flagIota
@@ -108,11 +248,15 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 	}
 	deprecatedFs := false
 	for _, i := range requiredFlags {
+		if i == FlagGCMIV128 && cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) {
+			// GCM is not used at all
+			continue
+		}
 		if !cf.IsFeatureFlagSet(i) {
 			// For now, warn but continue.
 			fmt.Printf("Deprecated filesystem: feature flag %q is missing\n", knownFlags[i])
 			deprecatedFs = true
-			//return nil, nil, fmt.Errorf("Required feature flag %q is missing", knownFlags[i])
+			//return nil, fmt.Errorf("Required feature flag %q is missing", knownFlags[i])
 		}
 	}
 	if deprecatedFs {
@@ -126,39 +270,31 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 ` + "\033[0m")
 	}
 
-	// Generate derived key from password
-	scryptHash := cf.ScryptObject.DeriveKey(password)
-
-	// Unlock master key using password-based key
-	// We use stock go GCM instead of OpenSSL here as we only use 96-bit IVs,
-	// speed is not important and we get better error messages
-	cc := cryptocore.New(scryptHash, false, false)
-	ce := contentenc.New(cc, 4096)
+	return &cf, nil
+}
 
-	toggledlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
-	key, err := ce.DecryptBlock(cf.EncryptedKey, 0, nil)
-	toggledlog.Warn.Enabled = true
-	if err != nil {
-		toggledlog.Warn.Printf("failed to unlock master key: %s", err.Error())
-		return nil, nil, fmt.Errorf("Password incorrect.")
+// PlainBS - get the plaintext block size of the filesystem
+func (cf *ConfFile) PlainBS() uint64 {
+	if cf.BlockSize == 0 {
+		return contentenc.DefaultBS
 	}
-
-	return key, &cf, nil
+	return cf.BlockSize
 }
 
-// EncryptKey - encrypt "key" using an scrypt hash generated from "password"
-// and store it in cf.EncryptedKey.
-// Uses scrypt with cost parameter logN and stores the scrypt parameters in
-// cf.ScryptObject.
-func (cf *ConfFile) EncryptKey(key []byte, password string, logN int) {
-	// Generate derived key from password
-	cf.ScryptObject = NewScryptKdf(logN)
-	scryptHash := cf.ScryptObject.DeriveKey(password)
-
-	// Lock master key using password-based key
-	cc := cryptocore.New(scryptHash, false, false)
-	ce := contentenc.New(cc, 4096)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+// EncryptKey - encrypt "key" using a hash generated from "password"
+// and store it in the keyslot that was unlocked by LoadConfFile. A new config
+// file gets a keyslot labeled DefaultKeyslotLabel.
+// "params" selects the KDF and its cost, the KDF parameters are stored in
+// the keyslot.
+func (cf *ConfFile) EncryptKey(key []byte, password string, params KdfParams) {
+	if cf.unlockedSlot < 0 || cf.unlockedSlot >= len(cf.Keyslots) {
+		cf.Keyslots = append(cf.Keyslots, newKeyslot(key, password, params, DefaultKeyslotLabel))
+		cf.unlockedSlot = len(cf.Keyslots) - 1
+	} else {
+		label := cf.Keyslots[cf.unlockedSlot].Label
+		cf.Keyslots[cf.unlockedSlot] = newKeyslot(key, password, params, label)
+	}
+	cf.syncKeyslots()
 }
 
 // WriteFile - write out config in JSON format to file "filename.tmp"
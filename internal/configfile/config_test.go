@@ -1,13 +1,19 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/toggledlog"
 )
 
+// Low scrypt cost to keep the tests fast
+var testKdfParams = KdfParams{Name: KdfScrypt, ScryptLogN: 10}
+
 func TestLoadV1(t *testing.T) {
 	_, _, err := LoadConfFile("config_test/v1.conf", "test")
 	if err == nil {
@@ -60,7 +66,8 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 }
 
 func TestCreateConfFile(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test")
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -92,3 +99,280 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+// Load must work without the password and must not decrypt the master key
+func TestLoadNoPassword(t *testing.T) {
+	cf, err := Load("config_test/v2.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.Version != 2 || cf.ScryptObject.N == 0 || len(cf.EncryptedKey) == 0 {
+		t.Errorf("config file not loaded properly: %+v", cf)
+	}
+	_, err = Load("config_test/StrangeFeature.conf")
+	if err == nil {
+		t.Errorf("Loading unknown feature must fail but it didn't")
+	}
+}
+
+func TestKeyslots(t *testing.T) {
+	fn := "config_test/keyslots.conf"
+	os.Remove(fn)
+	defer os.Remove(fn)
+	err := CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cf.AddKeyslot(key, "bob", testKdfParams, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.AddKeyslot(key, "bob2", testKdfParams, "bob") == nil {
+		t.Error("adding a duplicate label should have failed")
+	}
+	err = cf.WriteFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both passwords unlock the same master key
+	key2, cf, err := LoadConfFile(fn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Fatal("keyslots hold different master keys")
+	}
+	// Revoke the default password
+	err = cf.RemoveKeyslot(DefaultKeyslotLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.RemoveKeyslot("bob") == nil {
+		t.Error("removing the last keyslot should have failed")
+	}
+	err = cf.WriteFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testing.Verbose() {
+		toggledlog.Warn.Enabled = false
+	}
+	_, _, err = LoadConfFile(fn, "test")
+	toggledlog.Warn.Enabled = true
+	if err == nil {
+		t.Error("removed keyslot still unlocks")
+	}
+	_, cf, err = LoadConfFile(fn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Older versions only know the top-level fields, they must match the
+	// first keyslot
+	if !bytes.Equal(cf.EncryptedKey, cf.Keyslots[0].EncryptedKey) {
+		t.Error("EncryptedKey does not mirror the first keyslot")
+	}
+}
+
+// Switch the default keyslot to Argon2id by changing the password
+func TestArgon2id(t *testing.T) {
+	fn := "config_test/argon2id.conf"
+	os.Remove(fn)
+	defer os.Remove(fn)
+	err := CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		t.Error("scrypt config must not have the Argon2id flag")
+	}
+	params := KdfParams{Name: KdfArgon2id, Argon2idTime: 1, Argon2idMemory: 1024, Argon2idThreads: 1}
+	cf.EncryptKey(key, "newpw", params)
+	if !cf.IsFeatureFlagSet(FlagArgon2id) {
+		t.Error("Argon2id flag is not set")
+	}
+	err = cf.WriteFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, cf, err := LoadConfFile(fn, "newpw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Error("wrong master key")
+	}
+	if cf.Keyslots[0].Argon2idObject == nil || cf.Keyslots[0].ScryptObject != nil {
+		t.Errorf("keyslot does not use Argon2id: %s", cf.Keyslots[0].KdfString())
+	}
+	if cf.UnlockedKdfParams() != params {
+		t.Errorf("KDF parameters not preserved: %+v", cf.UnlockedKdfParams())
+	}
+	// And back to scrypt
+	cf.EncryptKey(key, "test", testKdfParams)
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		t.Error("Argon2id flag has not been cleared")
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	fn := "config_test/blocksize.conf"
+	os.Remove(fn)
+	defer os.Remove(fn)
+	err := CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams, BlockSize: 5000})
+	if err == nil {
+		t.Error("block size that is not a power of two must be rejected")
+	}
+	err = CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams, BlockSize: 64 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagBlockSize) || cf.PlainBS() != 64*1024 {
+		t.Errorf("wrong block size: flags=%v size=%d", cf.FeatureFlags, cf.PlainBS())
+	}
+	// The default block size is not stored
+	err = CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err = LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.IsFeatureFlagSet(FlagBlockSize) || cf.BlockSize != 0 || cf.PlainBS() != contentenc.DefaultBS {
+		t.Errorf("default block size: flags=%v size=%d", cf.FeatureFlags, cf.BlockSize)
+	}
+}
+
+func TestXChaCha20Poly1305(t *testing.T) {
+	fn := "config_test/xchacha.conf"
+	os.Remove(fn)
+	defer os.Remove(fn)
+	err := CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS, XChaCha20Poly1305: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) {
+		t.Error("XChaCha20Poly1305 flag is not set")
+	}
+	if cf.IsFeatureFlagSet(FlagGCMIV128) {
+		t.Error("GCMIV128 flag must not be set, GCM is not used")
+	}
+}
+
+func TestAESSIV(t *testing.T) {
+	fn := "config_test/aessiv.conf"
+	os.Remove(fn)
+	defer os.Remove(fn)
+	err := CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS, AESSIV: true, XChaCha20Poly1305: true})
+	if err == nil {
+		t.Error("AES-SIV and XChaCha20-Poly1305 together must be rejected")
+	}
+	err = CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS, AESSIV: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagAESSIV) || !cf.IsFeatureFlagSet(FlagGCMIV128) {
+		t.Errorf("wrong feature flags: %v", cf.FeatureFlags)
+	}
+	// A config file that has been edited to enable both must not load
+	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXChaCha20Poly1305])
+	os.Remove(fn)
+	err = cf.WriteFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(fn)
+	if err == nil {
+		t.Error("AES-SIV and XChaCha20-Poly1305 together must be rejected by Load")
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	fn := "config_test/hkdf.conf"
+	os.Remove(fn)
+	defer os.Remove(fn)
+	err := CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS, HKDF: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagHKDF) {
+		t.Error("HKDF flag is not set")
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	fn := "config_test/integrity.conf"
+	os.Remove(fn)
+	defer os.Remove(fn)
+	err := CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS, Integrity: true})
+	if err == nil {
+		t.Error("Integrity without HeaderV3 must be rejected")
+	}
+	err = CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS, HeaderV3: true, Integrity: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagIntegrity) || !cf.IsFeatureFlagSet(FlagHeaderV3) {
+		t.Errorf("wrong feature flags: %v", cf.FeatureFlags)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	fn := "config_test/compress.conf"
+	os.Remove(fn)
+	defer os.Remove(fn)
+	err := CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS, Compress: true})
+	if err == nil {
+		t.Error("Compress without HeaderV3 must be rejected")
+	}
+	err = CreateConfFile(&CreateArgs{Filename: fn, Password: "test", Kdf: testKdfParams,
+		BlockSize: contentenc.DefaultBS, HeaderV3: true, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagCompress) || !cf.IsFeatureFlagSet(FlagHeaderV3) {
+		t.Errorf("wrong feature flags: %v", cf.FeatureFlags)
+	}
+}
@@ -8,15 +8,33 @@ const (
 	FlagEMENames
 	FlagGCMIV128
 	FlagLongNames
+	FlagArgon2id
+	FlagXattr
+	FlagBlockSize
+	FlagXChaCha20Poly1305
+	FlagAESSIV
+	FlagHKDF
+	FlagHeaderV3
+	FlagIntegrity
+	FlagCompress
 )
 
 // knownFlags stores the known feature flags and their string representation
 var knownFlags map[flagIota]string = map[flagIota]string{
-	FlagPlaintextNames: "PlaintextNames",
-	FlagDirIV:          "DirIV",
-	FlagEMENames:       "EMENames",
-	FlagGCMIV128:       "GCMIV128",
-	FlagLongNames:      "LongNames",
+	FlagPlaintextNames:    "PlaintextNames",
+	FlagDirIV:             "DirIV",
+	FlagEMENames:          "EMENames",
+	FlagGCMIV128:          "GCMIV128",
+	FlagLongNames:         "LongNames",
+	FlagArgon2id:          "Argon2id",
+	FlagXattr:             "Xattr",
+	FlagBlockSize:         "BlockSize",
+	FlagXChaCha20Poly1305: "XChaCha20Poly1305",
+	FlagAESSIV:            "AESSIV",
+	FlagHKDF:              "HKDF",
+	FlagHeaderV3:          "HeaderV3",
+	FlagIntegrity:         "Integrity",
+	FlagCompress:          "Compress",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -52,3 +70,22 @@ func (cf *ConfFile) IsFeatureFlagSet(flagWant flagIota) bool {
 	}
 	return false
 }
+
+// setFeatureFlag - enable feature flag "flag" if it is not already enabled
+func (cf *ConfFile) setFeatureFlag(flag flagIota) {
+	if cf.IsFeatureFlagSet(flag) {
+		return
+	}
+	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[flag])
+}
+
+// clearFeatureFlag - disable feature flag "flag"
+func (cf *ConfFile) clearFeatureFlag(flag flagIota) {
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[flag] {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+}
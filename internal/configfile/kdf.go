@@ -1,6 +1,7 @@
 package configfile
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"os"
@@ -17,6 +18,33 @@ const (
 	ScryptDefaultLogN = 16
 )
 
+// Names of the supported password hashing functions, see KdfParams.Name
+const (
+	KdfScrypt   = "scrypt"
+	KdfArgon2id = "argon2id"
+)
+
+// kdf is implemented by all supported password hashing functions
+type kdf interface {
+	// DeriveKey - hash the password "pw" into a key
+	DeriveKey(pw string) []byte
+	// String - human-readable name and parameters
+	String() string
+}
+
+// KdfParams selects the password hashing function and its cost for a new
+// keyslot
+type KdfParams struct {
+	// KdfScrypt or KdfArgon2id
+	Name string
+	// scrypt cost parameter logN
+	ScryptLogN int
+	// Argon2id cost parameters, see argon2idKdf
+	Argon2idTime    uint32
+	Argon2idMemory  uint32
+	Argon2idThreads uint8
+}
+
 type scryptKdf struct {
 	Salt   []byte
 	N      int
@@ -51,6 +79,11 @@ func (s *scryptKdf) DeriveKey(pw string) []byte {
 	return k
 }
 
+func (s *scryptKdf) String() string {
+	return fmt.Sprintf("scrypt Salt=%dB N=%d R=%d P=%d KeyLen=%d",
+		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+}
+
 // LogN - N is saved as 2^LogN, but LogN is much easier to work with.
 // This function gives you LogN = Log2(N).
 func (s *scryptKdf) LogN() int {
@@ -58,3 +58,18 @@ func BenchmarkScrypt16(b *testing.B) {
 func BenchmarkScrypt17(b *testing.B) {
 	benchmarkScryptN(17, b)
 }
+
+func benchmarkArgon2id(memoryMiB uint32, b *testing.B) {
+	kdf := NewArgon2idKdf(Argon2idDefaultTime, memoryMiB*1024, Argon2idDefaultThreads)
+	for i := 0; i < b.N; i++ {
+		kdf.DeriveKey("test")
+	}
+}
+
+func BenchmarkArgon2id16M(b *testing.B) {
+	benchmarkArgon2id(16, b)
+}
+
+func BenchmarkArgon2id64M(b *testing.B) {
+	benchmarkArgon2id(64, b)
+}
@@ -0,0 +1,225 @@
+package configfile
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// DefaultKeyslotLabel is the label of the keyslot that is created by "-init".
+// Config files written before keyslots were introduced get this label as well.
+const DefaultKeyslotLabel = "default"
+
+// Keyslot - a copy of the master key, encrypted with a key that is derived
+// from a password. Every keyslot wraps the same master key, so a password
+// can be revoked by deleting its keyslot without re-encrypting any data.
+type Keyslot struct {
+	// Human-readable name, unique within the config file
+	Label string
+	// Encrypted AES key, unlocked using a password hashed with the KDF
+	EncryptedKey []byte
+	// Exactly one of the KDF objects is set. It stores the parameters for
+	// password hashing (key derivation).
+	ScryptObject   *scryptKdf   `json:",omitempty"`
+	Argon2idObject *argon2idKdf `json:",omitempty"`
+}
+
+// newKeyslot - encrypt "key" using a hash generated from "password".
+// "params" selects the KDF and its cost.
+func newKeyslot(key []byte, password string, params KdfParams, label string) Keyslot {
+	ks := Keyslot{
+		Label: label,
+	}
+	switch params.Name {
+	case KdfArgon2id:
+		a := NewArgon2idKdf(params.Argon2idTime, params.Argon2idMemory, params.Argon2idThreads)
+		ks.Argon2idObject = &a
+	default:
+		s := NewScryptKdf(params.ScryptLogN)
+		ks.ScryptObject = &s
+	}
+	// Generate derived key from password
+	pwHash := ks.kdf().DeriveKey(password)
+
+	// Lock master key using password-based key
+	cc := cryptocore.New(pwHash, cryptocore.BackendGoGCM, false, false)
+	ce := contentenc.New(cc, 4096, false, false, false)
+	ks.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	return ks
+}
+
+// kdf - the KDF that is used by this keyslot. Returns nil if there is none.
+func (ks *Keyslot) kdf() kdf {
+	if ks.Argon2idObject != nil {
+		return ks.Argon2idObject
+	}
+	if ks.ScryptObject != nil {
+		return ks.ScryptObject
+	}
+	return nil
+}
+
+// KdfParams - the KDF and cost that are used by this keyslot
+func (ks *Keyslot) KdfParams() KdfParams {
+	if a := ks.Argon2idObject; a != nil {
+		return KdfParams{
+			Name:            KdfArgon2id,
+			Argon2idTime:    a.Time,
+			Argon2idMemory:  a.Memory,
+			Argon2idThreads: a.Threads,
+		}
+	}
+	params := KdfParams{Name: KdfScrypt, ScryptLogN: ScryptDefaultLogN}
+	if ks.ScryptObject != nil {
+		params.ScryptLogN = ks.ScryptObject.LogN()
+	}
+	return params
+}
+
+// KdfString - human-readable description of the KDF used by this keyslot
+func (ks *Keyslot) KdfString() string {
+	kdf := ks.kdf()
+	if kdf == nil {
+		return "none"
+	}
+	return kdf.String()
+}
+
+// unlock - decrypt the master key stored in the keyslot using "password"
+func (ks *Keyslot) unlock(password string) ([]byte, error) {
+	kdf := ks.kdf()
+	if kdf == nil {
+		return nil, fmt.Errorf("keyslot %q has no KDF", ks.Label)
+	}
+	if ks.Argon2idObject != nil {
+		// Argon2 panics on invalid parameters
+		if err := ks.Argon2idObject.validate(); err != nil {
+			return nil, err
+		}
+	}
+	// Generate derived key from password
+	pwHash := kdf.DeriveKey(password)
+
+	// Unlock master key using password-based key
+	// We use stock go GCM instead of OpenSSL here as we only use 96-bit IVs,
+	// speed is not important and we get better error messages
+	cc := cryptocore.New(pwHash, cryptocore.BackendGoGCM, false, false)
+	ce := contentenc.New(cc, 4096, false, false, false)
+
+	toggledlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
+	key, err := ce.DecryptBlock(ks.EncryptedKey, 0, nil)
+	toggledlog.Warn.Enabled = true
+	return key, err
+}
+
+// findKeyslot - return the index of the keyslot labeled "label", or -1
+func (cf *ConfFile) findKeyslot(label string) int {
+	for i := range cf.Keyslots {
+		if cf.Keyslots[i].Label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddKeyslot - encrypt "key" using "password" and store it in a new keyslot
+// labeled "label". "params" selects the KDF and its cost.
+func (cf *ConfFile) AddKeyslot(key []byte, password string, params KdfParams, label string) error {
+	if label == "" {
+		return fmt.Errorf("Keyslot label must not be empty")
+	}
+	if cf.findKeyslot(label) >= 0 {
+		return fmt.Errorf("Keyslot %q already exists", label)
+	}
+	cf.Keyslots = append(cf.Keyslots, newKeyslot(key, password, params, label))
+	cf.syncKeyslots()
+	return nil
+}
+
+// RemoveKeyslot - delete the keyslot labeled "label". The last keyslot
+// cannot be removed as that would make the filesystem inaccessible.
+func (cf *ConfFile) RemoveKeyslot(label string) error {
+	i := cf.findKeyslot(label)
+	if i < 0 {
+		return fmt.Errorf("Keyslot %q not found", label)
+	}
+	if len(cf.Keyslots) == 1 {
+		return fmt.Errorf("Refusing to remove the last keyslot")
+	}
+	cf.Keyslots = append(cf.Keyslots[:i], cf.Keyslots[i+1:]...)
+	if cf.unlockedSlot > i {
+		cf.unlockedSlot--
+	} else if cf.unlockedSlot == i {
+		cf.unlockedSlot = -1
+	}
+	cf.syncKeyslots()
+	return nil
+}
+
+// syncKeyslots - must be called after the keyslots have changed.
+//
+// Copies the first keyslot to the top-level EncryptedKey and ScryptObject
+// fields. Older gocryptfs versions only know these fields and can still
+// mount the filesystem using the password of the first slot.
+//
+// Sets the Argon2id feature flag if any keyslot uses Argon2id, so that
+// older versions refuse to mount instead of failing with "Password
+// incorrect".
+func (cf *ConfFile) syncKeyslots() {
+	if len(cf.Keyslots) == 0 {
+		return
+	}
+	cf.EncryptedKey = cf.Keyslots[0].EncryptedKey
+	cf.ScryptObject = scryptKdf{}
+	if cf.Keyslots[0].ScryptObject != nil {
+		cf.ScryptObject = *cf.Keyslots[0].ScryptObject
+	}
+	argon2id := false
+	for _, ks := range cf.Keyslots {
+		if ks.Argon2idObject != nil {
+			argon2id = true
+		}
+	}
+	if argon2id {
+		cf.setFeatureFlag(FlagArgon2id)
+	} else {
+		cf.clearFeatureFlag(FlagArgon2id)
+	}
+}
+
+// UnlockedKdfParams - the KDF and cost of the keyslot that was unlocked by
+// LoadConfFile
+func (cf *ConfFile) UnlockedKdfParams() KdfParams {
+	if cf.unlockedSlot < 0 || cf.unlockedSlot >= len(cf.Keyslots) {
+		return KdfParams{Name: KdfScrypt, ScryptLogN: ScryptDefaultLogN}
+	}
+	return cf.Keyslots[cf.unlockedSlot].KdfParams()
+}
+
+// ResetKeyslots - replace all keyslots by a single keyslot that stores "key"
+// encrypted with "password". The keyslot that was unlocked by LoadConfFile
+// keeps its label, KDF and cost. Used when the master key changes, as the
+// passwords of the other keyslots are not known.
+// Returns the labels of the keyslots that were dropped.
+func (cf *ConfFile) ResetKeyslots(key []byte, password string) (dropped []string) {
+	params := cf.UnlockedKdfParams()
+	var keep []Keyslot
+	for i, ks := range cf.Keyslots {
+		if i == cf.unlockedSlot {
+			keep = append(keep, ks)
+		} else {
+			dropped = append(dropped, ks.Label)
+		}
+	}
+	cf.Keyslots = keep
+	cf.unlockedSlot = len(keep) - 1
+	cf.EncryptKey(key, password, params)
+	return dropped
+}
+
+// SetFilename - change the file the config is saved to by WriteFile
+func (cf *ConfFile) SetFilename(filename string) {
+	cf.filename = filename
+}
@@ -0,0 +1,168 @@
+package contentenc
+
+// Compression mode: the plaintext of every content block is compressed with
+// deflate before it is encrypted. Every block is still stored in a slot of
+// CipherBS bytes so offsets can be computed like before. The unused rest of
+// the slot is zero padding that the backing filesystem can store sparsely or
+// compress.
+//
+// Slot layout:
+// [ "Length" uint32 big endian ] [ nonce | payload | tag ] [ zero padding ]
+// "Length" is the length of the encrypted part. The payload is
+// [ "Method" uint8 ] [ "CompressedLen" uint32 big endian ] [ data ]
+// The payload is authenticated, "CompressedLen" must match the length of
+// "data". Incompressible blocks are stored with method compressStored.
+//
+// The plaintext size of a file cannot be derived from the ciphertext size
+// anymore, it is stored in the version 3 file header.
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+const (
+	// Length of the "Length" field in front of the encrypted part
+	compressLenLen = 4
+	// Length of the "Method" and "CompressedLen" fields of the payload
+	compressPayloadHeaderLen = 1 + 4
+	// Slot size minus normal ciphertext block size
+	compressOverhead = compressLenLen + compressPayloadHeaderLen
+
+	// Payload methods
+	compressStored  = 0
+	compressDeflate = 1
+)
+
+// Deflate state is expensive to allocate, reuse it
+var deflateWriters = sync.Pool{
+	New: func() interface{} {
+		// BestSpeed as every write goes through here
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var deflateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(bytes.NewReader(nil))
+	},
+}
+
+// compressBlock - build the payload for plaintext block "plaintext"
+func compressBlock(plaintext []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(compressPayloadHeaderLen + len(plaintext))
+	buf.Write(make([]byte, compressPayloadHeaderLen))
+	w := deflateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(plaintext)
+	w.Close()
+	deflateWriters.Put(w)
+	payload := buf.Bytes()
+	payload[0] = compressDeflate
+	if len(payload)-compressPayloadHeaderLen >= len(plaintext) {
+		// Incompressible
+		payload = append(payload[:compressPayloadHeaderLen], plaintext...)
+		payload[0] = compressStored
+	}
+	binary.BigEndian.PutUint32(payload[1:compressPayloadHeaderLen], uint32(len(payload)-compressPayloadHeaderLen))
+	return payload
+}
+
+// decompressBlock - get the plaintext block back from "payload". The result
+// is at most "plainBS" bytes long.
+func decompressBlock(payload []byte, plainBS uint64) ([]byte, error) {
+	if len(payload) < compressPayloadHeaderLen {
+		return nil, errors.New("compressed payload is too short")
+	}
+	method := payload[0]
+	data := payload[compressPayloadHeaderLen:]
+	compressedLen := binary.BigEndian.Uint32(payload[1:compressPayloadHeaderLen])
+	if uint64(compressedLen) != uint64(len(data)) {
+		return nil, fmt.Errorf("compressed length %d does not match the payload (%d)", compressedLen, len(data))
+	}
+	switch method {
+	case compressStored:
+		if uint64(len(data)) > plainBS {
+			return nil, errors.New("stored block is too big")
+		}
+		return data, nil
+	case compressDeflate:
+		r := deflateReaders.Get().(io.ReadCloser)
+		defer deflateReaders.Put(r)
+		r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+		plaintext, err := ioutil.ReadAll(io.LimitReader(r, int64(plainBS)+1))
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(plaintext)) > plainBS {
+			return nil, errors.New("decompressed block is too big")
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("unknown compression method %d", method)
+}
+
+// EncryptFileBlock - encrypt a content block of a regular file. In
+// compression mode, the block is compressed and padded to a full slot.
+// Everything that is not file content (headers, symlink targets, xattrs) uses
+// EncryptBlock.
+func (be *ContentEnc) EncryptFileBlock(plaintext []byte, blockNo uint64, fileID []byte) []byte {
+	if !be.compress || len(plaintext) == 0 {
+		return be.EncryptBlock(plaintext, blockNo, fileID)
+	}
+	sealed := be.EncryptBlock(compressBlock(plaintext), blockNo, fileID)
+	slot := make([]byte, be.cipherBS)
+	binary.BigEndian.PutUint32(slot, uint32(len(sealed)))
+	copy(slot[compressLenLen:], sealed)
+	return slot
+}
+
+// DecryptFileBlock - counterpart of EncryptFileBlock. An all-zero slot is a
+// file hole, like in DecryptBlock.
+func (be *ContentEnc) DecryptFileBlock(ciphertext []byte, blockNo uint64, fileID []byte) ([]byte, error) {
+	if !be.compress || len(ciphertext) == 0 || bytes.Equal(ciphertext, be.allZeroBlock) {
+		return be.DecryptBlock(ciphertext, blockNo, fileID)
+	}
+	end := be.UsedLen(ciphertext)
+	if end > uint64(len(ciphertext)) {
+		toggledlog.Warn.Printf("DecryptFileBlock: slot is too short: %d bytes, want %d", len(ciphertext), end)
+		return nil, errors.New("Slot is too short")
+	}
+	if !bytes.Equal(ciphertext[end:], be.allZeroBlock[:uint64(len(ciphertext))-end]) {
+		toggledlog.Warn.Printf("DecryptFileBlock: padding is not zero")
+		return nil, errors.New("Padding is not zero")
+	}
+	payload, err := be.DecryptBlock(ciphertext[compressLenLen:end], blockNo, fileID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decompressBlock(payload, be.plainBS)
+	if err != nil {
+		toggledlog.Warn.Printf("DecryptFileBlock: %v", err)
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// UsedLen - number of bytes at the start of ciphertext block "block" that
+// are not zero padding. The result may exceed len(block) if the slot has
+// been cut off.
+func (be *ContentEnc) UsedLen(block []byte) uint64 {
+	if !be.compress {
+		return uint64(len(block))
+	}
+	if len(block) < compressLenLen {
+		return compressLenLen
+	}
+	return compressLenLen + uint64(binary.BigEndian.Uint32(block))
+}
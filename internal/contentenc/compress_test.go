@@ -0,0 +1,96 @@
+package contentenc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, false)
+	f := New(cc, DefaultBS, true, false, true)
+	text := bytes.Repeat([]byte("2016-10-16 12:00:00 INFO something happened\n"), 100)[:DefaultBS]
+	random := cryptocore.RandBytes(DefaultBS)
+	fileID := cryptocore.RandBytes(HEADER_ID_LEN)
+	for _, plaintext := range [][]byte{text, random, text[:100], random[:100]} {
+		slot := f.EncryptFileBlock(plaintext, 5, fileID)
+		if uint64(len(slot)) != f.CipherBS() {
+			t.Errorf("wrong slot length %d, want %d", len(slot), f.CipherBS())
+		}
+		out, err := f.DecryptFileBlock(slot, 5, fileID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, plaintext) {
+			t.Errorf("block of length %d did not survive the round trip", len(plaintext))
+		}
+		// The block number is still authenticated
+		_, err = f.DecryptFileBlock(slot, 6, fileID)
+		if err == nil {
+			t.Error("block accepted at the wrong position")
+		}
+	}
+	slot := f.EncryptFileBlock(text, 0, fileID)
+	if f.UsedLen(slot) > DefaultBS/4 {
+		t.Errorf("text block was not compressed: %d bytes used", f.UsedLen(slot))
+	}
+	// File holes pass through
+	out, err := f.DecryptFileBlock(f.AllZeroBlock(), 0, fileID)
+	if err != nil || !bytes.Equal(out, make([]byte, DefaultBS)) {
+		t.Errorf("file hole was not passed through: %v", err)
+	}
+}
+
+// Garbage in the padding or a manipulated length must be rejected
+func TestCompressTamper(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, false)
+	f := New(cc, DefaultBS, true, false, true)
+	slot := f.EncryptFileBlock(make([]byte, DefaultBS), 0, nil)
+	used := f.UsedLen(slot)
+
+	padding := append([]byte{}, slot...)
+	padding[used] = 1
+	if _, err := f.DecryptFileBlock(padding, 0, nil); err == nil {
+		t.Error("non-zero padding accepted")
+	}
+	length := append([]byte{}, slot...)
+	length[compressLenLen-1]++
+	if _, err := f.DecryptFileBlock(length, 0, nil); err == nil {
+		t.Error("manipulated length accepted")
+	}
+	if _, err := f.DecryptFileBlock(slot[:used-1], 0, nil); err == nil {
+		t.Error("cut off slot accepted")
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	payload := compressBlock(make([]byte, 2*DefaultBS))
+	if _, err := decompressBlock(payload, DefaultBS); err == nil {
+		t.Error("oversized block accepted")
+	}
+	payload = compressBlock([]byte("hello"))
+	payload[4]++
+	if _, err := decompressBlock(payload, DefaultBS); err == nil {
+		t.Error("wrong compressed length accepted")
+	}
+}
+
+// Every block occupies a full slot, so sizes are rounded up to whole blocks
+func TestCompressSizes(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, false)
+	f := New(cc, DefaultBS, true, false, true)
+	for _, plainSize := range []uint64{1, DefaultBS - 1, DefaultBS, DefaultBS + 1} {
+		blocks := (plainSize + DefaultBS - 1) / DefaultBS
+		cipherSize := f.PlainSizeToCipherSize(plainSize)
+		if cipherSize != f.HeaderLen()+blocks*f.CipherBS() {
+			t.Errorf("size %d: wrong ciphertext size %d", plainSize, cipherSize)
+		}
+		if f.CipherSizeToPlainSize(cipherSize) != blocks*DefaultBS {
+			t.Errorf("size %d: wrong upper bound %d", plainSize, f.CipherSizeToPlainSize(cipherSize))
+		}
+	}
+}
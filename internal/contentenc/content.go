@@ -7,19 +7,89 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"runtime"
+	"sync"
 
 	"github.com/rfjakob/gocryptfs/internal/toggledlog"
 )
 
-// DecryptBlocks - Decrypt a number of blocks
+// Every goroutine of a parallel request gets at least this many bytes
+const parallelMinBytes = 32 * 1024
+
+// parallelGroupSize - number of blocks per goroutine when "blockCount" blocks
+// of "blockSize" bytes are split across GOMAXPROCS goroutines, but not more
+// goroutines than there are CPUs. The request should be processed serially if
+// the result is not smaller than "blockCount".
+func parallelGroupSize(blockCount int, blockSize int) int {
+	workers := runtime.GOMAXPROCS(0)
+	if n := runtime.NumCPU(); n < workers {
+		workers = n
+	}
+	groupSize := (blockCount + workers - 1) / workers
+	minBlocks := (parallelMinBytes + blockSize - 1) / blockSize
+	if groupSize < minBlocks {
+		groupSize = minBlocks
+	}
+	return groupSize
+}
+
+// DecryptBlocks - Decrypt a number of file content blocks. Large requests are
+// split across goroutines. Like in the serial case, the returned plaintext
+// ends at the first block that failed to decrypt.
 func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileId []byte) ([]byte, error) {
+	cipherBS := int(be.cipherBS)
+	blockCount := (len(ciphertext) + cipherBS - 1) / cipherBS
+	return be.decryptBlocksSplit(ciphertext, firstBlockNo, fileId, parallelGroupSize(blockCount, cipherBS))
+}
+
+// decryptBlocksSplit - Decrypt a number of file content blocks with one
+// goroutine per "groupSize" blocks
+func (be *ContentEnc) decryptBlocksSplit(ciphertext []byte, firstBlockNo uint64, fileId []byte, groupSize int) ([]byte, error) {
+	cipherBS := int(be.cipherBS)
+	blockCount := (len(ciphertext) + cipherBS - 1) / cipherBS
+	if groupSize >= blockCount {
+		return be.decryptBlocksSerial(ciphertext, firstBlockNo, fileId)
+	}
+	type result struct {
+		plaintext []byte
+		err       error
+	}
+	results := make([]result, (blockCount+groupSize-1)/groupSize)
+	var wg sync.WaitGroup
+	for i := range results {
+		start := i * groupSize * cipherBS
+		end := start + groupSize*cipherBS
+		if end > len(ciphertext) {
+			end = len(ciphertext)
+		}
+		wg.Add(1)
+		go func(i int, c []byte, blockNo uint64) {
+			results[i].plaintext, results[i].err = be.decryptBlocksSerial(c, blockNo, fileId)
+			wg.Done()
+		}(i, ciphertext[start:end], firstBlockNo+uint64(i*groupSize))
+	}
+	wg.Wait()
+	var pBuf bytes.Buffer
+	pBuf.Grow(blockCount * int(be.plainBS))
+	for _, r := range results {
+		pBuf.Write(r.plaintext)
+		if r.err != nil {
+			return pBuf.Bytes(), r.err
+		}
+	}
+	return pBuf.Bytes(), nil
+}
+
+// decryptBlocksSerial - Decrypt a number of file content blocks one after
+// the other
+func (be *ContentEnc) decryptBlocksSerial(ciphertext []byte, firstBlockNo uint64, fileId []byte) ([]byte, error) {
 	cBuf := bytes.NewBuffer(ciphertext)
 	var err error
 	var pBuf bytes.Buffer
 	for cBuf.Len() > 0 {
 		cBlock := cBuf.Next(int(be.cipherBS))
 		var pBlock []byte
-		pBlock, err = be.DecryptBlock(cBlock, firstBlockNo, fileId)
+		pBlock, err = be.DecryptFileBlock(cBlock, firstBlockNo, fileId)
 		if err != nil {
 			break
 		}
@@ -72,6 +142,41 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileId []b
 	return plaintext, nil
 }
 
+// EncryptBlocks - Encrypt a number of file content blocks. Block "i" gets
+// block number firstBlockNo+i. Large requests are split across goroutines.
+func (be *ContentEnc) EncryptBlocks(plaintexts [][]byte, firstBlockNo uint64, fileID []byte) [][]byte {
+	return be.encryptBlocksSplit(plaintexts, firstBlockNo, fileID, parallelGroupSize(len(plaintexts), int(be.plainBS)))
+}
+
+// encryptBlocksSplit - Encrypt a number of file content blocks with one
+// goroutine per "groupSize" blocks
+func (be *ContentEnc) encryptBlocksSplit(plaintexts [][]byte, firstBlockNo uint64, fileID []byte, groupSize int) [][]byte {
+	ciphertexts := make([][]byte, len(plaintexts))
+	encryptGroup := func(start int, end int) {
+		for i := start; i < end; i++ {
+			ciphertexts[i] = be.EncryptFileBlock(plaintexts[i], firstBlockNo+uint64(i), fileID)
+		}
+	}
+	if groupSize >= len(plaintexts) {
+		encryptGroup(0, len(plaintexts))
+		return ciphertexts
+	}
+	var wg sync.WaitGroup
+	for start := 0; start < len(plaintexts); start += groupSize {
+		end := start + groupSize
+		if end > len(plaintexts) {
+			end = len(plaintexts)
+		}
+		wg.Add(1)
+		go func(start int, end int) {
+			encryptGroup(start, end)
+			wg.Done()
+		}(start, end)
+	}
+	wg.Wait()
+	return ciphertexts
+}
+
 // encryptBlock - Encrypt and add IV and MAC
 func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []byte) []byte {
 
@@ -83,6 +188,24 @@ func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []by
 	// Get fresh nonce
 	nonce := be.cryptoCore.GcmIVGen.Get()
 
+	return be.EncryptBlockNonce(plaintext, blockNo, fileID, nonce)
+}
+
+// EncryptBlockNonce - Encrypt and add the explicitly passed "nonce" and the MAC.
+// The caller is responsible for never reusing a nonce with different
+// plaintext. This is used by reverse mode, which needs deterministic
+// ciphertext.
+func (be *ContentEnc) EncryptBlockNonce(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
+
+	// Empty block?
+	if len(plaintext) == 0 {
+		return plaintext
+	}
+
+	if len(nonce) != be.cryptoCore.IVLen {
+		panic("wrong nonce length")
+	}
+
 	// Authenticate block with block number and file ID
 	aData := make([]byte, 8)
 	binary.BigEndian.PutUint64(aData, blockNo)
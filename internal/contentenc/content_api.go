@@ -1,12 +1,28 @@
 package contentenc
 
-import "github.com/rfjakob/gocryptfs/internal/cryptocore"
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
 
 const (
 	// Default plaintext block size
 	DefaultBS = 4096
+	// Smallest and largest plaintext block size a filesystem can use
+	MinBS = 4096
+	MaxBS = 1024 * 1024
 )
 
+// CheckBS - verify that "plainBS" is a power of two between MinBS and MaxBS
+func CheckBS(plainBS uint64) error {
+	if plainBS < MinBS || plainBS > MaxBS || plainBS&(plainBS-1) != 0 {
+		return fmt.Errorf("Invalid block size %d: must be a power of two between %d and %d",
+			plainBS, MinBS, MaxBS)
+	}
+	return nil
+}
+
 type ContentEnc struct {
 	// Cryptographic primitives
 	cryptoCore *cryptocore.CryptoCore
@@ -16,20 +32,72 @@ type ContentEnc struct {
 	cipherBS uint64
 	// All-zero block of size cipherBS, for fast compares
 	allZeroBlock []byte
+	// File header length, depends on the header version
+	headerLen uint64
+	// Integrity mode: the header stores the root of a hash tree over all
+	// blocks
+	integrity bool
+	// Compression mode: content blocks are compressed before encryption
+	compress bool
 }
 
-func New(cc *cryptocore.CryptoCore, plainBS uint64) *ContentEnc {
+// New - create a ContentEnc. "headerV3" selects version 3 file headers,
+// which carry an authenticated metadata block, instead of version 2.
+// "integrity" adds the hash tree root to the metadata and requires
+// "headerV3". "compress" compresses the content blocks and requires
+// "headerV3" as well because the file size is no longer implied by the
+// ciphertext size.
+func New(cc *cryptocore.CryptoCore, plainBS uint64, headerV3 bool, integrity bool, compress bool) *ContentEnc {
+	if integrity && !headerV3 {
+		panic("integrity mode requires version 3 file headers")
+	}
+	if compress && !headerV3 {
+		panic("compression mode requires version 3 file headers")
+	}
 
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
+	if compress {
+		cipherBS += compressOverhead
+	}
+
+	headerLen := uint64(HEADER_LEN)
+	if headerV3 {
+		headerLen += uint64(cc.IVLen) + HEADER_META_LEN + cryptocore.AuthTagLen
+	}
+	if integrity {
+		headerLen += HEADER_ROOT_LEN
+	}
 
 	return &ContentEnc{
 		cryptoCore:   cc,
 		plainBS:      plainBS,
 		cipherBS:     cipherBS,
 		allZeroBlock: make([]byte, cipherBS),
+		headerLen:    headerLen,
+		integrity:    integrity,
+		compress:     compress,
 	}
 }
 
 func (be *ContentEnc) PlainBS() uint64 {
 	return be.plainBS
 }
+
+func (be *ContentEnc) CipherBS() uint64 {
+	return be.cipherBS
+}
+
+// Integrity - is integrity mode enabled?
+func (be *ContentEnc) Integrity() bool {
+	return be.integrity
+}
+
+// Compression - is compression mode enabled?
+func (be *ContentEnc) Compression() bool {
+	return be.compress
+}
+
+// AllZeroBlock - the ciphertext of a file hole, which is not encrypted
+func (be *ContentEnc) AllZeroBlock() []byte {
+	return be.allZeroBlock
+}
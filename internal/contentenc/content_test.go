@@ -1,6 +1,7 @@
 package contentenc
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -23,8 +24,8 @@ func TestSplitRange(t *testing.T) {
 		testRange{6654, 8945})
 
 	key := make([]byte, cryptocore.KeyLen)
-	cc := cryptocore.New(key, true, true)
-	f := New(cc, DefaultBS)
+	cc := cryptocore.New(key, cryptocore.BackendOpenSSL, true, false)
+	f := New(cc, DefaultBS, false, false, false)
 
 	for _, r := range ranges {
 		parts := f.ExplodePlainRange(r.offset, r.length)
@@ -51,8 +52,8 @@ func TestCiphertextRange(t *testing.T) {
 		testRange{6654, 8945})
 
 	key := make([]byte, cryptocore.KeyLen)
-	cc := cryptocore.New(key, true, true)
-	f := New(cc, DefaultBS)
+	cc := cryptocore.New(key, cryptocore.BackendOpenSSL, true, false)
+	f := New(cc, DefaultBS, false, false, false)
 
 	for _, r := range ranges {
 
@@ -74,8 +75,8 @@ func TestCiphertextRange(t *testing.T) {
 
 func TestBlockNo(t *testing.T) {
 	key := make([]byte, cryptocore.KeyLen)
-	cc := cryptocore.New(key, true, true)
-	f := New(cc, DefaultBS)
+	cc := cryptocore.New(key, cryptocore.BackendOpenSSL, true, false)
+	f := New(cc, DefaultBS, false, false, false)
 
 	b := f.CipherOffToBlockNo(788)
 	if b != 0 {
@@ -94,3 +95,94 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+func TestExplodeCipherRange(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendOpenSSL, true, false)
+	f := New(cc, DefaultBS, false, false, false)
+
+	var ranges []testRange
+	ranges = append(ranges, testRange{HEADER_LEN, 70000},
+		testRange{HEADER_LEN + 10, 10},
+		testRange{HEADER_LEN + 4100, 6511},
+		testRange{HEADER_LEN + f.cipherBS - 1, 2})
+
+	for _, r := range ranges {
+		blocks := f.ExplodeCipherRange(r.offset, r.length)
+		var sum uint64
+		for _, b := range blocks {
+			if b.Skip+b.Length > f.cipherBS {
+				t.Errorf("block #%d overflows: skip=%d length=%d", b.BlockNo, b.Skip, b.Length)
+			}
+			sum += b.Length
+		}
+		if sum != r.length {
+			t.Errorf("lengths do not add up: got %d, want %d", sum, r.length)
+		}
+		if f.BlockNoToCipherOff(blocks[0].BlockNo)+blocks[0].Skip != r.offset {
+			t.Errorf("wrong start offset for range %v", r)
+		}
+	}
+}
+
+func TestCheckBS(t *testing.T) {
+	for _, bs := range []uint64{MinBS, 8192, 64 * 1024, MaxBS} {
+		if err := CheckBS(bs); err != nil {
+			t.Errorf("block size %d: %v", bs, err)
+		}
+	}
+	for _, bs := range []uint64{0, 512, 5000, MaxBS * 2} {
+		if CheckBS(bs) == nil {
+			t.Errorf("block size %d must be rejected", bs)
+		}
+	}
+}
+
+// Size translation must be consistent for every block size
+func TestSizesBS(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendOpenSSL, true, false)
+	for _, headerV3 := range []bool{false, true} {
+		for _, bs := range []uint64{MinBS, 64 * 1024, MaxBS} {
+			f := New(cc, bs, headerV3, false, false)
+			for _, plainSize := range []uint64{1, bs - 1, bs, bs + 1, 10*bs + 17} {
+				cipherSize := f.PlainSizeToCipherSize(plainSize)
+				if f.CipherSizeToPlainSize(cipherSize) != plainSize {
+					t.Errorf("bs=%d headerV3=%v: size %d does not survive the round trip",
+						bs, headerV3, plainSize)
+				}
+			}
+		}
+	}
+}
+
+// The parallel path must return the blocks in order and stop at the first
+// corrupt block like the serial path
+func TestBlocksParallel(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, false)
+	f := New(cc, DefaultBS, false, false, false)
+	fileID := cryptocore.RandBytes(HEADER_ID_LEN)
+	var plaintexts [][]byte
+	for i := 0; i < 64; i++ {
+		plaintexts = append(plaintexts, bytes.Repeat([]byte{byte(i)}, DefaultBS))
+	}
+	plaintexts[63] = plaintexts[63][:100]
+	// 64 blocks in groups of 5
+	ciphertext := bytes.Join(f.encryptBlocksSplit(plaintexts, 10, fileID, 5), nil)
+	plaintext, err := f.decryptBlocksSplit(ciphertext, 10, fileID, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, bytes.Join(plaintexts, nil)) {
+		t.Error("blocks were reordered")
+	}
+	ciphertext[37*f.cipherBS+100] ^= 1
+	plaintext, err = f.decryptBlocksSplit(ciphertext, 10, fileID, 5)
+	if err == nil {
+		t.Fatal("corrupt block was not detected")
+	}
+	if len(plaintext) != 37*DefaultBS {
+		t.Errorf("plaintext should end at the corrupt block: got %d bytes, want %d", len(plaintext), 37*DefaultBS)
+	}
+}
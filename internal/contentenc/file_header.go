@@ -2,32 +2,74 @@ package contentenc
 
 // Per-file header
 //
-// Format: [ "Version" uint16 big endian ] [ "Id" 16 random bytes ]
+// Version 2: [ "Version" uint16 big endian ] [ "Id" 16 random bytes ]
+//
+// Version 3 appends an encrypted and authenticated metadata block to the
+// version 2 layout: [ "Version" ] [ "Id" ] [ nonce | metadata | tag ]
+// The metadata is
+// [ "PlainSize" uint64 ] [ "Flags" uint32 ] [ "BlockSize" uint32 ] [ 16 zero bytes ]
+// all big endian, followed by the 32-byte hash tree "Root" in integrity mode.
+// The metadata block is encrypted like a content block with the block number
+// HeaderMetaBlockNo, which ties it to the file Id.
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/merkletree"
 )
 
 const (
 	// Current On-Disk-Format version
 	CurrentVersion = 2
+	// File header version that carries the authenticated metadata block
+	HeaderVersion3 = 3
 
 	HEADER_VERSION_LEN = 2                                  // uint16
 	HEADER_ID_LEN      = 16                                 // 128 bit random file id
-	HEADER_LEN         = HEADER_VERSION_LEN + HEADER_ID_LEN // Total header length
+	HEADER_LEN         = HEADER_VERSION_LEN + HEADER_ID_LEN // Total version 2 header length
+	HEADER_META_LEN    = 32                                 // Plaintext length of the version 3 metadata
+	HEADER_ROOT_LEN    = merkletree.HashLen                 // Hash tree root, integrity mode only
+
+	// Block number the version 3 metadata is encrypted with. Content blocks
+	// never get this far.
+	HeaderMetaBlockNo = math.MaxUint64
+)
+
+const (
+	// HeaderFlagIntegrity - the metadata contains the hash tree root
+	HeaderFlagIntegrity = 1 << iota
+	// HeaderFlagCompression - the content blocks are compressed
+	HeaderFlagCompression
+
+	// Known bits in FileHeader.Flags. Headers with unknown bits are rejected.
+	knownHeaderFlags = HeaderFlagIntegrity | HeaderFlagCompression
 )
 
 type FileHeader struct {
 	Version uint16
 	Id      []byte
+
+	// The fields below are only stored in version 3 headers, where they are
+	// encrypted and authenticated.
+
+	// Exact plaintext size of the file
+	PlainSize uint64
+	// Per-file feature bits
+	Flags uint32
+	// Plaintext block size the file was written with
+	BlockSize uint32
+	// Root of the hash tree over all ciphertext blocks, integrity mode only
+	Root []byte
 }
 
-// Pack - serialize fileHeader object
+// Pack - serialize the unencrypted part (version and Id) of the fileHeader
+// object
 func (h *FileHeader) Pack() []byte {
-	if len(h.Id) != HEADER_ID_LEN || h.Version != CurrentVersion {
+	if len(h.Id) != HEADER_ID_LEN || (h.Version != CurrentVersion && h.Version != HeaderVersion3) {
 		panic("FileHeader object not properly initialized")
 	}
 	buf := make([]byte, HEADER_LEN)
@@ -37,17 +79,54 @@ func (h *FileHeader) Pack() []byte {
 
 }
 
-// ParseHeader - parse "buf" into fileHeader object
+// packMeta - serialize the version 3 metadata
+func (h *FileHeader) packMeta() []byte {
+	buf := make([]byte, HEADER_META_LEN, HEADER_META_LEN+len(h.Root))
+	binary.BigEndian.PutUint64(buf[0:8], h.PlainSize)
+	binary.BigEndian.PutUint32(buf[8:12], h.Flags)
+	binary.BigEndian.PutUint32(buf[12:16], h.BlockSize)
+	return append(buf, h.Root...)
+}
+
+// unpackMeta - parse the decrypted version 3 metadata in "buf" into "h"
+func (h *FileHeader) unpackMeta(buf []byte) error {
+	if len(buf) == HEADER_META_LEN+HEADER_ROOT_LEN {
+		h.Root = buf[HEADER_META_LEN:]
+		buf = buf[:HEADER_META_LEN]
+	}
+	if len(buf) != HEADER_META_LEN {
+		return fmt.Errorf("header metadata: invalid length: got %d, want %d", len(buf), HEADER_META_LEN)
+	}
+	if !bytes.Equal(buf[16:], make([]byte, HEADER_META_LEN-16)) {
+		return fmt.Errorf("header metadata: reserved bytes are not zero")
+	}
+	h.PlainSize = binary.BigEndian.Uint64(buf[0:8])
+	h.Flags = binary.BigEndian.Uint32(buf[8:12])
+	h.BlockSize = binary.BigEndian.Uint32(buf[12:16])
+	if h.Flags&^knownHeaderFlags != 0 {
+		return fmt.Errorf("header metadata: unknown flags 0x%x", h.Flags)
+	}
+	if (h.Flags&HeaderFlagIntegrity != 0) != (h.Root != nil) {
+		return fmt.Errorf("header metadata: integrity flag does not match the hash tree root")
+	}
+	return nil
+}
+
+// ParseHeader - parse the unencrypted part of "buf" into fileHeader object.
+// Both version 2 and version 3 headers are accepted. The metadata of version
+// 3 headers is not parsed, use ContentEnc.DecryptHeader for that.
 func ParseHeader(buf []byte) (*FileHeader, error) {
-	if len(buf) != HEADER_LEN {
-		return nil, fmt.Errorf("ParseHeader: invalid length: got %d, want %d", len(buf), HEADER_LEN)
+	if len(buf) < HEADER_LEN {
+		return nil, fmt.Errorf("ParseHeader: invalid length: got %d, want at least %d", len(buf), HEADER_LEN)
 	}
 	var h FileHeader
 	h.Version = binary.BigEndian.Uint16(buf[0:HEADER_VERSION_LEN])
-	if h.Version != CurrentVersion {
-		return nil, fmt.Errorf("ParseHeader: invalid version: got %d, want %d", h.Version, CurrentVersion)
+	if h.Version != CurrentVersion && h.Version != HeaderVersion3 {
+		return nil, fmt.Errorf("ParseHeader: invalid version: got %d, want %d or %d",
+			h.Version, CurrentVersion, HeaderVersion3)
 	}
-	h.Id = buf[HEADER_VERSION_LEN:]
+	h.Id = make([]byte, HEADER_ID_LEN)
+	copy(h.Id, buf[HEADER_VERSION_LEN:HEADER_LEN])
 	return &h, nil
 }
 
@@ -58,3 +137,82 @@ func RandomHeader() *FileHeader {
 	h.Id = cryptocore.RandBytes(HEADER_ID_LEN)
 	return &h
 }
+
+// HeaderLen - length of the file header on disk
+func (be *ContentEnc) HeaderLen() uint64 {
+	return be.headerLen
+}
+
+// HeaderV3 - does this filesystem use version 3 file headers?
+func (be *ContentEnc) HeaderV3() bool {
+	return be.headerLen != HEADER_LEN
+}
+
+// NewHeader - create new fileHeader object with random Id in the version this
+// filesystem uses
+func (be *ContentEnc) NewHeader() *FileHeader {
+	h := RandomHeader()
+	if be.HeaderV3() {
+		h.Version = HeaderVersion3
+		h.BlockSize = uint32(be.plainBS)
+	}
+	if be.integrity {
+		h.Flags |= HeaderFlagIntegrity
+		h.Root = (&merkletree.Tree{}).Root()
+	}
+	if be.compress {
+		h.Flags |= HeaderFlagCompression
+	}
+	return h
+}
+
+// EncryptHeader - serialize fileHeader object. The metadata of version 3
+// headers is encrypted and authenticated.
+func (be *ContentEnc) EncryptHeader(h *FileHeader) []byte {
+	buf := h.Pack()
+	if h.Version == HeaderVersion3 {
+		buf = append(buf, be.EncryptBlock(h.packMeta(), HeaderMetaBlockNo, h.Id)...)
+	}
+	if uint64(len(buf)) != be.headerLen {
+		panic("header version does not match the filesystem")
+	}
+	return buf
+}
+
+// DecryptHeader - parse "buf" into fileHeader object. The header version must
+// match the filesystem. The metadata of version 3 headers is decrypted and
+// verified.
+func (be *ContentEnc) DecryptHeader(buf []byte) (*FileHeader, error) {
+	if uint64(len(buf)) != be.headerLen {
+		return nil, fmt.Errorf("DecryptHeader: invalid length: got %d, want %d", len(buf), be.headerLen)
+	}
+	h, err := ParseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if (h.Version == HeaderVersion3) != be.HeaderV3() {
+		return nil, fmt.Errorf("DecryptHeader: file header version %d does not match the filesystem", h.Version)
+	}
+	if h.Version != HeaderVersion3 {
+		return h, nil
+	}
+	meta, err := be.DecryptBlock(buf[HEADER_LEN:], HeaderMetaBlockNo, h.Id)
+	if err != nil {
+		return nil, fmt.Errorf("DecryptHeader: metadata: %v", err)
+	}
+	err = h.unpackMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(h.BlockSize) != be.plainBS {
+		return nil, fmt.Errorf("DecryptHeader: block size %d does not match the filesystem (%d)",
+			h.BlockSize, be.plainBS)
+	}
+	if (h.Flags&HeaderFlagIntegrity != 0) != be.integrity {
+		return nil, fmt.Errorf("DecryptHeader: integrity mode does not match the filesystem")
+	}
+	if (h.Flags&HeaderFlagCompression != 0) != be.compress {
+		return nil, fmt.Errorf("DecryptHeader: compression mode does not match the filesystem")
+	}
+	return h, nil
+}
@@ -0,0 +1,117 @@
+package contentenc
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// Version 2 headers must keep working unchanged
+func TestHeaderV2(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, false)
+	f := New(cc, DefaultBS, false, false, false)
+	if f.HeaderLen() != HEADER_LEN || f.BlockNoToCipherOff(0) != HEADER_LEN {
+		t.Fatalf("wrong header length %d", f.HeaderLen())
+	}
+	h := f.NewHeader()
+	buf := f.EncryptHeader(h)
+	h2, err := ParseHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Version != CurrentVersion || string(h2.Id) != string(h.Id) {
+		t.Errorf("header did not survive the round trip")
+	}
+	_, err = f.DecryptHeader(buf)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHeaderV3(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	for _, aead := range []cryptocore.AEADTypeEnum{cryptocore.BackendGoGCM, cryptocore.BackendXChaCha20Poly1305} {
+		cc := cryptocore.New(key, aead, true, false)
+		f := New(cc, DefaultBS, true, false, false)
+		if f.BlockNoToCipherOff(0) != f.HeaderLen() {
+			t.Errorf("first block does not start after the header")
+		}
+		h := f.NewHeader()
+		h.PlainSize = 123456789
+		buf := f.EncryptHeader(h)
+		if uint64(len(buf)) != f.HeaderLen() {
+			t.Fatalf("wrong header length %d, want %d", len(buf), f.HeaderLen())
+		}
+		// ParseHeader only looks at the unencrypted part
+		p, err := ParseHeader(buf)
+		if err != nil || p.Version != HeaderVersion3 {
+			t.Fatalf("ParseHeader: %v", err)
+		}
+		h2, err := f.DecryptHeader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h2.PlainSize != h.PlainSize || h2.BlockSize != DefaultBS || string(h2.Id) != string(h.Id) {
+			t.Errorf("header did not survive the round trip: %+v", h2)
+		}
+		// The metadata is bound to the file Id
+		buf[HEADER_VERSION_LEN] ^= 1
+		_, err = f.DecryptHeader(buf)
+		if err == nil {
+			t.Errorf("modified file Id was not detected")
+		}
+		buf[HEADER_VERSION_LEN] ^= 1
+		buf[len(buf)-1] ^= 1
+		_, err = f.DecryptHeader(buf)
+		if err == nil {
+			t.Errorf("modified metadata was not detected")
+		}
+	}
+}
+
+// The header version must match the filesystem
+func TestHeaderVersionMismatch(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, false)
+	v2 := New(cc, DefaultBS, false, false, false)
+	v3 := New(cc, DefaultBS, true, false, false)
+	buf := v3.EncryptHeader(v3.NewHeader())
+	// Pretend that a version 2 header is followed by the first block
+	buf2 := append(v2.EncryptHeader(v2.NewHeader()), make([]byte, len(buf)-HEADER_LEN)...)
+	_, err := v3.DecryptHeader(buf2)
+	if err == nil {
+		t.Errorf("version 2 header accepted on a version 3 filesystem")
+	}
+	_, err = v2.DecryptHeader(buf[:HEADER_LEN])
+	if err == nil {
+		t.Errorf("version 3 header accepted on a version 2 filesystem")
+	}
+}
+
+// Integrity mode stores the hash tree root in the header
+func TestHeaderIntegrity(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, false)
+	f := New(cc, DefaultBS, true, true, false)
+	if f.HeaderLen() != New(cc, DefaultBS, true, false, false).HeaderLen()+HEADER_ROOT_LEN {
+		t.Errorf("wrong header length %d", f.HeaderLen())
+	}
+	h := f.NewHeader()
+	h.Root = make([]byte, HEADER_ROOT_LEN)
+	h.Root[0] = 42
+	h2, err := f.DecryptHeader(f.EncryptHeader(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(h2.Root) != string(h.Root) || h2.Flags != HeaderFlagIntegrity {
+		t.Errorf("header did not survive the round trip: %+v", h2)
+	}
+	// A filesystem without integrity mode must reject the header
+	noIntegrity := New(cc, DefaultBS, true, false, false)
+	buf := f.EncryptHeader(h)
+	_, err = noIntegrity.DecryptHeader(buf[:noIntegrity.HeaderLen()])
+	if err == nil {
+		t.Error("header with hash tree root accepted without integrity mode")
+	}
+}
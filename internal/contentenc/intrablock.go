@@ -49,3 +49,15 @@ func (ib *intraBlock) JointCiphertextRange(blocks []intraBlock) (offset uint64,
 
 	return offset, length
 }
+
+// Plaintext range corresponding to the sum of all "blocks" (complete blocks)
+func (ib *intraBlock) JointPlaintextRange(blocks []intraBlock) (offset uint64, length uint64) {
+	firstBlock := blocks[0]
+	lastBlock := blocks[len(blocks)-1]
+
+	offset = ib.fs.BlockNoToPlainOff(firstBlock.BlockNo)
+	offsetLast := ib.fs.BlockNoToPlainOff(lastBlock.BlockNo)
+	length = offsetLast + ib.fs.plainBS - offset
+
+	return offset, length
+}
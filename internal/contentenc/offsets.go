@@ -13,12 +13,12 @@ func (be *ContentEnc) PlainOffToBlockNo(plainOffset uint64) uint64 {
 
 // get the block number at ciphter-text offset
 func (be *ContentEnc) CipherOffToBlockNo(cipherOffset uint64) uint64 {
-	return (cipherOffset - HEADER_LEN) / be.cipherBS
+	return (cipherOffset - be.headerLen) / be.cipherBS
 }
 
 // get ciphertext offset of block "blockNo"
 func (be *ContentEnc) BlockNoToCipherOff(blockNo uint64) uint64 {
-	return HEADER_LEN + blockNo*be.cipherBS
+	return be.headerLen + blockNo*be.cipherBS
 }
 
 // get plaintext offset of block "blockNo"
@@ -26,7 +26,8 @@ func (be *ContentEnc) BlockNoToPlainOff(blockNo uint64) uint64 {
 	return blockNo * be.plainBS
 }
 
-// PlainSize - calculate plaintext size from ciphertext size
+// PlainSize - calculate plaintext size from ciphertext size. In compression
+// mode, this is an upper bound as every block occupies a full slot.
 func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 
 	// Zero sized files stay zero-sized
@@ -34,13 +35,13 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 		return 0
 	}
 
-	if cipherSize == HEADER_LEN {
+	if cipherSize == be.headerLen {
 		toggledlog.Warn.Printf("cipherSize %d == header size: interrupted write?\n", cipherSize)
 		return 0
 	}
 
-	if cipherSize < HEADER_LEN {
-		toggledlog.Warn.Printf("cipherSize %d < header size %d: corrupt file\n", cipherSize, HEADER_LEN)
+	if cipherSize < be.headerLen {
+		toggledlog.Warn.Printf("cipherSize %d < header size %d: corrupt file\n", cipherSize, be.headerLen)
 		return 0
 	}
 
@@ -48,19 +49,29 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 	blockNo := be.CipherOffToBlockNo(cipherSize - 1)
 	blockCount := blockNo + 1
 
-	overhead := be.BlockOverhead()*blockCount + HEADER_LEN
+	overhead := be.BlockOverhead()*blockCount + be.headerLen
 
 	return cipherSize - overhead
 }
 
-// CipherSize - calculate ciphertext size from plaintext size
+// CipherSize - calculate ciphertext size from plaintext size. In compression
+// mode, the last block occupies a full slot as well.
 func (be *ContentEnc) PlainSizeToCipherSize(plainSize uint64) uint64 {
 
+	// Zero sized files stay zero-sized
+	if plainSize == 0 {
+		return 0
+	}
+
 	// Block number at last byte
 	blockNo := be.PlainOffToBlockNo(plainSize - 1)
 	blockCount := blockNo + 1
 
-	overhead := be.BlockOverhead()*blockCount + HEADER_LEN
+	if be.compress {
+		return be.BlockNoToCipherOff(blockCount)
+	}
+
+	overhead := be.BlockOverhead()*blockCount + be.headerLen
 
 	return plainSize + overhead
 }
@@ -85,6 +96,28 @@ func (be *ContentEnc) ExplodePlainRange(offset uint64, length uint64) []intraBlo
 	return blocks
 }
 
+// Split a ciphertext byte range into (possibly partial) blocks
+// "offset" must not point into the file header.
+// This is used in reverse mode when reading files.
+func (be *ContentEnc) ExplodeCipherRange(offset uint64, length uint64) []intraBlock {
+	var blocks []intraBlock
+	var nextBlock intraBlock
+	nextBlock.fs = be
+
+	for length > 0 {
+		nextBlock.BlockNo = be.CipherOffToBlockNo(offset)
+		nextBlock.Skip = offset - be.BlockNoToCipherOff(nextBlock.BlockNo)
+
+		// Minimum of remaining data and remaining space in the block
+		nextBlock.Length = MinUint64(length, be.cipherBS-nextBlock.Skip)
+
+		blocks = append(blocks, nextBlock)
+		offset += nextBlock.Length
+		length -= nextBlock.Length
+	}
+	return blocks
+}
+
 func (be *ContentEnc) BlockOverhead() uint64 {
 	return be.cipherBS - be.plainBS
 }
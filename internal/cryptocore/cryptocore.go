@@ -3,8 +3,12 @@ package cryptocore
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha512"
 	"fmt"
 
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/rfjakob/gocryptfs/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 )
 
@@ -13,15 +17,40 @@ const (
 	AuthTagLen = 16
 )
 
+// AEADTypeEnum selects the content encryption backend
+type AEADTypeEnum int
+
+const (
+	// BackendGoGCM - AES-GCM using Go's built-in crypto
+	BackendGoGCM AEADTypeEnum = iota
+	// BackendOpenSSL - AES-GCM using OpenSSL via stupidgcm. Only supports
+	// 128-bit IVs, falls back to BackendGoGCM otherwise.
+	BackendOpenSSL
+	// BackendXChaCha20Poly1305 - XChaCha20-Poly1305 with 192-bit random
+	// nonces. Fast on CPUs without AES instructions.
+	BackendXChaCha20Poly1305
+	// BackendAESSIV - AES-SIV-512, misuse-resistant: a repeated nonce does
+	// not leak the key. Always uses 128-bit nonces.
+	BackendAESSIV
+)
+
 type CryptoCore struct {
+	// Filename encryption
 	BlockCipher cipher.Block
-	Gcm         cipher.AEAD
-	GcmIVGen    *nonceGenerator
-	IVLen       int
+	// File content encryption. Despite the name, this can be any of the
+	// AEADTypeEnum backends.
+	Gcm      cipher.AEAD
+	GcmIVGen *nonceGenerator
+	IVLen    int
 }
 
 // "New" returns a new CryptoCore object or panics.
-func New(key []byte, useOpenssl bool, GCMIV128 bool) *CryptoCore {
+// "GCMIV128" selects the IV length of the AES-GCM backends and is ignored for
+// XChaCha20-Poly1305 and AES-SIV.
+// "useHKDF" derives independent subkeys for filename and content encryption
+// from "key". Filesystems created before HKDF was introduced use "key"
+// directly for both.
+func New(key []byte, aeadType AEADTypeEnum, GCMIV128 bool, useHKDF bool) *CryptoCore {
 
 	if len(key) != KeyLen {
 		panic(fmt.Sprintf("Unsupported key length %d", len(key)))
@@ -33,22 +62,60 @@ func New(key []byte, useOpenssl bool, GCMIV128 bool) *CryptoCore {
 		IVLen = 128 / 8
 	}
 
+	emeKey := key
+	if useHKDF {
+		emeKey = HkdfDerive(key, HKDFInfoEMENames, KeyLen)
+	}
 	// We always use built-in Go crypto for blockCipher because it is not
 	// performance-critical.
-	blockCipher, err := aes.NewCipher(key)
+	blockCipher, err := aes.NewCipher(emeKey)
 	if err != nil {
 		panic(err)
 	}
 
 	var gcm cipher.AEAD
-	if useOpenssl && GCMIV128 {
-		// stupidgcm only supports 128-bit IVs
-		gcm = stupidgcm.New(key)
-	} else {
-		gcm, err = goGCMWrapper(blockCipher, IVLen)
+	if aeadType == BackendXChaCha20Poly1305 {
+		contentKey := key
+		if useHKDF {
+			contentKey = HkdfDerive(key, HKDFInfoXChaChaContent, chacha20poly1305.KeySize)
+		}
+		gcm, err = chacha20poly1305.NewX(contentKey)
 		if err != nil {
 			panic(err)
 		}
+		IVLen = chacha20poly1305.NonceSizeX
+	} else if aeadType == BackendAESSIV {
+		// AES-SIV-512 needs a 64-byte key
+		var contentKey []byte
+		if useHKDF {
+			contentKey = HkdfDerive(key, HKDFInfoSIVContent, siv_aead.KeyLen)
+		} else {
+			key64 := sha512.Sum512(key)
+			contentKey = key64[:]
+		}
+		gcm = siv_aead.New(contentKey)
+		IVLen = gcm.NonceSize()
+	} else {
+		contentKey := key
+		if useHKDF {
+			contentKey = HkdfDerive(key, HKDFInfoGCMContent, KeyLen)
+		}
+		if aeadType == BackendOpenSSL && GCMIV128 {
+			// stupidgcm only supports 128-bit IVs
+			gcm = stupidgcm.New(contentKey)
+		} else {
+			gcmCipher := blockCipher
+			if useHKDF {
+				gcmCipher, err = aes.NewCipher(contentKey)
+				if err != nil {
+					panic(err)
+				}
+			}
+			gcm, err = goGCMWrapper(gcmCipher, IVLen)
+			if err != nil {
+				panic(err)
+			}
+		}
 	}
 
 	return &CryptoCore{
@@ -15,5 +15,5 @@ func TestCryptoCoreNewGo14(t *testing.T) {
 		}
 	}()
 	key := make([]byte, 32)
-	New(key, false, true)
+	New(key, BackendGoGCM, true, false)
 }
@@ -1,6 +1,8 @@
 package cryptocore
 
 import (
+	"bytes"
+	"encoding/hex"
 	"testing"
 )
 
@@ -8,19 +10,48 @@ import (
 func TestCryptoCoreNew(t *testing.T) {
 	key := make([]byte, 32)
 
-	c := New(key, true, true)
+	c := New(key, BackendOpenSSL, true, false)
 	if c.IVLen != 16 {
 		t.Fail()
 	}
-	c = New(key, true, false)
+	c = New(key, BackendOpenSSL, false, false)
 	if c.IVLen != 12 {
 		t.Fail()
 	}
-	c = New(key, false, false)
+	c = New(key, BackendGoGCM, false, false)
 	if c.IVLen != 12 {
 		t.Fail()
 	}
-	// "New(key, false, true)" is tested for Go 1.4 and 1.5+ seperately
+	// "New(key, BackendGoGCM, true, false)" is tested for Go 1.4 and 1.5+ seperately
+	c = New(key, BackendXChaCha20Poly1305, false, false)
+	if c.IVLen != 24 {
+		t.Fail()
+	}
+	c = New(key, BackendAESSIV, false, false)
+	if c.IVLen != 16 {
+		t.Fail()
+	}
+}
+
+// XChaCha20-Poly1305 must round-trip through the Gcm slot with nonces from
+// GcmIVGen
+func TestXChaCha20Poly1305(t *testing.T) {
+	key := make([]byte, 32)
+	c := New(key, BackendXChaCha20Poly1305, true, false)
+	if c.Gcm.NonceSize() != c.IVLen || c.Gcm.Overhead() != AuthTagLen {
+		t.Fatalf("wrong sizes: nonce=%d overhead=%d", c.Gcm.NonceSize(), c.Gcm.Overhead())
+	}
+	nonce := c.GcmIVGen.Get()
+	ciphertext := c.Gcm.Seal(nil, nonce, []byte("hello"), []byte("ad"))
+	plaintext, err := c.Gcm.Open(nil, nonce, ciphertext, []byte("ad"))
+	if err != nil || string(plaintext) != "hello" {
+		t.Errorf("round trip failed: %q %v", plaintext, err)
+	}
+	ciphertext[0] ^= 1
+	_, err = c.Gcm.Open(nil, nonce, ciphertext, []byte("ad"))
+	if err == nil {
+		t.Error("corrupted ciphertext was accepted")
+	}
 }
 
 // "New" should panic on any key not 32 bytes long
@@ -32,5 +63,39 @@ func TestNewPanic(t *testing.T) {
 	}()
 
 	key := make([]byte, 16)
-	New(key, true, true)
+	New(key, BackendOpenSSL, true, false)
+}
+
+// RFC 5869 test case 3: zero-length salt and info
+func TestHkdfDerive(t *testing.T) {
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	out := HkdfDerive(ikm, "", 42)
+	want := "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8"
+	if hex.EncodeToString(out) != want {
+		t.Errorf("got %x, want %s", out, want)
+	}
+}
+
+// With HKDF, the name and content ciphers must not use the master key
+func TestHKDFSubkeys(t *testing.T) {
+	key := make([]byte, 32)
+	direct := New(key, BackendGoGCM, true, false)
+	derived := New(key, BackendGoGCM, true, true)
+	in := make([]byte, 16)
+	a := make([]byte, 16)
+	b := make([]byte, 16)
+	direct.BlockCipher.Encrypt(a, in)
+	derived.BlockCipher.Encrypt(b, in)
+	if bytes.Equal(a, b) {
+		t.Error("HKDF did not change the name cipher key")
+	}
+	nonce := make([]byte, 16)
+	ca := direct.Gcm.Seal(nil, nonce, in, nil)
+	cb := derived.Gcm.Seal(nil, nonce, in, nil)
+	if bytes.Equal(ca, cb) {
+		t.Error("HKDF did not change the content cipher key")
+	}
+	if bytes.Equal(HkdfDerive(key, HKDFInfoEMENames, KeyLen), HkdfDerive(key, HKDFInfoGCMContent, KeyLen)) {
+		t.Error("different purposes must get different subkeys")
+	}
 }
@@ -0,0 +1,34 @@
+package cryptocore
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HKDF info strings. Every purpose gets its own subkey that is derived from
+// the master key. Changing a string breaks existing filesystems.
+const (
+	// Filename encryption (EME), see CryptoCore.BlockCipher
+	HKDFInfoEMENames = "EME filename encryption"
+	// File content encryption, see CryptoCore.Gcm. Go GCM and OpenSSL GCM
+	// share the key as they are interchangeable.
+	HKDFInfoGCMContent     = "AES-GCM file content encryption"
+	HKDFInfoXChaChaContent = "XChaCha20-Poly1305 file content encryption"
+	HKDFInfoSIVContent     = "AES-SIV file content encryption"
+	// Deterministic IVs and nonces in reverse mode
+	HKDFInfoReverseIV = "reverse mode IV derivation"
+)
+
+// HkdfDerive - derive a "length"-byte subkey for the purpose "info" from
+// "masterkey" using HKDF-SHA256
+func HkdfDerive(masterkey []byte, info string, length int) []byte {
+	h := hkdf.New(sha256.New, masterkey, nil, []byte(info))
+	out := make([]byte, length)
+	_, err := io.ReadFull(h, out)
+	if err != nil {
+		panic("hkdf: " + err.Error())
+	}
+	return out
+}
@@ -0,0 +1,149 @@
+// Package ctlsock implements the control socket interface that can be
+// activated by passing "-ctlsock" on the command line.
+//
+// The protocol is newline-delimited JSON: every request is a JSON-encoded
+// RequestStruct, every answer a JSON-encoded ResponseStruct.
+package ctlsock
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// Interface should be implemented by fusefrontend[_reverse]
+type Interface interface {
+	EncryptPath(string) (string, error)
+	DecryptPath(string) (string, error)
+}
+
+// RequestStruct is sent by a client
+type RequestStruct struct {
+	EncryptPath string `json:",omitempty"`
+	DecryptPath string `json:",omitempty"`
+}
+
+// ResponseStruct is sent by us as response to a request
+type ResponseStruct struct {
+	// Result is the resulting decrypted or encrypted path. Empty on error.
+	Result string
+	// ErrNo is the error number as defined in errno.h.
+	// 0 means success and -1 means that the error number is not known
+	// (look at ErrText in this case).
+	ErrNo int32
+	// ErrText is a detailed error message.
+	ErrText string
+}
+
+type ctlSockHandler struct {
+	fs     Interface
+	socket net.Listener
+}
+
+// Serve serves incoming connections on "sock". This call blocks so you
+// probably want to run it in a new goroutine.
+func Serve(sock net.Listener, fs Interface) {
+	handler := ctlSockHandler{
+		fs:     fs,
+		socket: sock,
+	}
+	handler.acceptLoop()
+}
+
+func (ch *ctlSockHandler) acceptLoop() {
+	for {
+		conn, err := ch.socket.Accept()
+		if err != nil {
+			// This can trigger on program exit with "use of closed network
+			// connection". Special-casing this is hard:
+			// https://github.com/golang/go/issues/4373
+			// so just log the error and return.
+			toggledlog.Info.Printf("ctlsock: Accept error: %v", err)
+			return
+		}
+		go ch.handleConnection(conn)
+	}
+}
+
+// ReadBufSize is the maximum size of a request.
+// The longest possible path is 4096 bytes on Linux and 1024 on Mac OS X so
+// 5000 bytes should be enough to hold the whole JSON request.
+const ReadBufSize = 5000
+
+func (ch *ctlSockHandler) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	// The decoder only reads from the connection when it has no complete
+	// request buffered, so the limit applies to every request on its own
+	lr := &io.LimitedReader{R: conn}
+	dec := json.NewDecoder(lr)
+	enc := json.NewEncoder(conn)
+	for {
+		lr.N = ReadBufSize
+		var in RequestStruct
+		err := dec.Decode(&in)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			toggledlog.Debug.Printf("ctlsock: decode error: %v", err)
+			enc.Encode(errorResponse(err))
+			return
+		}
+		err = enc.Encode(ch.handleRequest(&in))
+		if err != nil {
+			toggledlog.Debug.Printf("ctlsock: encode error: %v", err)
+			return
+		}
+	}
+}
+
+// handleRequest - answer a single request
+func (ch *ctlSockHandler) handleRequest(in *RequestStruct) ResponseStruct {
+	var err error
+	var out ResponseStruct
+	// You cannot perform both decryption and encryption in one request
+	if in.DecryptPath != "" && in.EncryptPath != "" {
+		return errorResponse(errors.New("Ambiguous request"))
+	}
+	if in.EncryptPath != "" {
+		out.Result, err = ch.fs.EncryptPath(sanitizePath(in.EncryptPath))
+	} else if in.DecryptPath != "" {
+		out.Result, err = ch.fs.DecryptPath(sanitizePath(in.DecryptPath))
+	} else {
+		err = errors.New("Empty input")
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	return out
+}
+
+// sanitizePath - convert "path" to a clean relative path. ".." components
+// cannot escape the filesystem root. The root directory is "".
+func sanitizePath(path string) string {
+	clean := filepath.Clean("/" + path)
+	return strings.TrimPrefix(clean, "/")
+}
+
+// errorResponse - convert "err" into a ResponseStruct
+func errorResponse(err error) ResponseStruct {
+	out := ResponseStruct{
+		ErrNo:   -1,
+		ErrText: err.Error(),
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		out.ErrNo = int32(errno)
+	} else if pe, ok := err.(*os.PathError); ok {
+		if errno, ok := pe.Err.(syscall.Errno); ok {
+			out.ErrNo = int32(errno)
+		}
+	}
+	return out
+}
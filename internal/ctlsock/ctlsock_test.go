@@ -0,0 +1,63 @@
+package ctlsock
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	testCases := [][]string{
+		{"", ""},
+		{"/", ""},
+		{".", ""},
+		{"foo", "foo"},
+		{"/foo", "foo"},
+		{"foo/", "foo"},
+		{"foo/bar", "foo/bar"},
+		{"//foo//bar/", "foo/bar"},
+		{"foo/../bar", "bar"},
+		{"../foo", "foo"},
+		{"/../../foo/..", ""},
+	}
+	for _, tc := range testCases {
+		res := sanitizePath(tc[0])
+		if res != tc[1] {
+			t.Errorf("%q: want %q, got %q", tc[0], tc[1], res)
+		}
+	}
+}
+
+// echoFS returns paths unchanged
+type echoFS struct{}
+
+func (echoFS) EncryptPath(p string) (string, error) { return p, nil }
+func (echoFS) DecryptPath(p string) (string, error) { return p, nil }
+
+// Test that the size limit applies to every request on a connection on its
+// own
+func TestRequestSizeLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ch := ctlSockHandler{fs: echoFS{}}
+	go ch.handleConnection(server)
+	enc := json.NewEncoder(client)
+	dec := json.NewDecoder(client)
+	path := strings.Repeat("x", ReadBufSize/2)
+	// Together larger than the limit
+	for i := 0; i < 3; i++ {
+		go enc.Encode(RequestStruct{EncryptPath: path})
+		var resp ResponseStruct
+		err := dec.Decode(&resp)
+		if err != nil || resp.Result != path {
+			t.Fatalf("request %d failed: %v, %q", i, err, resp.ErrText)
+		}
+	}
+	go enc.Encode(RequestStruct{EncryptPath: path + path})
+	var resp ResponseStruct
+	err := dec.Decode(&resp)
+	if err != nil || resp.ErrNo == 0 {
+		t.Errorf("oversized request should fail: %v, %q", err, resp.Result)
+	}
+}
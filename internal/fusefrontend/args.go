@@ -1,5 +1,9 @@
 package fusefrontend
 
+import (
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
 // Container for arguments that are passed from main() to fusefrontend
 type Args struct {
 	Masterkey      []byte
@@ -10,4 +14,51 @@ type Args struct {
 	EMENames       bool
 	GCMIV128       bool
 	LongNames      bool
+	// ConfigPath is the config file in use. Reverse mode shows it as
+	// gocryptfs.conf in the encrypted view.
+	ConfigPath string
+	// ReadOnly makes all operations that would modify CIPHERDIR fail with
+	// EROFS
+	ReadOnly bool
+	// Xattr enables encrypted extended attributes
+	Xattr bool
+	// PlainBS is the plaintext block size of the file contents
+	PlainBS uint64
+	// XChaCha20Poly1305 replaces AES-GCM for the file contents
+	XChaCha20Poly1305 bool
+	// AESSIV replaces AES-GCM for the file contents
+	AESSIV bool
+	// HKDF derives independent subkeys from the master key
+	HKDF bool
+	// HeaderV3 selects file headers with an authenticated plaintext size
+	HeaderV3 bool
+	// Integrity verifies all blocks against a per-file hash tree. Requires
+	// HeaderV3.
+	Integrity bool
+	// Compress compresses the file contents before encryption. Requires
+	// HeaderV3.
+	Compress bool
+	// KernelCache lets the kernel keep the page cache of a file across
+	// opens. Only safe if CIPHERDIR is not modified behind our back.
+	KernelCache bool
+	// Writeback means that the kernel caches writes. It may then read from
+	// files that were opened write-only.
+	Writeback bool
+	// CtlSock means that a control socket is served. The DirIV cache is only
+	// kept up to date for it.
+	CtlSock bool
+}
+
+// AEADType - the content encryption backend selected by the arguments
+func (args *Args) AEADType() cryptocore.AEADTypeEnum {
+	if args.XChaCha20Poly1305 {
+		return cryptocore.BackendXChaCha20Poly1305
+	}
+	if args.AESSIV {
+		return cryptocore.BackendAESSIV
+	}
+	if args.OpenSSL {
+		return cryptocore.BackendOpenSSL
+	}
+	return cryptocore.BackendGoGCM
 }
@@ -1,5 +1,7 @@
 package fusefrontend
 
+import "syscall"
+
 // prealloc - preallocate space without changing the file size. This prevents
 // us from running out of space in the middle of an operation.
 func prealloc(fd int, off int64, len int64) (err error) {
@@ -10,3 +12,9 @@ func prealloc(fd int, off int64, len int64) (err error) {
 	// See https://github.com/rfjakob/gocryptfs/issues/18 if you want to help.
 	return nil
 }
+
+// punchHole - deallocate the byte range. Not available on OSX, the caller
+// falls back to writing zeros.
+func punchHole(fd int, off int64, len int64) (err error) {
+	return syscall.EOPNOTSUPP
+}
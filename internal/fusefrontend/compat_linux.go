@@ -33,3 +33,15 @@ func prealloc(fd int, off int64, len int64) (err error) {
 		return err
 	}
 }
+
+// punchHole - deallocate the byte range. Reading the range afterwards returns
+// zeros.
+func punchHole(fd int, off int64, len int64) (err error) {
+	for {
+		err = syscall.Fallocate(fd, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, off, len)
+		if err == syscall.EINTR {
+			continue
+		}
+		return err
+	}
+}
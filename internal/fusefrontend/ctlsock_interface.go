@@ -0,0 +1,17 @@
+package fusefrontend
+
+import (
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+)
+
+var _ ctlsock.Interface = &FS{} // Verify that interface is implemented.
+
+// EncryptPath implements ctlsock.Interface
+func (fs *FS) EncryptPath(plainPath string) (string, error) {
+	return fs.encryptPath(plainPath)
+}
+
+// DecryptPath implements ctlsock.Interface
+func (fs *FS) DecryptPath(cipherPath string) (string, error) {
+	return fs.decryptPath(cipherPath)
+}
@@ -80,12 +80,12 @@ func (f *file) SetInode(n *nodefs.Inode) {
 //
 // Returns io.EOF if the file is empty
 func (f *file) readHeader() error {
-	buf := make([]byte, contentenc.HEADER_LEN)
+	buf := make([]byte, f.contentEnc.HeaderLen())
 	_, err := f.fd.ReadAt(buf, 0)
 	if err != nil {
 		return err
 	}
-	h, err := contentenc.ParseHeader(buf)
+	h, err := f.contentEnc.DecryptHeader(buf)
 	if err != nil {
 		return err
 	}
@@ -96,11 +96,11 @@ func (f *file) readHeader() error {
 
 // createHeader - create a new random header and write it to disk
 func (f *file) createHeader() error {
-	h := contentenc.RandomHeader()
-	buf := h.Pack()
+	h := f.contentEnc.NewHeader()
+	buf := f.contentEnc.EncryptHeader(h)
 
 	// Prevent partially written (=corrupt) header by preallocating the space beforehand
-	err := prealloc(int(f.fd.Fd()), 0, contentenc.HEADER_LEN)
+	err := prealloc(int(f.fd.Fd()), 0, int64(len(buf)))
 	if err != nil {
 		toggledlog.Warn.Printf("ino%d: createHeader: prealloc failed: %s\n", f.ino, err.Error())
 		return err
@@ -116,6 +116,109 @@ func (f *file) createHeader() error {
 	return nil
 }
 
+// plainSize - get the plaintext size of the file. Version 3 headers store the
+// exact size, which is read from disk every time because other file handles
+// may have changed it. Otherwise, the size is calculated from the ciphertext
+// size. The caller must hold the wlock.
+func (f *file) plainSize() (uint64, error) {
+	fi, err := f.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	cipherSize := uint64(fi.Size())
+	if !f.contentEnc.HeaderV3() {
+		return f.contentEnc.CipherSizeToPlainSize(cipherSize), nil
+	}
+	if cipherSize < f.contentEnc.HeaderLen() {
+		// No header (yet), forget the one from before an open(O_TRUNC)
+		f.header = nil
+		return f.contentEnc.CipherSizeToPlainSize(cipherSize), nil
+	}
+	err = f.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	return f.header.PlainSize, nil
+}
+
+// lockedPlainSize - plainSize() for callers that do not hold the wlock
+func (f *file) lockedPlainSize() (uint64, fuse.Status) {
+	if f.released {
+		return 0, fuse.EBADF
+	}
+	wlock.lock(f.ino)
+	defer wlock.unlock(f.ino)
+	size, err := f.plainSize()
+	if err != nil {
+		toggledlog.Warn.Printf("ino%d fh%d: could not get plaintext size: %v", f.ino, f.intFd(), err)
+		return 0, fuse.ToStatus(err)
+	}
+	return size, fuse.OK
+}
+
+// verifiedPlainSize - plainSize() that also loads the hash tree in integrity
+// mode. The caller must hold the wlock.
+func (f *file) verifiedPlainSize() (uint64, fuse.Status) {
+	plainSize, err := f.plainSize()
+	if err != nil {
+		toggledlog.Warn.Printf("ino%d fh%d: could not get plaintext size: %v", f.ino, f.intFd(), err)
+		return 0, fuse.ToStatus(err)
+	}
+	if f.contentEnc.Integrity() {
+		status := f.loadTree(plainSize)
+		if status != fuse.OK {
+			return 0, status
+		}
+	}
+	return plainSize, fuse.OK
+}
+
+// writePlainSize - get the plaintext size of the file before modifying it.
+// An interrupted write can leave ciphertext beyond the size stored in a
+// version 3 header. It is cut off here so it cannot resurface when the file
+// grows. The caller must hold the wlock.
+func (f *file) writePlainSize() (uint64, fuse.Status) {
+	plainSize, status := f.verifiedPlainSize()
+	if status != fuse.OK || !f.contentEnc.HeaderV3() {
+		return plainSize, status
+	}
+	fi, err := f.fd.Stat()
+	if err != nil {
+		return 0, fuse.ToStatus(err)
+	}
+	if uint64(fi.Size()) > f.contentEnc.PlainSizeToCipherSize(plainSize) {
+		toggledlog.Debug.Printf("ino%d: dropping ciphertext beyond the authenticated size %d", f.ino, plainSize)
+		status = f.truncateShrinkFile(plainSize)
+		if status == fuse.OK && f.contentEnc.Integrity() {
+			// The last block may have been rewritten
+			status = f.storeHeader(plainSize)
+		}
+		if status != fuse.OK {
+			return 0, status
+		}
+	}
+	return plainSize, fuse.OK
+}
+
+// storeHeader - store the plaintext size and, in integrity mode, the hash
+// tree root in the version 3 file header. The header is rewritten with a
+// single write that fits into one disk sector. Does nothing for older
+// headers. The caller must hold the wlock.
+func (f *file) storeHeader(size uint64) fuse.Status {
+	if !f.contentEnc.HeaderV3() || f.header == nil {
+		return fuse.OK
+	}
+	f.header.PlainSize = size
+	if f.contentEnc.Integrity() {
+		f.header.Root = wlock.getTree(f.ino).Root()
+	}
+	_, err := f.fd.WriteAt(f.contentEnc.EncryptHeader(f.header), 0)
+	if err != nil {
+		toggledlog.Warn.Printf("ino%d fh%d: storeHeader: %v", f.ino, f.intFd(), err)
+	}
+	return fuse.ToStatus(err)
+}
+
 func (f *file) String() string {
 	return fmt.Sprintf("cryptFile(%s)", f.fd.Name())
 }
@@ -128,6 +231,9 @@ func (f *file) String() string {
 //
 // Called by Read() for normal reading,
 // by Write() and Truncate() for Read-Modify-Write
+//
+// In integrity mode, the blocks are verified against the hash tree and the
+// caller must hold the wlock.
 func (f *file) doRead(off uint64, length uint64) ([]byte, fuse.Status) {
 
 	// Read file header
@@ -158,6 +264,13 @@ func (f *file) doRead(off uint64, length uint64) ([]byte, fuse.Status) {
 	firstBlockNo := blocks[0].BlockNo
 	toggledlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
+	if f.contentEnc.Integrity() {
+		status := f.verifyBlocks(ciphertext, firstBlockNo, uint64(len(blocks)))
+		if status != fuse.OK {
+			return nil, status
+		}
+	}
+
 	// Decrypt it
 	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, f.header.Id)
 	if err != nil {
@@ -195,7 +308,33 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 		return nil, fuse.EBADF
 	}
 
-	out, status := f.doRead(uint64(off), uint64(len(buf)))
+	length := uint64(len(buf))
+	if f.contentEnc.HeaderV3() {
+		// Do not return anything beyond the authenticated size
+		var plainSize uint64
+		var status fuse.Status
+		if f.contentEnc.Integrity() {
+			// The hash tree must not change while doRead() verifies against
+			// it
+			if f.released {
+				return nil, fuse.EBADF
+			}
+			wlock.lock(f.ino)
+			defer wlock.unlock(f.ino)
+			plainSize, status = f.verifiedPlainSize()
+		} else {
+			plainSize, status = f.lockedPlainSize()
+		}
+		if status != fuse.OK {
+			return nil, status
+		}
+		if uint64(off) >= plainSize {
+			return fuse.ReadResultData(nil), fuse.OK
+		}
+		length = contentenc.MinUint64(length, plainSize-uint64(off))
+	}
+
+	out, status := f.doRead(uint64(off), length)
 
 	if status == fuse.EIO {
 		toggledlog.Warn.Printf("ino%d: Read failed with EIO, offset=%d, length=%d", f.ino, len(buf), off)
@@ -208,7 +347,10 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 	return fuse.ReadResultData(out), status
 }
 
-const FALLOC_FL_KEEP_SIZE = 0x01
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x01
+	FALLOC_FL_PUNCH_HOLE = 0x02
+)
 
 // doWrite - encrypt "data" and write it to plaintext offset "off"
 //
@@ -235,7 +377,11 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 	status := fuse.OK
 	dataBuf := bytes.NewBuffer(data)
 	blocks := f.contentEnc.ExplodePlainRange(uint64(off), uint64(len(data)))
-	for _, b := range blocks {
+	if len(blocks) == 0 {
+		return 0, fuse.OK
+	}
+	plaintexts := make([][]byte, len(blocks))
+	for i, b := range blocks {
 
 		blockData := dataBuf.Next(int(b.Length))
 
@@ -247,16 +393,21 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 			oldData, status = f.doRead(o, f.contentEnc.PlainBS())
 			if status != fuse.OK {
 				toggledlog.Warn.Printf("ino%d fh%d: RMW read failed: %s", f.ino, f.intFd(), status.String())
-				return written, status
+				return 0, status
 			}
 			// Modify
 			blockData = f.contentEnc.MergeBlocks(oldData, blockData, int(b.Skip))
 			toggledlog.Debug.Printf("len(oldData)=%d len(blockData)=%d", len(oldData), len(blockData))
 		}
+		plaintexts[i] = blockData
+	}
+
+	// Encrypt. Large writes are spread across several cores.
+	ciphertexts := f.contentEnc.EncryptBlocks(plaintexts, blocks[0].BlockNo, f.header.Id)
 
-		// Encrypt
+	for i, b := range blocks {
+		blockData := ciphertexts[i]
 		blockOffset, blockLen := b.CiphertextRange()
-		blockData = f.contentEnc.EncryptBlock(blockData, b.BlockNo, f.header.Id)
 		toggledlog.Debug.Printf("ino%d: Writing %d bytes to block #%d",
 			f.ino, uint64(len(blockData))-f.contentEnc.BlockOverhead(), b.BlockNo)
 
@@ -276,6 +427,12 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 			status = fuse.ToStatus(err)
 			break
 		}
+		if f.contentEnc.Compression() {
+			f.punchPadding(blockOffset, blockData)
+		}
+		if f.contentEnc.Integrity() {
+			f.setLeaf(b.BlockNo, blockData)
+		}
 		written += uint32(b.Length)
 	}
 	return written, status
@@ -297,12 +454,10 @@ func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 
 	toggledlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.ino, off, len(data))
 
-	fi, err := f.fd.Stat()
-	if err != nil {
-		toggledlog.Warn.Printf("Write: Fstat failed: %v", err)
-		return 0, fuse.ToStatus(err)
+	plainSize, status := f.writePlainSize()
+	if status != fuse.OK {
+		return 0, status
 	}
-	plainSize := f.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))
 	if f.createsHole(plainSize, off) {
 		status := f.zeroPad(plainSize)
 		if status != fuse.OK {
@@ -310,7 +465,20 @@ func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 			return 0, status
 		}
 	}
-	return f.doWrite(data, off)
+	written, status := f.doWrite(data, off)
+	// The data must be on disk before the header is updated. In integrity
+	// mode, every write changes the hash tree root.
+	newSize := uint64(off) + uint64(written)
+	if newSize < plainSize {
+		newSize = plainSize
+	}
+	if newSize != plainSize || f.contentEnc.Integrity() {
+		headerStatus := f.storeHeader(newSize)
+		if status == fuse.OK {
+			status = headerStatus
+		}
+	}
+	return written, status
 }
 
 // Release - FUSE call, close file
@@ -323,6 +491,7 @@ func (f *file) Release() {
 	f.released = true
 	f.fdLock.Unlock()
 
+	wlock.dropLockFds(f)
 	wlock.unregister(f.ino)
 }
 
@@ -371,17 +540,18 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 		}
 		// Truncate to zero kills the file header
 		f.header = nil
+		if f.contentEnc.Integrity() {
+			wlock.setTree(f.ino, nil)
+		}
 		return fuse.OK
 	}
 
 	// We need the old file size to determine if we are growing or shrinking
 	// the file
-	fi, err := f.fd.Stat()
-	if err != nil {
-		toggledlog.Warn.Printf("ino%d fh%d: Truncate: Fstat failed: %v", f.ino, f.intFd(), err)
-		return fuse.ToStatus(err)
+	oldSize, status := f.writePlainSize()
+	if status != fuse.OK {
+		return status
 	}
-	oldSize := f.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))
 	{
 		oldB := float32(oldSize) / float32(f.contentEnc.PlainBS())
 		newB := float32(newSize) / float32(f.contentEnc.PlainBS())
@@ -395,63 +565,103 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 
 	// File grows
 	if newSize > oldSize {
+		return f.truncateGrowFile(oldSize, newSize)
+	}
+	// File shrinks. The size must be updated before the data is cut off.
+	status = f.storeHeader(newSize)
+	if status != fuse.OK {
+		return status
+	}
+	status = f.truncateShrinkFile(newSize)
+	if status != fuse.OK || !f.contentEnc.Integrity() {
+		return status
+	}
+	// The hash tree root changes with the rewritten last block
+	return f.storeHeader(newSize)
+}
 
-		// File was empty, create new header
-		if oldSize == 0 {
-			err := f.createHeader()
-			if err != nil {
-				return fuse.ToStatus(err)
-			}
+// truncateShrinkFile - cut the file down to "newSize" plaintext bytes. The
+// last block is rewritten if it becomes partial. The caller must hold the
+// wlock.
+func (f *file) truncateShrinkFile(newSize uint64) fuse.Status {
+	if newSize == 0 {
+		err := syscall.Ftruncate(int(f.fd.Fd()), 0)
+		if err != nil {
+			toggledlog.Warn.Printf("shrink Ftruncate returned error: %v", err)
+			return fuse.ToStatus(err)
 		}
-
-		blocks := f.contentEnc.ExplodePlainRange(oldSize, newSize-oldSize)
-		for _, b := range blocks {
-			// First and last block may be partial
-			if b.IsPartial() {
-				off, _ := b.PlaintextRange()
-				off += b.Skip
-				_, status := f.doWrite(make([]byte, b.Length), int64(off))
-				if status != fuse.OK {
-					return status
-				}
-			} else {
-				off, length := b.CiphertextRange()
-				err := syscall.Ftruncate(int(f.fd.Fd()), int64(off+length))
-				if err != nil {
-					toggledlog.Warn.Printf("grow Ftruncate returned error: %v", err)
-					return fuse.ToStatus(err)
-				}
-			}
+		f.header = nil
+		if f.contentEnc.Integrity() {
+			wlock.setTree(f.ino, nil)
 		}
 		return fuse.OK
-	} else {
-		// File shrinks
-		blockNo := f.contentEnc.PlainOffToBlockNo(newSize)
-		cipherOff := f.contentEnc.BlockNoToCipherOff(blockNo)
-		plainOff := f.contentEnc.BlockNoToPlainOff(blockNo)
-		lastBlockLen := newSize - plainOff
-		var data []byte
-		if lastBlockLen > 0 {
-			var status fuse.Status
-			data, status = f.doRead(plainOff, lastBlockLen)
-			if status != fuse.OK {
-				toggledlog.Warn.Printf("shrink doRead returned error: %v", err)
-				return status
-			}
+	}
+	blockNo := f.contentEnc.PlainOffToBlockNo(newSize)
+	cipherOff := f.contentEnc.BlockNoToCipherOff(blockNo)
+	plainOff := f.contentEnc.BlockNoToPlainOff(blockNo)
+	lastBlockLen := newSize - plainOff
+	var data []byte
+	if lastBlockLen > 0 {
+		var status fuse.Status
+		data, status = f.doRead(plainOff, lastBlockLen)
+		if status != fuse.OK {
+			toggledlog.Warn.Printf("shrink doRead returned error: %v", status)
+			return status
 		}
-		// Truncate down to last complete block
-		err = syscall.Ftruncate(int(f.fd.Fd()), int64(cipherOff))
+	}
+	// Truncate down to last complete block
+	err := syscall.Ftruncate(int(f.fd.Fd()), int64(cipherOff))
+	if err != nil {
+		toggledlog.Warn.Printf("shrink Ftruncate returned error: %v", err)
+		return fuse.ToStatus(err)
+	}
+	if f.contentEnc.Integrity() {
+		f.truncateTree(blockNo)
+	}
+	// Append partial block
+	if lastBlockLen > 0 {
+		_, status := f.doWrite(data, int64(plainOff))
+		return status
+	}
+	return fuse.OK
+}
+
+// truncateGrowFile - grow the file from "oldSize" to "newSize" plaintext
+// bytes. Partial blocks are filled with encrypted zeros, complete blocks become
+// file holes. The size in a version 3 header is updated last. The caller must
+// hold the wlock.
+func (f *file) truncateGrowFile(oldSize uint64, newSize uint64) fuse.Status {
+	// File was empty, create new header
+	if oldSize == 0 {
+		err := f.createHeader()
 		if err != nil {
-			toggledlog.Warn.Printf("shrink Ftruncate returned error: %v", err)
 			return fuse.ToStatus(err)
 		}
-		// Append partial block
-		if lastBlockLen > 0 {
-			_, status := f.doWrite(data, int64(plainOff))
-			return status
+	}
+
+	blocks := f.contentEnc.ExplodePlainRange(oldSize, newSize-oldSize)
+	for _, b := range blocks {
+		// First and last block may be partial
+		if b.IsPartial() {
+			off, _ := b.PlaintextRange()
+			off += b.Skip
+			_, status := f.doWrite(make([]byte, b.Length), int64(off))
+			if status != fuse.OK {
+				return status
+			}
+		} else {
+			off, length := b.CiphertextRange()
+			err := syscall.Ftruncate(int(f.fd.Fd()), int64(off+length))
+			if err != nil {
+				toggledlog.Warn.Printf("grow Ftruncate returned error: %v", err)
+				return fuse.ToStatus(err)
+			}
+			if f.contentEnc.Integrity() {
+				f.setLeaf(b.BlockNo, f.contentEnc.AllZeroBlock())
+			}
 		}
-		return fuse.OK
 	}
+	return f.storeHeader(newSize)
 }
 
 func (f *file) Chmod(mode uint32) fuse.Status {
@@ -479,22 +689,19 @@ func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
 		return fuse.ToStatus(err)
 	}
 	a.FromStat(&st)
-	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	if f.contentEnc.HeaderV3() {
+		var status fuse.Status
+		a.Size, status = f.lockedPlainSize()
+		if status != fuse.OK {
+			return status
+		}
+	} else {
+		a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	}
 
 	return fuse.OK
 }
 
-// Only warn once
-var allocateWarnOnce sync.Once
-
-// Allocate - FUSE call, fallocate(2)
-func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
-	allocateWarnOnce.Do(func() {
-		toggledlog.Warn.Printf("fallocate(2) is not supported, returning ENOSYS - see https://github.com/rfjakob/gocryptfs/issues/1")
-	})
-	return fuse.ENOSYS
-}
-
 const _UTIME_OMIT = ((1 << 30) - 2)
 
 func (f *file) Utimens(a *time.Time, m *time.Time) fuse.Status {
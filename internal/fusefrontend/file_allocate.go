@@ -0,0 +1,124 @@
+package fusefrontend
+
+// FUSE operations for fallocate(2)
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// Allocate - FUSE call, fallocate(2)
+//
+// Supported modes are 0 (allocate and extend the file), FALLOC_FL_KEEP_SIZE
+// (allocate without changing the size) and FALLOC_FL_PUNCH_HOLE combined with
+// FALLOC_FL_KEEP_SIZE (zero out the range).
+func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		toggledlog.Warn.Printf("ino%d fh%d: Allocate on released file", f.ino, f.intFd())
+		return fuse.EBADF
+	}
+	if sz == 0 {
+		return fuse.EINVAL
+	}
+	wlock.lock(f.ino)
+	defer wlock.unlock(f.ino)
+
+	toggledlog.Debug.Printf("ino%d: FUSE Allocate: offset=%d length=%d mode=%#x", f.ino, off, sz, mode)
+
+	plainSize, status := f.writePlainSize()
+	if status != fuse.OK {
+		return status
+	}
+
+	switch mode {
+	case 0:
+		if off+sz > plainSize {
+			status = f.truncateGrowFile(plainSize, off+sz)
+			if status != fuse.OK {
+				return status
+			}
+		}
+		return f.preallocPlainRange(off, sz)
+	case FALLOC_FL_KEEP_SIZE:
+		return f.preallocPlainRange(off, sz)
+	case FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE:
+		if off >= plainSize {
+			return fuse.OK
+		}
+		status = f.punchPlainRange(off, contentenc.MinUint64(sz, plainSize-off))
+		if status != fuse.OK || !f.contentEnc.Integrity() {
+			return status
+		}
+		// The hash tree root has changed
+		return f.storeHeader(plainSize)
+	}
+	// FALLOC_FL_PUNCH_HOLE without FALLOC_FL_KEEP_SIZE is invalid, everything
+	// else (COLLAPSE_RANGE, ZERO_RANGE, ...) is not implemented
+	return fuse.Status(syscall.EOPNOTSUPP)
+}
+
+// preallocPlainRange - preallocate the ciphertext blocks that correspond to
+// the plaintext range. Does not change the file size.
+func (f *file) preallocPlainRange(off uint64, sz uint64) fuse.Status {
+	firstBlockNo := f.contentEnc.PlainOffToBlockNo(off)
+	lastBlockNo := f.contentEnc.PlainOffToBlockNo(off + sz - 1)
+	cOff := f.contentEnc.BlockNoToCipherOff(firstBlockNo)
+	cEnd := f.contentEnc.BlockNoToCipherOff(lastBlockNo + 1)
+	err := prealloc(int(f.fd.Fd()), int64(cOff), int64(cEnd-cOff))
+	if err != nil {
+		toggledlog.Warn.Printf("ino%d fh%d: Allocate: prealloc failed: %v", f.ino, f.intFd(), err)
+	}
+	return fuse.ToStatus(err)
+}
+
+// punchPlainRange - zero out the plaintext range, which must lie inside the
+// file. Complete blocks are replaced by all-zero ciphertext, which
+// DecryptBlock() treats as a file hole. Partial blocks get encrypted zeros
+// using read-modify-write.
+func (f *file) punchPlainRange(off uint64, sz uint64) fuse.Status {
+	blocks := f.contentEnc.ExplodePlainRange(off, sz)
+	var holeStart, holeEnd uint64
+	var holeBlocks []uint64
+	for _, b := range blocks {
+		if b.IsPartial() {
+			o, _ := b.PlaintextRange()
+			_, status := f.doWrite(make([]byte, b.Length), int64(o+b.Skip))
+			if status != fuse.OK {
+				return status
+			}
+			continue
+		}
+		cOff, cLen := b.CiphertextRange()
+		if holeEnd == 0 {
+			holeStart = cOff
+		}
+		holeEnd = cOff + cLen
+		holeBlocks = append(holeBlocks, b.BlockNo)
+	}
+	if holeEnd == 0 {
+		return fuse.OK
+	}
+	fd := int(f.fd.Fd())
+	err := punchHole(fd, int64(holeStart), int64(holeEnd-holeStart))
+	if err == syscall.EOPNOTSUPP {
+		// The backing filesystem cannot deallocate, write the zeros ourselves
+		zeros := make([]byte, f.contentEnc.CipherBS())
+		for o := holeStart; o < holeEnd && err == nil; o += uint64(len(zeros)) {
+			_, err = syscall.Pwrite(fd, zeros, int64(o))
+		}
+	}
+	if err != nil {
+		toggledlog.Warn.Printf("ino%d fh%d: Allocate: punching hole failed: %v", f.ino, f.intFd(), err)
+	} else if f.contentEnc.Integrity() {
+		for _, blockNo := range holeBlocks {
+			f.setLeaf(blockNo, f.contentEnc.AllZeroBlock())
+		}
+	}
+	return fuse.ToStatus(err)
+}
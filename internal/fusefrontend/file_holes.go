@@ -3,6 +3,8 @@ package fusefrontend
 // Helper functions for sparse files (files with holes)
 
 import (
+	"syscall"
+
 	"github.com/hanwen/go-fuse/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/toggledlog"
@@ -27,3 +29,23 @@ func (f *file) zeroPad(plainSize uint64) fuse.Status {
 	_, status := f.doWrite(pad, int64(plainSize))
 	return status
 }
+
+// Only whole pages of the backing file can be deallocated
+const pageSize = 4096
+
+// punchPadding - deallocate the zero padding of compressed block "block" that
+// has just been written to ciphertext offset "off". The padding is already on
+// disk as zeros, so errors are not fatal.
+func (f *file) punchPadding(off uint64, block []byte) {
+	start := off + f.contentEnc.UsedLen(block)
+	end := off + uint64(len(block))
+	start = (start + pageSize - 1) / pageSize * pageSize
+	end = end / pageSize * pageSize
+	if start >= end {
+		return
+	}
+	err := punchHole(int(f.fd.Fd()), int64(start), int64(end-start))
+	if err != nil && err != syscall.EOPNOTSUPP {
+		toggledlog.Debug.Printf("ino%d: punchPadding: %v", f.ino, err)
+	}
+}
@@ -0,0 +1,125 @@
+package fusefrontend
+
+// Integrity mode: every file has a hash tree over its ciphertext blocks. The
+// root is stored in the authenticated version 3 header, so a block that is
+// replaced by an older version of itself, moved to another position or cut
+// off is detected.
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/merkletree"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// Read the ciphertext in chunks of this size when building the hash tree
+const treeReadSize = 1024 * 1024
+
+// loadTree - make sure the cached hash tree matches the header that
+// plainSize() has just read from disk. The tree is rebuilt from the ciphertext
+// and verified if it is not cached yet or if the file has been changed
+// through another path, for example by open(O_TRUNC). The caller must hold
+// the wlock.
+func (f *file) loadTree(plainSize uint64) fuse.Status {
+	if f.header == nil {
+		// Empty file
+		wlock.setTree(f.ino, &merkletree.Tree{})
+		return fuse.OK
+	}
+	t := wlock.getTree(f.ino)
+	if t != nil && bytes.Equal(t.Root(), f.header.Root) {
+		return fuse.OK
+	}
+	t, err := f.buildTree(plainSize)
+	if err != nil {
+		toggledlog.Warn.Printf("ino%d: loadTree: %v", f.ino, err)
+		return fuse.ToStatus(err)
+	}
+	if !bytes.Equal(t.Root(), f.header.Root) {
+		toggledlog.Warn.Printf("ino%d: hash tree mismatch: stale, reordered or missing blocks", f.ino)
+		return fuse.EIO
+	}
+	wlock.setTree(f.ino, t)
+	return fuse.OK
+}
+
+// buildTree - hash all ciphertext blocks up to "plainSize"
+func (f *file) buildTree(plainSize uint64) (*merkletree.Tree, error) {
+	t := &merkletree.Tree{}
+	cipherBS := f.contentEnc.CipherBS()
+	cipherSize := f.contentEnc.PlainSizeToCipherSize(plainSize)
+	buf := make([]byte, (treeReadSize/cipherBS+1)*cipherBS)
+	for off := f.contentEnc.HeaderLen(); off < cipherSize; {
+		chunk := buf[:contentenc.MinUint64(uint64(len(buf)), cipherSize-off)]
+		n, err := f.fd.ReadAt(chunk, int64(off))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		chunk = chunk[:n]
+		for len(chunk) > 0 {
+			block := chunk[:contentenc.MinUint64(cipherBS, uint64(len(chunk)))]
+			t.Set(t.Len(), merkletree.Leaf(t.Len(), block))
+			chunk = chunk[len(block):]
+		}
+		if n == 0 {
+			// The file is shorter than the header says. The root will not
+			// match.
+			break
+		}
+		off += uint64(n)
+	}
+	return t, nil
+}
+
+// verifyBlocks - check the ciphertext that doRead() has read for "blockCount"
+// blocks starting at "firstBlockNo" against the hash tree. The caller must
+// hold the wlock.
+func (f *file) verifyBlocks(ciphertext []byte, firstBlockNo uint64, blockCount uint64) fuse.Status {
+	t := wlock.getTree(f.ino)
+	cipherBS := int(f.contentEnc.CipherBS())
+	for blockNo := firstBlockNo; blockNo < firstBlockNo+blockCount; blockNo++ {
+		if blockNo >= t.Len() {
+			if len(ciphertext) > 0 {
+				toggledlog.Warn.Printf("ino%d: block #%d is not in the hash tree", f.ino, blockNo)
+				return fuse.EIO
+			}
+			break
+		}
+		if len(ciphertext) == 0 {
+			toggledlog.Warn.Printf("ino%d: block #%d is missing", f.ino, blockNo)
+			return fuse.EIO
+		}
+		block := ciphertext
+		if len(block) > cipherBS {
+			block = block[:cipherBS]
+		}
+		if !bytes.Equal(merkletree.Leaf(blockNo, block), t.Leaf(blockNo)) {
+			toggledlog.Warn.Printf("ino%d: block #%d does not match the hash tree (stale or moved block)",
+				f.ino, blockNo)
+			return fuse.EIO
+		}
+		ciphertext = ciphertext[len(block):]
+	}
+	return fuse.OK
+}
+
+// setLeaf - update the hash tree after ciphertext block "blockNo" has been
+// written. Blocks between the old end of the tree and "blockNo" are file
+// holes. The caller must hold the wlock.
+func (f *file) setLeaf(blockNo uint64, block []byte) {
+	t := wlock.getTree(f.ino)
+	for i := t.Len(); i < blockNo; i++ {
+		t.Set(i, merkletree.Leaf(i, f.contentEnc.AllZeroBlock()))
+	}
+	t.Set(blockNo, merkletree.Leaf(blockNo, block))
+}
+
+// truncateTree - drop the hash tree leaves starting at block "blockNo".
+// The caller must hold the wlock.
+func (f *file) truncateTree(blockNo uint64) {
+	wlock.getTree(f.ino).Truncate(blockNo)
+}
@@ -0,0 +1,134 @@
+package fusefrontend
+
+// FUSE operations for fcntl(2) and flock(2) advisory locks
+//
+// Locks are taken on the backing ciphertext file, so they are visible to
+// other gocryptfs mounts of the same CIPHERDIR and to programs that access
+// the ciphertext directly. Byte ranges are passed through unchanged: they
+// do not match the ciphertext layout, but lock ranges only have to be
+// consistent between the users of a lock, not between the plaintext and
+// the ciphertext view.
+//
+// flock(2) locks belong to the open file, like our file handles, and are
+// taken on the backing fd of the handle. fcntl(2) locks belong to the lock
+// owner, usually a process, which may hold them through several file
+// handles. Every owner gets a backing fd of its own (see wlockMap.getLockFd)
+// that carries its open file description locks, so the locks of one owner
+// never conflict with each other.
+//
+// Limitation: POSIX releases all locks of a process when it closes any fd of
+// the file. The FUSE flush request that tells us about this does not reach
+// us with the lock owner, so the locks of an owner are only released when
+// it unlocks them or when all file handles it has used are released.
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// GetLk - FUSE call, fcntl(F_GETLK)
+func (f *file) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) fuse.Status {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		toggledlog.Warn.Printf("ino%d fh%d: GetLk on released file", f.ino, f.intFd())
+		return fuse.EBADF
+	}
+	l, err := wlock.getLockFd(f, owner, f.openLockFd)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer wlock.putLockFd(f.ino, owner, l, false)
+	var flk syscall.Flock_t
+	lk.ToFlockT(&flk)
+	err = syscallcompat.FcntlFlockOFD(l.fd.Fd(), syscall.F_GETLK, &flk)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	out.FromFlockT(&flk)
+	return fuse.OK
+}
+
+// SetLk - FUSE call, fcntl(F_SETLK) and non-blocking flock(2)
+func (f *file) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	return f.setLock(owner, lk, flags, false)
+}
+
+// SetLkw - FUSE call, fcntl(F_SETLKW) and blocking flock(2)
+func (f *file) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	return f.setLock(owner, lk, flags, true)
+}
+
+// setLock - take or release a lock on the backing file.
+//
+// A blocking request can wait for a long time, and we do not get to know if
+// the caller gives up. It must not hold fdLock while it waits, or Release()
+// and every other operation on the file handle would wait with it. So the
+// lock is taken on an fd that stays valid without fdLock: a dup of the
+// backing fd for flock(2), which shares the open file and its locks, and
+// the reference-counted fd of the lock owner for fcntl(2).
+func (f *file) setLock(owner uint64, lk *fuse.FileLock, flags uint32, blocking bool) fuse.Status {
+	f.fdLock.RLock()
+	if f.released {
+		f.fdLock.RUnlock()
+		toggledlog.Warn.Printf("ino%d fh%d: SetLk on released file", f.ino, f.intFd())
+		return fuse.EBADF
+	}
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		var how int
+		switch lk.Typ {
+		case syscall.F_RDLCK:
+			how = syscall.LOCK_SH
+		case syscall.F_WRLCK:
+			how = syscall.LOCK_EX
+		case syscall.F_UNLCK:
+			how = syscall.LOCK_UN
+		default:
+			f.fdLock.RUnlock()
+			return fuse.EINVAL
+		}
+		if !blocking {
+			how |= syscall.LOCK_NB
+		}
+		fd, err := syscall.Dup(f.intFd())
+		f.fdLock.RUnlock()
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		defer syscall.Close(fd)
+		return fuse.ToStatus(syscall.Flock(fd, how))
+	}
+	l, err := wlock.getLockFd(f, owner, f.openLockFd)
+	f.fdLock.RUnlock()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	var flk syscall.Flock_t
+	lk.ToFlockT(&flk)
+	cmd := syscall.F_SETLK
+	if blocking {
+		cmd = syscall.F_SETLKW
+	}
+	err = syscallcompat.FcntlFlockOFD(l.fd.Fd(), cmd, &flk)
+	// Unlocking the whole file leaves the owner without locks
+	unlocked := err == nil && flk.Type == syscall.F_UNLCK && flk.Start == 0 && flk.Len == 0
+	wlock.putLockFd(f.ino, owner, l, unlocked)
+	return fuse.ToStatus(err)
+}
+
+// openLockFd - open a new backing fd for the fcntl locks of a lock owner.
+// Write locks need an fd that is open for writing, files we may not write to
+// are opened read-only.
+func (f *file) openLockFd() (*os.File, error) {
+	path := syscallcompat.ProcFdPath(f.intFd())
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		fd, err = os.Open(path)
+	}
+	return fd, err
+}
@@ -1,28 +1,31 @@
 package fusefrontend
 
-// FUSE operations on paths
+// FUSE operations on nodes
 
 import (
 	"encoding/base64"
 	"os"
-	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"golang.org/x/sys/unix"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/toggledlog"
 )
 
+// FS - state shared by all nodes of the filesystem. The FUSE operations are
+// implemented on the nodes, see node.go.
 type FS struct {
-	pathfs.FileSystem      // loopbackFileSystem, see go-fuse/fuse/pathfs/loopback.go
-	args              Args // Stores configuration arguments
+	args Args // Stores configuration arguments
+	// Root node, set by Root()
+	root *node
 	// dirIVLock: Lock()ed if any "gocryptfs.diriv" file is modified
 	// Readers must RLock() it to prevent them from seeing intermediate
 	// states
@@ -31,51 +34,119 @@ type FS struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Extended attribute name encryption helper. Always uses EME, independent
+	// of the file name settings.
+	xattrNames *nametransform.NameTransform
 }
 
 // Encrypted FUSE overlay filesystem
 func NewFS(args Args) *FS {
 
-	cryptoCore := cryptocore.New(args.Masterkey, args.OpenSSL, args.GCMIV128)
-	contentEnc := contentenc.New(cryptoCore, contentenc.DefaultBS)
+	cryptoCore := cryptocore.New(args.Masterkey, args.AEADType(), args.GCMIV128, args.HKDF)
+	contentEnc := contentenc.New(cryptoCore, args.PlainBS, args.HeaderV3, args.Integrity, args.Compress)
 	nameTransform := nametransform.New(cryptoCore, args.EMENames, args.LongNames)
 
 	return &FS{
-		FileSystem:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
 		args:          args,
 		nameTransform: nameTransform,
 		contentEnc:    contentEnc,
+		xattrNames:    nametransform.New(cryptoCore, true, false),
 	}
 }
 
-func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	toggledlog.Debug.Printf("FS.GetAttr('%s')", name)
-	if fs.isFiltered(name) {
-		return nil, fuse.EPERM
+// LogCtlSockStats - log the hit and miss counts of the DirIV cache at debug
+// level. Called after the filesystem has been unmounted. FUSE operations keep
+// the DirIV in the directory nodes, the cache only serves path lookups of
+// the control socket.
+func (fs *FS) LogCtlSockStats() {
+	if !fs.args.CtlSock {
+		return
 	}
-	cName, err := fs.encryptPath(name)
+	hits, misses := fs.nameTransform.DirIVCache.Stats()
+	toggledlog.Debug.Printf("ctlsock DirIV cache: %d hits, %d misses", hits, misses)
+}
+
+// plainSize - get the plaintext size of the regular file "cName" in the
+// ciphertext directory "dirfd" that has "cipherSize" bytes. The authenticated
+// size in version 3 headers is used, the size is only calculated from the
+// ciphertext size for files that have no header (yet). A header that cannot
+// be read or does not authenticate gives EIO.
+func (fs *FS) plainSize(dirfd *os.File, cName string, cipherSize uint64) (uint64, fuse.Status) {
+	if !fs.contentEnc.HeaderV3() || cipherSize < fs.contentEnc.HeaderLen() {
+		return fs.contentEnc.CipherSizeToPlainSize(cipherSize), fuse.OK
+	}
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err == syscall.EACCES {
+		// Unreadable files cannot be opened through the mount either
+		toggledlog.Debug.Printf("FS.GetAttr: could not open %q: %v", cName, err)
+		return fs.contentEnc.CipherSizeToPlainSize(cipherSize), fuse.OK
+	} else if err != nil {
+		return 0, fuse.ToStatus(err)
+	}
+	fd := os.NewFile(uintptr(fdRaw), cName)
+	defer fd.Close()
+	buf := make([]byte, fs.contentEnc.HeaderLen())
+	_, err = fd.ReadAt(buf, 0)
 	if err != nil {
-		return nil, fuse.ToStatus(err)
+		toggledlog.Warn.Printf("FS.GetAttr: could not read header of %q: %v", cName, err)
+		return 0, fuse.EIO
 	}
-	a, status := fs.FileSystem.GetAttr(cName, context)
-	if a == nil {
-		toggledlog.Debug.Printf("FS.GetAttr failed: %s", status.String())
-		return a, status
+	h, err := fs.contentEnc.DecryptHeader(buf)
+	if err != nil {
+		toggledlog.Warn.Printf("FS.GetAttr: corrupt header of %q: %v", cName, err)
+		return 0, fuse.EIO
 	}
+	return h.PlainSize, fuse.OK
+}
+
+// getAttr - get the plaintext attributes of "cName" in the ciphertext
+// directory "dirfd"
+func (fs *FS) getAttr(dirfd *os.File, cName string) (*fuse.Attr, fuse.Status) {
+	var st syscall.Stat_t
+	err := syscallcompat.Fstatat(int(dirfd.Fd()), cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		toggledlog.Debug.Printf("FS.GetAttr failed: %v", err)
+		return nil, fuse.ToStatus(err)
+	}
+	a := &fuse.Attr{}
+	a.FromStat(&st)
 	if a.IsRegular() {
-		a.Size = fs.contentEnc.CipherSizeToPlainSize(a.Size)
+		var status fuse.Status
+		a.Size, status = fs.plainSize(dirfd, cName, a.Size)
+		if !status.Ok() {
+			return nil, status
+		}
 	} else if a.IsSymlink() {
-		target, _ := fs.Readlink(name, context)
+		target, _ := fs.readlink(dirfd, cName)
 		a.Size = uint64(len(target))
 	}
-	return a, status
+	return a, fuse.OK
+}
+
+func (n *node) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	if file != nil {
+		return file.GetAttr(out)
+	}
+	dirfd, cName, release, err := n.backing()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer release()
+	a, status := n.fs.getAttr(dirfd, cName)
+	if !status.Ok() {
+		return status
+	}
+	*out = *a
+	return fuse.OK
 }
 
 // We always need read access to do read-modify-write cycles
 func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int, writeOnly bool) {
 	newFlags = int(flags)
 	if newFlags&os.O_WRONLY > 0 {
-		writeOnly = true
+		// With writeback caching, the kernel reads the rest of partially
+		// written pages
+		writeOnly = !fs.args.Writeback
 		newFlags = newFlags ^ os.O_WRONLY | os.O_RDWR
 	}
 	// We also cannot open the file in append mode, we need to seek back for RMW
@@ -84,170 +155,287 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int, writeOnly bool) {
 	return newFlags, writeOnly
 }
 
-func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
-	if fs.isFiltered(path) {
-		return nil, fuse.EPERM
+func (n *node) Open(flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	if n.fs.args.ReadOnly && flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, fuse.EROFS
 	}
-	iflags, writeOnly := fs.mangleOpenFlags(flags)
-	cPath, err := fs.getBackingPath(path)
+	iflags, writeOnly := n.fs.mangleOpenFlags(flags)
+	dirfd, cName, release, err := n.backing()
 	if err != nil {
-		toggledlog.Debug.Printf("Open: getBackingPath: %v", err)
+		toggledlog.Debug.Printf("Open: backing: %v", err)
 		return nil, fuse.ToStatus(err)
 	}
-	toggledlog.Debug.Printf("Open: %s", cPath)
-	f, err := os.OpenFile(cPath, iflags, 0666)
+	defer release()
+	toggledlog.Debug.Printf("Open: %s/%s", dirfd.Name(), cName)
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), cName, iflags|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
 
-	return NewFile(f, writeOnly, fs.contentEnc)
+	f, status := NewFile(os.NewFile(uintptr(fdRaw), cName), writeOnly, n.fs.contentEnc)
+	if !status.Ok() {
+		return nil, status
+	}
+	return n.fs.keepCache(f), fuse.OK
 }
 
-func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
-	if fs.isFiltered(path) {
-		return nil, fuse.EPERM
+// keepCache - tell the kernel to keep the cached contents of "f" from
+// earlier opens if -kernel_cache is enabled. Every change to the file goes
+// through the kernel, so the cache is up to date. The exception are files
+// with several hard links: a link created through Link shares the node and
+// kernel inode of its target, but Lookup creates a separate node for every
+// name of a file that already had several links, and every node has its
+// own page cache in the kernel.
+func (fs *FS) keepCache(f nodefs.File) nodefs.File {
+	if !fs.args.KernelCache {
+		return f
+	}
+	var st syscall.Stat_t
+	err := syscall.Fstat(int(f.(*file).fd.Fd()), &st)
+	if err != nil || st.Nlink != 1 {
+		return f
+	}
+	return &nodefs.WithFlags{File: f, FuseFlags: fuse.FOPEN_KEEP_CACHE}
+}
+
+func (n *node) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, child *nodefs.Inode, code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return nil, nil, fuse.EROFS
+	}
+	if n.isFiltered(name) {
+		return nil, nil, fuse.EPERM
 	}
-	iflags, writeOnly := fs.mangleOpenFlags(flags)
-	cPath, err := fs.getBackingPath(path)
+	iflags, writeOnly := n.fs.mangleOpenFlags(flags)
+	cName, err := n.encryptChildName(name)
 	if err != nil {
-		return nil, fuse.ToStatus(err)
+		return nil, nil, fuse.ToStatus(err)
 	}
-
-	var fd *os.File
-	cName := filepath.Base(cPath)
+	dirfd, err := n.acquireDirfd()
+	if err != nil {
+		return nil, nil, fuse.ToStatus(err)
+	}
+	defer n.releaseDirfd()
 
 	// Handle long file name
-	if nametransform.IsLongContent(cName) {
-		var dirfd *os.File
-		dirfd, err = os.Open(filepath.Dir(cPath))
-		if err != nil {
-			return nil, fuse.ToStatus(err)
-		}
-		defer dirfd.Close()
-
+	isLong := nametransform.IsLongContent(cName)
+	if isLong {
 		// Create ".name"
-		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
+		err = n.fs.nameTransform.WriteLongName(dirfd, cName, name)
 		if err != nil {
-			return nil, fuse.ToStatus(err)
+			return nil, nil, fuse.ToStatus(err)
 		}
+	}
 
-		// Create content
-		var fdRaw int
-		fdRaw, err = syscall.Openat(int(dirfd.Fd()), cName, iflags|os.O_CREATE, mode)
-		if err != nil {
+	// Create content
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), cName, iflags|syscall.O_CREAT|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		if isLong {
 			nametransform.DeleteLongName(dirfd, cName)
-			return nil, fuse.ToStatus(err)
-		}
-		fd = os.NewFile(uintptr(fdRaw), cName)
-	} else {
-		// Normal (short) file name
-		fd, err = os.OpenFile(cPath, iflags|os.O_CREATE, os.FileMode(mode))
-		if err != nil {
-			return nil, fuse.ToStatus(err)
 		}
+		return nil, nil, fuse.ToStatus(err)
 	}
-
-	return NewFile(fd, writeOnly, fs.contentEnc)
+	fd := os.NewFile(uintptr(fdRaw), cName)
+	fuseFile, code = NewFile(fd, writeOnly, n.fs.contentEnc)
+	if !code.Ok() {
+		fd.Close()
+		return nil, nil, code
+	}
+	c := n.fs.newFileNode(fuseFile.(*file).ino)
+	c.setName(n, name, cName)
+	return n.fs.keepCache(fuseFile), n.addChild(name, c), fuse.OK
 }
 
-func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
-		return fuse.EPERM
+func (n *node) Chmod(file nodefs.File, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	if file != nil {
+		return file.Chmod(mode)
 	}
-	cPath, err := fs.encryptPath(path)
+	dirfd, cName, release, err := n.backing()
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	return fs.FileSystem.Chmod(cPath, mode, context)
+	defer release()
+	return fuse.ToStatus(syscallcompat.FchmodatNofollow(int(dirfd.Fd()), cName, mode))
 }
 
-func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
-		return fuse.EPERM
+func (n *node) Chown(file nodefs.File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
 	}
-	cPath, err := fs.getBackingPath(path)
+	if file != nil {
+		return file.Chown(uid, gid)
+	}
+	dirfd, cName, release, err := n.backing()
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	return fuse.ToStatus(os.Lchown(cPath, int(uid), int(gid)))
+	defer release()
+	return fuse.ToStatus(unix.Fchownat(int(dirfd.Fd()), cName, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW))
 }
 
-func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
-		return fuse.EPERM
+func (n *node) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return nil, fuse.EROFS
 	}
-	cPath, err := fs.encryptPath(path)
+	if n.isFiltered(name) {
+		return nil, fuse.EPERM
+	}
+	cName, err := n.encryptChildName(name)
 	if err != nil {
-		return fuse.ToStatus(err)
+		return nil, fuse.ToStatus(err)
 	}
+	dirfd, err := n.acquireDirfd()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer n.releaseDirfd()
 
 	// Handle long file name
-	cName := filepath.Base(cPath)
-	if nametransform.IsLongContent(cName) {
-		dirfd, err := os.Open(filepath.Dir(cPath))
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer dirfd.Close()
-
+	isLong := nametransform.IsLongContent(cName)
+	if isLong {
 		// Create ".name"
-		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
+		err = n.fs.nameTransform.WriteLongName(dirfd, cName, name)
 		if err != nil {
-			return fuse.ToStatus(err)
+			return nil, fuse.ToStatus(err)
 		}
+	}
 
-		// Create device node
-		err = syscall.Mknodat(int(dirfd.Fd()), cName, uint32(mode), int(dev))
-		if err != nil {
+	// Create device node
+	err = syscallcompat.Mknodat(int(dirfd.Fd()), cName, mode, int(dev))
+	if err != nil {
+		if isLong {
 			nametransform.DeleteLongName(dirfd, cName)
 		}
-
-		return fuse.ToStatus(err)
+		return nil, fuse.ToStatus(err)
 	}
+	return n.newChildAt(dirfd, name, cName)
+}
 
-	return fs.FileSystem.Mknod(cPath, mode, dev, context)
+// newChildAt - add the node for the file, symlink or device "cName" that has
+// just been created in our ciphertext directory "dirfd" as "name"
+func (n *node) newChildAt(dirfd *os.File, name string, cName string) (*nodefs.Inode, fuse.Status) {
+	var st syscall.Stat_t
+	err := syscallcompat.Fstatat(int(dirfd.Fd()), cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	c := n.fs.newFileNode(st.Ino)
+	c.setName(n, name, cName)
+	return n.addChild(name, c), fuse.OK
 }
 
-// Only warn once
-var truncateWarnOnce sync.Once
+// Truncate - FUSE call. Triggered by truncate(2) on a path.
+// Opens the backing file and truncates it through a temporary file object so
+// the per-inode write lock and the RMW logic of file.Truncate are reused.
+func (n *node) Truncate(file nodefs.File, offset uint64, context *fuse.Context) (code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	if file != nil {
+		return file.Truncate(offset)
+	}
+	dirfd, cName, release, err := n.backing()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer release()
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), cName, syscall.O_RDWR|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	fd := os.NewFile(uintptr(fdRaw), cName)
+	f, code := NewFile(fd, false, n.fs.contentEnc)
+	if !code.Ok() {
+		fd.Close()
+		return code
+	}
+	defer f.Release()
+	return f.Truncate(offset)
+}
 
-func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	truncateWarnOnce.Do(func() {
-		toggledlog.Warn.Printf("truncate(2) is not supported, returning ENOSYS - use ftruncate(2)")
-	})
-	return fuse.ENOSYS
+// utimeToTimespec - convert a FUSE timestamp for utimensat. A nil time means
+// that the timestamp should not be changed.
+func utimeToTimespec(t *time.Time) unix.Timespec {
+	if t == nil {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
 }
 
-func (fs *FS) Utimens(path string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
-		return fuse.EPERM
+func (n *node) Utimens(file nodefs.File, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
 	}
-	cPath, err := fs.encryptPath(path)
+	if file != nil {
+		return file.Utimens(Atime, Mtime)
+	}
+	dirfd, cName, release, err := n.backing()
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	return fs.FileSystem.Utimens(cPath, Atime, Mtime, context)
+	defer release()
+	ts := []unix.Timespec{utimeToTimespec(Atime), utimeToTimespec(Mtime)}
+	return fuse.ToStatus(unix.UtimesNanoAt(int(dirfd.Fd()), cName, ts, unix.AT_SYMLINK_NOFOLLOW))
 }
 
-func (fs *FS) StatFs(path string) *fuse.StatfsOut {
-	if fs.isFiltered(path) {
+// Fallocate - FUSE call. The kernel always passes the open file.
+func (n *node) Fallocate(file nodefs.File, off uint64, size uint64, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if file == nil {
+		return fuse.ENOSYS
+	}
+	return file.Allocate(off, size, mode)
+}
+
+func (n *node) Read(file nodefs.File, dest []byte, off int64, context *fuse.Context) (fuse.ReadResult, fuse.Status) {
+	if file == nil {
+		return nil, fuse.ENOSYS
+	}
+	return file.Read(dest, off)
+}
+
+func (n *node) Write(file nodefs.File, data []byte, off int64, context *fuse.Context) (written uint32, code fuse.Status) {
+	if file == nil {
+		return 0, fuse.ENOSYS
+	}
+	return file.Write(data, off)
+}
+
+// StatFs - FUSE call. Reports the file system that holds the ciphertext
+// directory of the node.
+func (n *node) StatFs() *fuse.StatfsOut {
+	dirfd, _, release, err := n.backing()
+	if err != nil {
 		return nil
 	}
-	cPath, err := fs.encryptPath(path)
+	defer release()
+	var st syscall.Statfs_t
+	err = syscall.Fstatfs(int(dirfd.Fd()), &st)
 	if err != nil {
 		return nil
 	}
-	return fs.FileSystem.StatFs(cPath)
+	out := &fuse.StatfsOut{}
+	out.FromStatfsT(&st)
+	return out
 }
 
-func (fs *FS) Readlink(path string, context *fuse.Context) (out string, status fuse.Status) {
-	cPath, err := fs.encryptPath(path)
+func (n *node) Readlink(context *fuse.Context) ([]byte, fuse.Status) {
+	dirfd, cName, release, err := n.backing()
 	if err != nil {
-		return "", fuse.ToStatus(err)
+		return nil, fuse.ToStatus(err)
 	}
-	cTarget, status := fs.FileSystem.Readlink(cPath, context)
-	if status != fuse.OK {
-		return "", status
+	defer release()
+	target, status := n.fs.readlink(dirfd, cName)
+	return []byte(target), status
+}
+
+// readlink - read and decrypt the target of symlink "cName" in the ciphertext
+// directory "dirfd"
+func (fs *FS) readlink(dirfd *os.File, cName string) (string, fuse.Status) {
+	cTarget, err := syscallcompat.Readlinkat(int(dirfd.Fd()), cName)
+	if err != nil {
+		return "", fuse.ToStatus(err)
 	}
 	// Old filesystem: symlinks are encrypted like paths (CBC)
 	if !fs.args.DirIV {
@@ -273,228 +461,224 @@ func (fs *FS) Readlink(path string, context *fuse.Context) (out string, status f
 	return string(target), fuse.OK
 }
 
-func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
+func (n *node) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	if n.isFiltered(name) {
 		return fuse.EPERM
 	}
-	cPath, err := fs.getBackingPath(path)
+	cName, err := n.encryptChildName(name)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	dirfd, err := n.acquireDirfd()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer n.releaseDirfd()
 
-	cName := filepath.Base(cPath)
+	// Delete content
+	err = syscall.Unlinkat(int(dirfd.Fd()), cName)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
 	if nametransform.IsLongContent(cName) {
-		var dirfd *os.File
-		dirfd, err = os.Open(filepath.Dir(cPath))
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer dirfd.Close()
-		// Delete content
-		err = syscall.Unlinkat(int(dirfd.Fd()), cName)
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
 		// Delete ".name"
 		err = nametransform.DeleteLongName(dirfd, cName)
 		if err != nil {
 			toggledlog.Warn.Printf("Unlink: could not delete .name file: %v", err)
 		}
-		return fuse.ToStatus(err)
 	}
-
-	err = syscall.Unlink(cPath)
 	return fuse.ToStatus(err)
 }
 
-func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (code fuse.Status) {
+func (n *node) Symlink(linkName string, target string, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
 	toggledlog.Debug.Printf("Symlink(\"%s\", \"%s\")", target, linkName)
-	if fs.isFiltered(linkName) {
-		return fuse.EPERM
+	if n.fs.args.ReadOnly {
+		return nil, fuse.EROFS
+	}
+	if n.isFiltered(linkName) {
+		return nil, fuse.EPERM
 	}
-	cPath, err := fs.getBackingPath(linkName)
+	cName, err := n.encryptChildName(linkName)
 	if err != nil {
-		return fuse.ToStatus(err)
+		return nil, fuse.ToStatus(err)
 	}
-	// Before v0.5, symlinks were encrypted like paths (CBC)
-	// TODO drop compatibility and simplify code?
-	if !fs.args.DirIV {
-		var cTarget string
-		cTarget, err = fs.encryptPath(target)
+	dirfd, err := n.acquireDirfd()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer n.releaseDirfd()
+	var cTarget string
+	if !n.fs.args.DirIV {
+		// Before v0.5, symlinks were encrypted like paths (CBC)
+		// TODO drop compatibility and simplify code?
+		cTarget, err = n.fs.encryptPath(target)
 		if err != nil {
 			toggledlog.Warn.Printf("Symlink: BUG: we should not get an error here: %v", err)
-			return fuse.ToStatus(err)
+			return nil, fuse.ToStatus(err)
 		}
-		err = os.Symlink(cTarget, cPath)
-		return fuse.ToStatus(err)
+	} else {
+		cBinTarget := n.fs.contentEnc.EncryptBlock([]byte(target), 0, nil)
+		cTarget = base64.URLEncoding.EncodeToString(cBinTarget)
 	}
 
-	cBinTarget := fs.contentEnc.EncryptBlock([]byte(target), 0, nil)
-	cTarget := base64.URLEncoding.EncodeToString(cBinTarget)
-
 	// Handle long file name
-	cName := filepath.Base(cPath)
-	if nametransform.IsLongContent(cName) {
-		var dirfd *os.File
-		dirfd, err = os.Open(filepath.Dir(cPath))
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer dirfd.Close()
-
+	isLong := nametransform.IsLongContent(cName)
+	if isLong {
 		// Create ".name"
-		err = fs.nameTransform.WriteLongName(dirfd, cName, linkName)
+		err = n.fs.nameTransform.WriteLongName(dirfd, cName, linkName)
 		if err != nil {
-			return fuse.ToStatus(err)
+			return nil, fuse.ToStatus(err)
 		}
+	}
 
-		// Create symlink
-		// TODO use syscall.Symlinkat once it is available in Go
-		err = syscall.Symlink(cTarget, cPath)
-		if err != nil {
+	// Create symlink
+	err = unix.Symlinkat(cTarget, int(dirfd.Fd()), cName)
+	if err != nil {
+		if isLong {
 			nametransform.DeleteLongName(dirfd, cName)
 		}
-
-		return fuse.ToStatus(err)
+		return nil, fuse.ToStatus(err)
 	}
-
-	err = os.Symlink(cTarget, cPath)
-	return fuse.ToStatus(err)
+	return n.newChildAt(dirfd, linkName, cName)
 }
 
-func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
+func (n *node) Rename(oldName string, newParent nodefs.Node, newName string, context *fuse.Context) (code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	np, ok := newParent.(*node)
+	if !ok {
+		return fuse.EXDEV
+	}
+	if np.isFiltered(newName) {
 		return fuse.EPERM
 	}
-	cOldPath, err := fs.getBackingPath(oldPath)
+	cOldName, err := n.encryptChildName(oldName)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	cNewPath, err := fs.getBackingPath(newPath)
+	cNewName, err := np.encryptChildName(newName)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	// The Rename may cause a directory to take the place of another directory.
-	// That directory may still be in the DirIV cache, clear it.
-	fs.nameTransform.DirIVCache.Clear()
-
-	// Handle long source file name
-	var oldDirFd *os.File
-	var finalOldDirFd int
-	var finalOldPath = cOldPath
-	cOldName := filepath.Base(cOldPath)
-	if nametransform.IsLongContent(cOldName) {
-		oldDirFd, err = os.Open(filepath.Dir(cOldPath))
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer oldDirFd.Close()
-		finalOldDirFd = int(oldDirFd.Fd())
-		finalOldPath = cOldName
+	oldDirFd, err := n.acquireDirfd()
+	if err != nil {
+		return fuse.ToStatus(err)
 	}
+	defer n.releaseDirfd()
+	newDirFd, err := np.acquireDirfd()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer np.releaseDirfd()
 	// Handle long destination file name
-	var newDirFd *os.File
-	var finalNewDirFd int
-	var finalNewPath = cNewPath
-	cNewName := filepath.Base(cNewPath)
-	if nametransform.IsLongContent(cNewName) {
-		newDirFd, err = os.Open(filepath.Dir(cNewPath))
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer newDirFd.Close()
-		finalNewDirFd = int(newDirFd.Fd())
-		finalNewPath = cNewName
+	newIsLong := nametransform.IsLongContent(cNewName)
+	if newIsLong {
 		// Create destination .name file
-		err = fs.nameTransform.WriteLongName(newDirFd, cNewName, newPath)
+		err = n.fs.nameTransform.WriteLongName(newDirFd, cNewName, newName)
 		if err != nil {
 			return fuse.ToStatus(err)
 		}
 	}
 	// Actual rename
-	err = syscall.Renameat(finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
+	err = syscall.Renameat(int(oldDirFd.Fd()), cOldName, int(newDirFd.Fd()), cNewName)
 	if err == syscall.ENOTEMPTY {
 		// If an empty directory is overwritten we will always get ENOTEMPTY as
 		// the "empty" directory will still contain gocryptfs.diriv.
 		// Handle that case by removing the target directory and trying again.
 		toggledlog.Debug.Printf("Rename: Handling ENOTEMPTY")
-		if fs.Rmdir(newPath, context) == fuse.OK {
-			err = syscall.Renameat(finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
+		if np.Rmdir(newName, context) == fuse.OK {
+			err = syscall.Renameat(int(oldDirFd.Fd()), cOldName, int(newDirFd.Fd()), cNewName)
 		}
 	}
 	if err != nil {
-		if newDirFd != nil {
+		if newIsLong {
 			// Roll back .name creation
 			nametransform.DeleteLongName(newDirFd, cNewName)
 		}
 		return fuse.ToStatus(err)
 	}
-	if oldDirFd != nil {
+	// Handle long source file name
+	if nametransform.IsLongContent(cOldName) {
 		nametransform.DeleteLongName(oldDirFd, cOldName)
 	}
+	// go-fuse moves the inode in the tree when we return. Its ciphertext name
+	// changes, everything below a moved directory stays valid.
+	if child := n.Inode().GetChild(oldName); child != nil {
+		if c, ok := child.Node().(*node); ok {
+			c.setName(np, newName, cNewName)
+		}
+	}
+	// The moved directory and everything below it may be in the DirIV cache
+	// under the old path, and the new path may have belonged to a directory
+	// that has been replaced
+	n.clearDirIVCache(oldName)
+	np.clearDirIVCache(newName)
 	return fuse.OK
 }
 
-func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
-		return fuse.EPERM
+func (n *node) Link(name string, existing nodefs.Node, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return nil, fuse.EROFS
+	}
+	if n.isFiltered(name) {
+		return nil, fuse.EPERM
+	}
+	target, ok := existing.(*node)
+	if !ok {
+		return nil, fuse.EXDEV
 	}
-	cOldPath, err := fs.getBackingPath(oldPath)
+	if target.isDir {
+		return nil, fuse.EPERM
+	}
+	cNewName, err := n.encryptChildName(name)
 	if err != nil {
-		return fuse.ToStatus(err)
+		return nil, fuse.ToStatus(err)
 	}
-	cNewPath, err := fs.getBackingPath(newPath)
+	oldDirFd, cOldName, release, err := target.backing()
 	if err != nil {
-		return fuse.ToStatus(err)
+		return nil, fuse.ToStatus(err)
 	}
+	defer release()
+	newDirFd, err := n.acquireDirfd()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer n.releaseDirfd()
 
 	// Handle long file name
-	cNewName := filepath.Base(cNewPath)
-	if nametransform.IsLongContent(cNewName) {
-		dirfd, err := os.Open(filepath.Dir(cNewPath))
+	newIsLong := nametransform.IsLongContent(cNewName)
+	if newIsLong {
+		err = n.fs.nameTransform.WriteLongName(newDirFd, cNewName, name)
 		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer dirfd.Close()
-		err = fs.nameTransform.WriteLongName(dirfd, cNewName, newPath)
-		if err != nil {
-			return fuse.ToStatus(err)
+			return nil, fuse.ToStatus(err)
 		}
-		// TODO Use syscall.Linkat once it is available in Go (it is not in Go
-		// 1.6).
-		err = syscall.Link(cOldPath, cNewPath)
-		if err != nil {
-			nametransform.DeleteLongName(dirfd, cNewName)
-			return fuse.ToStatus(err)
+	}
+	// Without AT_SYMLINK_FOLLOW, linkat does not follow a symlink in place of
+	// the source
+	err = unix.Linkat(int(oldDirFd.Fd()), cOldName, int(newDirFd.Fd()), cNewName, 0)
+	if err != nil {
+		if newIsLong {
+			nametransform.DeleteLongName(newDirFd, cNewName)
 		}
+		return nil, fuse.ToStatus(err)
 	}
-
-	return fuse.ToStatus(os.Link(cOldPath, cNewPath))
+	// Both names share the inode
+	n.childLock.Lock()
+	n.Inode().RmChild(name)
+	n.Inode().AddChild(name, target.Inode())
+	n.childLock.Unlock()
+	return target.Inode(), fuse.OK
 }
 
-func (fs *FS) Access(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
-		return fuse.EPERM
-	}
-	cPath, err := fs.getBackingPath(path)
+func (n *node) Access(mode uint32, context *fuse.Context) (code fuse.Status) {
+	dirfd, cName, release, err := n.backing()
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	return fuse.ToStatus(syscall.Access(cPath, mode))
-}
-
-func (fs *FS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	return nil, fuse.ENOSYS
-}
-
-func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
-}
-
-func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	return nil, fuse.ENOSYS
-}
-
-func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
+	defer release()
+	return fuse.ToStatus(unix.Faccessat(int(dirfd.Fd()), cName, mode, unix.AT_SYMLINK_NOFOLLOW))
 }
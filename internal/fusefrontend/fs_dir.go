@@ -5,32 +5,41 @@ package fusefrontend
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"golang.org/x/sys/unix"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/toggledlog"
 )
 
-func (fs *FS) mkdirWithIv(cPath string, mode uint32) error {
+// mkdirWithIv - create directory "cName" in the ciphertext directory "dirfd"
+// and its gocryptfs.diriv file.
+func (fs *FS) mkdirWithIv(dirfd *os.File, cName string, mode uint32) error {
 	// Between the creation of the directory and the creation of gocryptfs.diriv
 	// the directory is inconsistent. Take the lock to prevent other readers.
 	fs.dirIVLock.Lock()
-	// The new directory may take the place of an older one that is still in the cache
-	fs.nameTransform.DirIVCache.Clear()
 	defer fs.dirIVLock.Unlock()
-	err := os.Mkdir(cPath, os.FileMode(mode))
+	err := syscall.Mkdirat(int(dirfd.Fd()), cName, mode)
 	if err != nil {
 		return err
 	}
-	// Create gocryptfs.diriv
-	err = nametransform.WriteDirIV(cPath)
+	// Create gocryptfs.diriv. The directory may have been replaced in the
+	// meantime, do not follow a symlink.
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), cName,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err == nil {
+		newDir := os.NewFile(uintptr(fdRaw), cName)
+		err = nametransform.WriteDirIVAt(newDir)
+		newDir.Close()
+	}
 	if err != nil {
-		err2 := syscall.Rmdir(cPath)
+		err2 := unix.Unlinkat(int(dirfd.Fd()), cName, unix.AT_REMOVEDIR)
 		if err2 != nil {
 			toggledlog.Warn.Printf("mkdirWithIv: rollback failed: %v", err2)
 		}
@@ -38,106 +47,120 @@ func (fs *FS) mkdirWithIv(cPath string, mode uint32) error {
 	return err
 }
 
-func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
-		return fuse.EPERM
+func (n *node) Mkdir(name string, mode uint32, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return nil, fuse.EROFS
+	}
+	if n.isFiltered(name) {
+		return nil, fuse.EPERM
 	}
-	cPath, err := fs.getBackingPath(newPath)
+	cName, err := n.encryptChildName(name)
 	if err != nil {
-		return fuse.ToStatus(err)
+		return nil, fuse.ToStatus(err)
+	}
+	dirfd, err := n.acquireDirfd()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
 	}
-	if !fs.args.DirIV {
-		return fuse.ToStatus(os.Mkdir(cPath, os.FileMode(mode)))
+	defer n.releaseDirfd()
+	if !n.fs.args.DirIV {
+		err = syscall.Mkdirat(int(dirfd.Fd()), cName, mode)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		return n.newDirChild(dirfd, name, cName)
 	}
-	// We need write and execute permissions to create gocryptfs.diriv
+	// We need read, write and execute permissions to create gocryptfs.diriv
 	origMode := mode
-	mode = mode | 0300
+	mode = mode | 0700
+
+	// The new directory may take the place of an older one that is still in
+	// the DirIV cache
+	n.clearDirIVCache(name)
 
 	// Handle long file name
-	cName := filepath.Base(cPath)
 	if nametransform.IsLongContent(cName) {
-		var dirfd *os.File
-		dirfd, err = os.Open(filepath.Dir(cPath))
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer dirfd.Close()
-
 		// Create ".name"
-		err = fs.nameTransform.WriteLongName(dirfd, cName, newPath)
+		err = n.fs.nameTransform.WriteLongName(dirfd, cName, name)
 		if err != nil {
-			return fuse.ToStatus(err)
+			return nil, fuse.ToStatus(err)
 		}
 
 		// Create directory
-		err = fs.mkdirWithIv(cPath, mode)
+		err = n.fs.mkdirWithIv(dirfd, cName, mode)
 		if err != nil {
 			nametransform.DeleteLongName(dirfd, cName)
-			return fuse.ToStatus(err)
+			return nil, fuse.ToStatus(err)
 		}
 	} else {
-		err = fs.mkdirWithIv(cPath, mode)
+		err = n.fs.mkdirWithIv(dirfd, cName, mode)
 		if err != nil {
-			return fuse.ToStatus(err)
+			return nil, fuse.ToStatus(err)
 		}
 	}
 
 	// Set permissions back to what the user wanted
 	if origMode != mode {
-		err = os.Chmod(cPath, os.FileMode(origMode))
+		err = syscallcompat.FchmodatNofollow(int(dirfd.Fd()), cName, origMode)
 		if err != nil {
 			toggledlog.Warn.Printf("Mkdir: Chmod failed: %v", err)
 		}
 	}
 
-	return fuse.OK
+	return n.newDirChild(dirfd, name, cName)
 }
 
-func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
-	cPath, err := fs.getBackingPath(path)
+// newDirChild - add the node for the directory "cName" that has just been
+// created in our ciphertext directory "dirfd" as "name"
+func (n *node) newDirChild(dirfd *os.File, name string, cName string) (*nodefs.Inode, fuse.Status) {
+	c, err := n.fs.openChildDir(dirfd, cName)
 	if err != nil {
-		return fuse.ToStatus(err)
-	}
-	if !fs.args.DirIV {
-		return fuse.ToStatus(syscall.Rmdir(cPath))
+		return nil, fuse.ToStatus(err)
 	}
+	c.setName(n, name, cName)
+	return n.addChild(name, c), fuse.OK
+}
 
-	parentDir := filepath.Dir(cPath)
-	parentDirFd, err := os.Open(parentDir)
+func (n *node) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	cName, err := n.encryptChildName(name)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	defer parentDirFd.Close()
+	parentDirFd, err := n.acquireDirfd()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer n.releaseDirfd()
+	if !n.fs.args.DirIV {
+		return fuse.ToStatus(unix.Unlinkat(int(parentDirFd.Fd()), cName, unix.AT_REMOVEDIR))
+	}
 
-	cName := filepath.Base(cPath)
-	dirfdRaw, err := syscall.Openat(int(parentDirFd.Fd()), cName,
-		syscall.O_RDONLY, 0)
+	openFlags := syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW
+	dirfdRaw, err := syscall.Openat(int(parentDirFd.Fd()), cName, openFlags, 0)
 	if err == syscall.EACCES {
 		// We need permission to read and modify the directory
 		toggledlog.Debug.Printf("Rmdir: handling EACCESS")
-		// TODO use syscall.Fstatat once it is available in Go
-		var fi os.FileInfo
-		fi, err = os.Lstat(cPath)
+		var st syscall.Stat_t
+		err = syscallcompat.Fstatat(int(parentDirFd.Fd()), cName, &st, unix.AT_SYMLINK_NOFOLLOW)
 		if err != nil {
 			toggledlog.Debug.Printf("Rmdir: Stat: %v", err)
 			return fuse.ToStatus(err)
 		}
-		origMode := fi.Mode()
-		// TODO use syscall.Chmodat once it is available in Go
-		err = os.Chmod(cPath, origMode|0700)
+		origMode := uint32(st.Mode & 07777)
+		err = syscallcompat.FchmodatNofollow(int(parentDirFd.Fd()), cName, origMode|0700)
 		if err != nil {
 			toggledlog.Debug.Printf("Rmdir: Chmod failed: %v", err)
 			return fuse.ToStatus(err)
 		}
 		// Retry open
-		var st syscall.Stat_t
-		syscall.Lstat(cPath, &st)
-		dirfdRaw, err = syscall.Openat(int(parentDirFd.Fd()), cName,
-			syscall.O_RDONLY, 0)
+		dirfdRaw, err = syscall.Openat(int(parentDirFd.Fd()), cName, openFlags, 0)
 		// Undo the chmod if removing the directory failed
 		defer func() {
 			if code != fuse.OK {
-				err := os.Chmod(cPath, origMode)
+				err := syscallcompat.FchmodatNofollow(int(parentDirFd.Fd()), cName, origMode)
 				if err != nil {
 					toggledlog.Warn.Printf("Rmdir: Chmod rollback failed: %v", err)
 				}
@@ -167,8 +190,8 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 	toggledlog.Debug.Printf("Rmdir: Renaming %s to %s", nametransform.DirIVFilename, tmpName)
 	// The directory is in an inconsistent state between rename and rmdir.
 	// Protect against concurrent readers.
-	fs.dirIVLock.Lock()
-	defer fs.dirIVLock.Unlock()
+	n.fs.dirIVLock.Lock()
+	defer n.fs.dirIVLock.Unlock()
 	err = syscall.Renameat(int(dirfd.Fd()), nametransform.DirIVFilename,
 		int(parentDirFd.Fd()), tmpName)
 	if err != nil {
@@ -177,15 +200,13 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 		return fuse.ToStatus(err)
 	}
 	// Actual Rmdir
-	// TODO Use syscall.Unlinkat with the AT_REMOVEDIR flag once it is available
-	// in Go
-	err = syscall.Rmdir(cPath)
+	err = unix.Unlinkat(int(parentDirFd.Fd()), cName, unix.AT_REMOVEDIR)
 	if err != nil {
 		// This can happen if another file in the directory was created in the
 		// meantime, undo the rename
 		err2 := syscall.Renameat(int(parentDirFd.Fd()), tmpName,
 			int(dirfd.Fd()), nametransform.DirIVFilename)
-		if err != nil {
+		if err2 != nil {
 			toggledlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
 		}
 		return fuse.ToStatus(err)
@@ -200,31 +221,33 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 		nametransform.DeleteLongName(parentDirFd, cName)
 	}
 	// The now-deleted directory may have been in the DirIV cache. Clear it.
-	fs.nameTransform.DirIVCache.Clear()
+	n.clearDirIVCache(name)
 	return fuse.OK
 }
 
-func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
-	toggledlog.Debug.Printf("OpenDir(%s)", dirName)
-	cDirName, err := fs.encryptPath(dirName)
+func (n *node) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	dirfd, err := n.acquireDirfd()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer n.releaseDirfd()
+	toggledlog.Debug.Printf("OpenDir(%s)", dirfd.Name())
+	// The node only holds a path handle, open the directory again for reading
+	fd, err := syscall.Openat(int(dirfd.Fd()), ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	// Read ciphertext directory
-	cipherEntries, status := fs.FileSystem.OpenDir(cDirName, context)
-	if cipherEntries == nil {
+	cDir := os.NewFile(uintptr(fd), dirfd.Name())
+	defer cDir.Close()
+	cipherEntries, status := n.fs.readDirEntries(cDir)
+	if !status.Ok() {
 		return nil, status
 	}
-	// Get DirIV (stays nil if DirIV if off)
+	// The DirIV was read when the node was created and is used for all name
+	// decryptions. It is nil if DirIV is off.
 	var cachedIV []byte
-	var cDirAbsPath string
-	if fs.args.DirIV {
-		// Read the DirIV once and use it for all later name decryptions
-		cDirAbsPath = filepath.Join(fs.args.Cipherdir, cDirName)
-		cachedIV, err = nametransform.ReadDirIV(cDirAbsPath)
-		if err != nil {
-			return nil, fuse.ToStatus(err)
-		}
+	if n.fs.args.DirIV {
+		cachedIV = n.dirIV
 	}
 
 	// Decrypted directory entries
@@ -233,30 +256,30 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if dirName == "" && cName == configfile.ConfDefaultName {
+		if n == n.fs.root && cName == configfile.ConfDefaultName {
 			// silently ignore "gocryptfs.conf" in the top level dir
 			continue
 		}
-		if fs.args.DirIV && cName == nametransform.DirIVFilename {
+		if n.fs.args.DirIV && cName == nametransform.DirIVFilename {
 			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
 			continue
 		}
 
-		if fs.args.PlaintextNames {
+		if n.fs.args.PlaintextNames {
 			plain = append(plain, cipherEntries[i])
 			continue
 		}
 
 		// Handle long file name
 		isLong := nametransform.LongNameNone
-		if fs.args.LongNames {
+		if n.fs.args.LongNames {
 			isLong = nametransform.NameType(cName)
 		}
 		if isLong == nametransform.LongNameContent {
-			cNameLong, err := nametransform.ReadLongName(filepath.Join(cDirAbsPath, cName))
+			cNameLong, err := nametransform.ReadLongNameAt(cDir, cName)
 			if err != nil {
 				toggledlog.Warn.Printf("Skipping file %q in dir %q: Could not read .name: %v",
-					cName, cDirName, err)
+					cName, cDir.Name(), err)
 				errorCount++
 				continue
 			}
@@ -266,10 +289,10 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 			continue
 		}
 
-		name, err := fs.nameTransform.DecryptName(cName, cachedIV)
+		name, err := n.fs.nameTransform.DecryptName(cName, cachedIV)
 		if err != nil {
 			toggledlog.Warn.Printf("Skipping invalid name %q in dir %q: %s",
-				cName, cDirName, err)
+				cName, cDir.Name(), err)
 			errorCount++
 			continue
 		}
@@ -282,9 +305,31 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 		// Don't let the user stare on an empty directory. Report that things went
 		// wrong.
 		toggledlog.Warn.Printf("All %d entries in directory %q were invalid, returning EIO",
-			errorCount, cDirName)
+			errorCount, cDir.Name())
 		status = fuse.EIO
 	}
 
 	return plain, status
 }
+
+// readDirEntries - list the ciphertext directory "dirfd". The file type of
+// every entry is determined with fstatat relative to "dirfd", never through
+// a path.
+func (fs *FS) readDirEntries(dirfd *os.File) ([]fuse.DirEntry, fuse.Status) {
+	names, err := dirfd.Readdirnames(-1)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		var st syscall.Stat_t
+		err = syscallcompat.Fstatat(int(dirfd.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			// The entry has been deleted in the meantime
+			toggledlog.Debug.Printf("readDirEntries: skipping %q: %v", name, err)
+			continue
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: uint32(st.Mode)})
+	}
+	return entries, fuse.OK
+}
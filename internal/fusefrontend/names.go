@@ -3,21 +3,22 @@ package fusefrontend
 // This file forwards file encryption operations to cryptfs
 
 import (
-	"path/filepath"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/toggledlog"
 )
 
-// isFiltered - check if plaintext "path" should be forbidden
+// isFiltered - check if the child "name" of directory node "n" should be
+// forbidden
 //
 // Prevents name clashes with internal files when file names are not encrypted
-func (fs *FS) isFiltered(path string) bool {
-	if !fs.args.PlaintextNames {
+func (n *node) isFiltered(name string) bool {
+	if !n.fs.args.PlaintextNames {
 		return false
 	}
 	// gocryptfs.conf in the root directory is forbidden
-	if path == configfile.ConfDefaultName {
+	if n == n.fs.root && name == configfile.ConfDefaultName {
 		toggledlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
 			configfile.ConfDefaultName)
 		return true
@@ -27,16 +28,16 @@ func (fs *FS) isFiltered(path string) bool {
 	return false
 }
 
-// GetBackingPath - get the absolute encrypted path of the backing file
-// from the relative plaintext path "relPath"
-func (fs *FS) getBackingPath(relPath string) (string, error) {
-	cPath, err := fs.encryptPath(relPath)
-	if err != nil {
-		return "", err
+// encryptChildName - get the name of the backing file of child "name" in the
+// ciphertext directory of "n". Long names are hashed.
+func (n *node) encryptChildName(name string) (string, error) {
+	if n.fs.args.PlaintextNames {
+		return name, nil
 	}
-	cAbsPath := filepath.Join(fs.args.Cipherdir, cPath)
-	toggledlog.Debug.Printf("getBackingPath: %s + %s -> %s", fs.args.Cipherdir, relPath, cAbsPath)
-	return cAbsPath, nil
+	if len(name) > syscall.NAME_MAX {
+		return "", syscall.ENAMETOOLONG
+	}
+	return n.fs.nameTransform.EncryptAndHashName(name, n.dirIV), nil
 }
 
 // encryptPath - encrypt relative plaintext path
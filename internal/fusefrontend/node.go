@@ -0,0 +1,304 @@
+package fusefrontend
+
+// The inode tree
+//
+// Every file and directory the kernel knows about is a node in go-fuse's
+// inode tree. A directory node keeps its ciphertext directory open and knows
+// its DirIV, so the backing file of a node is found through its parent
+// directory without encrypting and walking the full path. Renames only change
+// the links in the tree, open directories stay valid.
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+type node struct {
+	// defaultNode, see go-fuse/fuse/nodefs/defaultnode.go
+	nodefs.Node
+	fs *FS
+	// Inode number of the backing file
+	ino uint64
+
+	// nameLock protects the cached ciphertext name
+	nameLock sync.Mutex
+	// Parent directory node and plaintext name that "cName" belongs to. The
+	// name is encrypted again if the node shows up under a different parent
+	// or name (rename, hard link).
+	cParent   *node
+	plainName string
+	cName     string
+
+	// The remaining fields are only used by directory nodes
+	isDir bool
+	// Ciphertext directory, opened relative to the parent directory without
+	// following symlinks. nil after the directory has been forgotten.
+	dirfd *os.File
+	// dirfdLock protects "dirfd" and the fields below. The dirfd is only
+	// closed when the node has been forgotten and no operation uses it.
+	dirfdLock  sync.Mutex
+	dirfdUsers int
+	forgotten  bool
+	// DirIV of the directory. All-zero without DirIV, nil with plaintext names.
+	dirIV []byte
+	// childLock prevents two concurrent lookups from adding two different
+	// nodes for the same name
+	childLock sync.Mutex
+}
+
+// newFileNode - create the node for a file, symlink or device with inode
+// number "ino"
+func (fs *FS) newFileNode(ino uint64) *node {
+	return &node{Node: nodefs.NewDefaultNode(), fs: fs, ino: ino}
+}
+
+// newDirNode - create the node for the directory that is open as "dirfd" and
+// read its DirIV. On success, the node owns the dirfd.
+func (fs *FS) newDirNode(dirfd *os.File) (*node, error) {
+	var st syscall.Stat_t
+	err := syscall.Fstat(int(dirfd.Fd()), &st)
+	if err != nil {
+		return nil, err
+	}
+	n := &node{
+		Node:  nodefs.NewDefaultNode(),
+		fs:    fs,
+		ino:   st.Ino,
+		isDir: true,
+		dirfd: dirfd,
+	}
+	if fs.args.DirIV {
+		fs.dirIVLock.RLock()
+		n.dirIV, err = nametransform.ReadDirIVAt(dirfd)
+		fs.dirIVLock.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+	} else if !fs.args.PlaintextNames {
+		n.dirIV = make([]byte, nametransform.DirIVLen)
+	}
+	return n, nil
+}
+
+// Root - open CIPHERDIR and return the root node of the plaintext view
+func (fs *FS) Root() (nodefs.Node, error) {
+	fd, err := syscallcompat.OpenDirNofollow(fs.args.Cipherdir, ".")
+	if err != nil {
+		return nil, err
+	}
+	dirfd := os.NewFile(uintptr(fd), fs.args.Cipherdir)
+	root, err := fs.newDirNode(dirfd)
+	if err != nil {
+		dirfd.Close()
+		return nil, err
+	}
+	fs.root = root
+	return root, nil
+}
+
+// openChildDir - open the ciphertext directory "cName" in directory "dirfd"
+// and create its node
+func (fs *FS) openChildDir(dirfd *os.File, cName string) (*node, error) {
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), cName,
+		syscallcompat.O_PATH|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	childfd := os.NewFile(uintptr(fdRaw), cName)
+	child, err := fs.newDirNode(childfd)
+	if err != nil {
+		childfd.Close()
+		return nil, err
+	}
+	return child, nil
+}
+
+// acquireDirfd - get the ciphertext directory of directory node "n" for the
+// duration of an operation. Every successful call must be paired with a call
+// to releaseDirfd.
+func (n *node) acquireDirfd() (*os.File, error) {
+	n.dirfdLock.Lock()
+	defer n.dirfdLock.Unlock()
+	if n.dirfd == nil {
+		return nil, syscall.ENOENT
+	}
+	n.dirfdUsers++
+	return n.dirfd, nil
+}
+
+// releaseDirfd - counterpart of acquireDirfd
+func (n *node) releaseDirfd() {
+	n.dirfdLock.Lock()
+	defer n.dirfdLock.Unlock()
+	n.dirfdUsers--
+	if n.dirfdUsers == 0 && n.forgotten {
+		n.closeDirfd()
+	}
+}
+
+// closeDirfd - close the directory handle. The caller must hold dirfdLock.
+func (n *node) closeDirfd() {
+	if n.dirfd != nil {
+		n.dirfd.Close()
+		n.dirfd = nil
+	}
+}
+
+// OnForget - called by go-fuse when the kernel has dropped the inode. This
+// happens with the tree lock held, so we must not block on operations that
+// still use the dirfd. The last one closes it.
+func (n *node) OnForget() {
+	if !n.isDir {
+		return
+	}
+	n.dirfdLock.Lock()
+	defer n.dirfdLock.Unlock()
+	n.forgotten = true
+	if n.dirfdUsers == 0 {
+		n.closeDirfd()
+	}
+}
+
+// backing - get the ciphertext directory and the name of the backing file
+// of "n". Directories are addressed as "." in their own dirfd, everything
+// else through the parent directory. On success, the caller must call
+// "release" when done.
+func (n *node) backing() (dirfd *os.File, cName string, release func(), err error) {
+	if n.isDir {
+		dirfd, err = n.acquireDirfd()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return dirfd, ".", n.releaseDirfd, nil
+	}
+	parentInode, name := n.Inode().Parent()
+	if parentInode == nil {
+		// Deleted
+		return nil, "", nil, syscall.ENOENT
+	}
+	parent := parentInode.Node().(*node)
+	cName, err = n.cachedName(parent, name)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	dirfd, err = parent.acquireDirfd()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return dirfd, cName, parent.releaseDirfd, nil
+}
+
+// cachedName - get the encrypted name of "n" as the child "name" of directory
+// node "parent"
+func (n *node) cachedName(parent *node, name string) (string, error) {
+	n.nameLock.Lock()
+	defer n.nameLock.Unlock()
+	if n.cParent == parent && n.plainName == name {
+		return n.cName, nil
+	}
+	cName, err := parent.encryptChildName(name)
+	if err != nil {
+		return "", err
+	}
+	n.cParent, n.plainName, n.cName = parent, name, cName
+	return cName, nil
+}
+
+// setName - store the encrypted name of "n" as the child "name" of directory
+// node "parent"
+func (n *node) setName(parent *node, name string, cName string) {
+	n.nameLock.Lock()
+	n.cParent, n.plainName, n.cName = parent, name, cName
+	n.nameLock.Unlock()
+}
+
+// plainPath - get the plaintext path of "n" relative to the root. Only the
+// path-based DirIV cache of the control socket needs this.
+func (n *node) plainPath() string {
+	var names []string
+	for inode := n.Inode(); inode != nil; {
+		var name string
+		inode, name = inode.Parent()
+		if inode != nil {
+			names = append([]string{name}, names...)
+		}
+	}
+	return filepath.Join(names...)
+}
+
+// childPath - get the plaintext path of child "name" of directory node "n"
+func (n *node) childPath(name string) string {
+	return filepath.Join(n.plainPath(), name)
+}
+
+// clearDirIVCache - drop the child directory "name" of "n" and everything
+// below it from the DirIV cache. Only the control socket uses the cache, so
+// there is nothing to do without one.
+func (n *node) clearDirIVCache(name string) {
+	if !n.fs.args.CtlSock {
+		return
+	}
+	n.fs.nameTransform.DirIVCache.ClearSubtree(n.childPath(name))
+}
+
+// addChild - add the freshly created "child" to the tree as "name". An older
+// inode with the same name is replaced, the backing file is gone.
+func (n *node) addChild(name string, child *node) *nodefs.Inode {
+	n.childLock.Lock()
+	defer n.childLock.Unlock()
+	n.Inode().RmChild(name)
+	return n.Inode().NewChild(name, child.isDir, child)
+}
+
+// Lookup - FUSE call. Find the child "name" of directory node "n".
+func (n *node) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	if n.isFiltered(name) {
+		return nil, fuse.EPERM
+	}
+	cName, err := n.encryptChildName(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	dirfd, err := n.acquireDirfd()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer n.releaseDirfd()
+	a, status := n.fs.getAttr(dirfd, cName)
+	if !status.Ok() {
+		return nil, status
+	}
+	*out = *a
+
+	n.childLock.Lock()
+	defer n.childLock.Unlock()
+	if existing := n.Inode().GetChild(name); existing != nil {
+		// Reuse the node unless the backing file has been replaced behind
+		// our back
+		if c, ok := existing.Node().(*node); ok && c.ino == a.Ino && c.isDir == a.IsDir() {
+			return existing, fuse.OK
+		}
+		n.Inode().RmChild(name)
+	}
+	var child *node
+	if a.IsDir() {
+		child, err = n.fs.openChildDir(dirfd, cName)
+		if err != nil {
+			toggledlog.Debug.Printf("Lookup: opening dir %q: %v", cName, err)
+			return nil, fuse.ToStatus(err)
+		}
+	} else {
+		child = n.fs.newFileNode(a.Ino)
+	}
+	child.setName(n, name, cName)
+	return n.Inode().NewChild(name, child.isDir, child), fuse.OK
+}
@@ -1,7 +1,10 @@
 package fusefrontend
 
 import (
+	"os"
 	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/merkletree"
 )
 
 func init() {
@@ -31,6 +34,21 @@ type refCntMutex struct {
 	sync.Mutex
 	// Reference count
 	refCnt int
+	// Cached hash tree of the file contents, integrity mode only. Protected
+	// by the mutex.
+	tree *merkletree.Tree
+	// Backing fds that carry the fcntl locks of each lock owner, see
+	// file_lock.go. Protected by the wlockMap mutex.
+	lockFds map[uint64]*lockFd
+}
+
+// lockFd - backing fd that carries the fcntl locks of one lock owner
+type lockFd struct {
+	fd *os.File
+	// Number of lock requests that are using the fd
+	users int
+	// File handles the owner has used
+	handles map[*file]bool
 }
 
 // register creates an entry for "ino", or incrementes the reference count
@@ -76,3 +94,78 @@ func (w *wlockMap) unlock(ino uint64) {
 	w.Unlock()
 	r.Unlock()
 }
+
+// getTree returns the cached hash tree of "ino". The caller must hold the
+// lock.
+func (w *wlockMap) getTree(ino uint64) *merkletree.Tree {
+	w.Lock()
+	defer w.Unlock()
+	return w.inodeLocks[ino].tree
+}
+
+// setTree replaces the cached hash tree of "ino". The caller must hold the
+// lock.
+func (w *wlockMap) setTree(ino uint64, t *merkletree.Tree) {
+	w.Lock()
+	defer w.Unlock()
+	w.inodeLocks[ino].tree = t
+}
+
+// getLockFd returns the fd that carries the fcntl locks of "owner" on the
+// inode of "f", opening it with "open" if the owner has none. Every call must
+// be followed by putLockFd.
+func (w *wlockMap) getLockFd(f *file, owner uint64, open func() (*os.File, error)) (*lockFd, error) {
+	w.Lock()
+	defer w.Unlock()
+	r := w.inodeLocks[f.ino]
+	l := r.lockFds[owner]
+	if l == nil {
+		fd, err := open()
+		if err != nil {
+			return nil, err
+		}
+		if r.lockFds == nil {
+			r.lockFds = make(map[uint64]*lockFd)
+		}
+		l = &lockFd{fd: fd, handles: make(map[*file]bool)}
+		r.lockFds[owner] = l
+	}
+	l.users++
+	l.handles[f] = true
+	return l, nil
+}
+
+// putLockFd releases "l", which getLockFd returned for "owner" on "ino". The
+// fd is closed once no request is using it if "unlocked" is set, because the
+// owner no longer holds any locks, or if all file handles of the owner have
+// been released while the request was waiting. The file handle does not
+// have to be valid any more.
+func (w *wlockMap) putLockFd(ino uint64, owner uint64, l *lockFd, unlocked bool) {
+	w.Lock()
+	defer w.Unlock()
+	l.users--
+	if l.users > 0 || (!unlocked && len(l.handles) > 0) {
+		return
+	}
+	l.fd.Close()
+	// The inode entry is gone if the last file handle has been released
+	if r := w.inodeLocks[ino]; r != nil && r.lockFds[owner] == l {
+		delete(r.lockFds, owner)
+	}
+}
+
+// dropLockFds is called when "f" is released. The fds of the lock owners
+// that have no other file handle left are closed, which releases their
+// locks.
+func (w *wlockMap) dropLockFds(f *file) {
+	w.Lock()
+	defer w.Unlock()
+	r := w.inodeLocks[f.ino]
+	for owner, l := range r.lockFds {
+		delete(l.handles, f)
+		if len(l.handles) == 0 && l.users == 0 {
+			l.fd.Close()
+			delete(r.lockFds, owner)
+		}
+	}
+}
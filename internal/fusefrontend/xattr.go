@@ -0,0 +1,284 @@
+package fusefrontend
+
+// Encrypted extended attributes
+//
+// A plaintext attribute "user.foo" is stored on the backing file as
+// "user.gocryptfs.<encrypted name>". The name is encrypted with EME and a
+// fixed IV so it can be looked up. The value is encrypted like a content
+// block and bound to the file and the encrypted name: the associated data is
+// a random per-file ID, stored in "user.gocryptfs.id" when the first
+// attribute is set, followed by the encrypted name. A value copied to
+// another file or attribute fails to decrypt. The plaintext starts with a
+// version byte, so that even an empty value is stored with an
+// authentication tag.
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// XattrStorePrefix - prefix of the encrypted attributes on the backing files.
+// Only the "user." namespace is writeable by normal users.
+const XattrStorePrefix = "user.gocryptfs."
+
+// XattrIDName - backing attribute that holds the per-file ID. Cannot
+// collide with encrypted names, which are at least 24 characters long.
+const XattrIDName = XattrStorePrefix + "id"
+
+// xattrIDLen - length of the per-file ID
+const xattrIDLen = 16
+
+// XattrNameIV - fixed IV for attribute name encryption. Attribute names must
+// be encrypted deterministically so they can be looked up.
+var XattrNameIV = []byte("xattr_name_iv_xx")
+
+// xattrMaxNameLen - the kernel limit for attribute names (XATTR_NAME_MAX)
+const xattrMaxNameLen = 255
+
+// encryptXattrName - get the backing attribute name for plaintext "attr"
+func (fs *FS) encryptXattrName(attr string) (string, fuse.Status) {
+	cAttr := XattrStorePrefix + fs.xattrNames.EncryptName(attr, XattrNameIV)
+	if len(cAttr) > xattrMaxNameLen {
+		return "", fuse.ERANGE
+	}
+	return cAttr, fuse.OK
+}
+
+// decryptXattrName - get the plaintext attribute name for backing attribute
+// "cAttr". Attributes that were not created by gocryptfs return an error.
+func (fs *FS) decryptXattrName(cAttr string) (string, error) {
+	if !strings.HasPrefix(cAttr, XattrStorePrefix) {
+		return "", syscall.EINVAL
+	}
+	return fs.xattrNames.DecryptName(cAttr[len(XattrStorePrefix):], XattrNameIV)
+}
+
+// xattrFileID - read the per-file ID of the backing file at "path". If the
+// file has no ID yet and "create" is set, a random ID is stored.
+func xattrFileID(path string, create bool) ([]byte, error) {
+	id, err := syscallcompat.Getxattr(path, XattrIDName)
+	if err == syscall.ENODATA && create {
+		id = cryptocore.RandBytes(xattrIDLen)
+		err = syscallcompat.Setxattr(path, XattrIDName, id, unix.XATTR_CREATE)
+		if err == syscall.EEXIST {
+			// Created concurrently
+			id, err = syscallcompat.Getxattr(path, XattrIDName)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(id) != xattrIDLen {
+		toggledlog.Warn.Printf("xattrFileID: %s has invalid length %d", XattrIDName, len(id))
+		return nil, syscall.EIO
+	}
+	return id, nil
+}
+
+// xattrValueVersion - first byte of every plaintext value. DecryptBlock
+// passes an empty ciphertext through unauthenticated, the version byte makes
+// sure we never store one.
+const xattrValueVersion = 1
+
+// xattrAD - get the associated data for the value of backing attribute
+// "cAttr" on the file with ID "fileID"
+func xattrAD(fileID []byte, cAttr string) []byte {
+	ad := make([]byte, 0, len(fileID)+len(cAttr))
+	ad = append(ad, fileID...)
+	return append(ad, cAttr...)
+}
+
+// XattrEncryptValue - encrypt "data" for storage in backing attribute
+// "cAttr" on the file with ID "fileID"
+func XattrEncryptValue(enc *contentenc.ContentEnc, data []byte, fileID []byte, cAttr string) []byte {
+	plain := make([]byte, 0, 1+len(data))
+	plain = append(plain, xattrValueVersion)
+	plain = append(plain, data...)
+	return enc.EncryptBlock(plain, 0, xattrAD(fileID, cAttr))
+}
+
+// XattrDecryptValue - decrypt the value "cData" of backing attribute "cAttr"
+// on the file with ID "fileID"
+func XattrDecryptValue(enc *contentenc.ContentEnc, cData []byte, fileID []byte, cAttr string) ([]byte, error) {
+	plain, err := enc.DecryptBlock(cData, 0, xattrAD(fileID, cAttr))
+	if err != nil {
+		return nil, err
+	}
+	// Empty ciphertext and file holes are not authenticated
+	if len(plain) == 0 || plain[0] != xattrValueVersion {
+		return nil, errors.New("unauthenticated value")
+	}
+	return plain[1:], nil
+}
+
+// xattrUnsupported - attributes in the "system." namespace (POSIX ACLs, ...)
+// are interpreted by the kernel and cannot be stored encrypted
+func xattrUnsupported(attr string) bool {
+	return strings.HasPrefix(attr, "system.")
+}
+
+// xattrBackingFile - get a handle to the backing file of node "n". The
+// handle is opened relative to the directory without following symlinks and
+// without needing permissions on the file. The attribute syscalls go through
+// syscallcompat.ProcFdPath so they reach exactly this file. Symlinks cannot
+// carry user attributes on Linux, so they are reported as such. The caller
+// must close the handle.
+func (n *node) xattrBackingFile() (*os.File, bool, fuse.Status) {
+	dirfd, cName, release, err := n.backing()
+	if err != nil {
+		return nil, false, fuse.ToStatus(err)
+	}
+	defer release()
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), cName, syscallcompat.O_PATH|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, false, fuse.ToStatus(err)
+	}
+	f := os.NewFile(uintptr(fdRaw), cName)
+	var st syscall.Stat_t
+	err = syscall.Fstat(fdRaw, &st)
+	if err != nil {
+		f.Close()
+		return nil, false, fuse.ToStatus(err)
+	}
+	return f, st.Mode&syscall.S_IFMT == syscall.S_IFLNK, fuse.OK
+}
+
+// GetXAttr - FUSE call
+func (n *node) GetXAttr(attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if !n.fs.args.Xattr {
+		return nil, fuse.ENOSYS
+	}
+	if xattrUnsupported(attr) {
+		return nil, fuse.ENODATA
+	}
+	cAttr, status := n.fs.encryptXattrName(attr)
+	if !status.Ok() {
+		return nil, status
+	}
+	f, isSymlink, status := n.xattrBackingFile()
+	if !status.Ok() {
+		return nil, status
+	}
+	defer f.Close()
+	if isSymlink {
+		return nil, fuse.ENODATA
+	}
+	procPath := syscallcompat.ProcFdPath(int(f.Fd()))
+	cData, err := syscallcompat.Getxattr(procPath, cAttr)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	id, err := xattrFileID(procPath, false)
+	if err != nil {
+		toggledlog.Warn.Printf("GetXAttr: could not read the file ID: %v", err)
+		return nil, fuse.EIO
+	}
+	data, err := XattrDecryptValue(n.fs.contentEnc, cData, id, cAttr)
+	if err != nil {
+		toggledlog.Warn.Printf("GetXAttr: could not decrypt value of %q: %v", attr, err)
+		return nil, fuse.EIO
+	}
+	return data, fuse.OK
+}
+
+// SetXAttr - FUSE call
+func (n *node) SetXAttr(attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	if !n.fs.args.Xattr {
+		return fuse.ENOSYS
+	}
+	if xattrUnsupported(attr) {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	cAttr, status := n.fs.encryptXattrName(attr)
+	if !status.Ok() {
+		return status
+	}
+	f, isSymlink, status := n.xattrBackingFile()
+	if !status.Ok() {
+		return status
+	}
+	defer f.Close()
+	if isSymlink {
+		return fuse.EPERM
+	}
+	procPath := syscallcompat.ProcFdPath(int(f.Fd()))
+	id, err := xattrFileID(procPath, true)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	cData := XattrEncryptValue(n.fs.contentEnc, data, id, cAttr)
+	return fuse.ToStatus(syscallcompat.Setxattr(procPath, cAttr, cData, flags))
+}
+
+// ListXAttr - FUSE call. Attributes that were not created by gocryptfs are
+// not listed.
+func (n *node) ListXAttr(context *fuse.Context) ([]string, fuse.Status) {
+	if !n.fs.args.Xattr {
+		return nil, fuse.ENOSYS
+	}
+	f, isSymlink, status := n.xattrBackingFile()
+	if !status.Ok() {
+		return nil, status
+	}
+	defer f.Close()
+	if isSymlink {
+		return nil, fuse.OK
+	}
+	buf, err := syscallcompat.Listxattr(syscallcompat.ProcFdPath(int(f.Fd())))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var attrs []string
+	for _, cAttr := range bytes.Split(buf, []byte{0}) {
+		if !bytes.HasPrefix(cAttr, []byte(XattrStorePrefix)) || string(cAttr) == XattrIDName {
+			continue
+		}
+		attr, err := n.fs.decryptXattrName(string(cAttr))
+		if err != nil {
+			toggledlog.Warn.Printf("ListXAttr: could not decrypt %q: %v", cAttr, err)
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, fuse.OK
+}
+
+// RemoveXAttr - FUSE call
+func (n *node) RemoveXAttr(attr string, context *fuse.Context) fuse.Status {
+	if n.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	if !n.fs.args.Xattr {
+		return fuse.ENOSYS
+	}
+	if xattrUnsupported(attr) {
+		return fuse.ENODATA
+	}
+	cAttr, status := n.fs.encryptXattrName(attr)
+	if !status.Ok() {
+		return status
+	}
+	f, isSymlink, status := n.xattrBackingFile()
+	if !status.Ok() {
+		return status
+	}
+	defer f.Close()
+	if isSymlink {
+		return fuse.ENODATA
+	}
+	return fuse.ToStatus(syscallcompat.Removexattr(syscallcompat.ProcFdPath(int(f.Fd())), cAttr))
+}
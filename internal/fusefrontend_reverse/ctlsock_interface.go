@@ -0,0 +1,33 @@
+package fusefrontend_reverse
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+)
+
+var _ ctlsock.Interface = &reverseFS{} // Verify that interface is implemented.
+
+// EncryptPath implements ctlsock.Interface
+func (rfs *reverseFS) EncryptPath(plainPath string) (string, error) {
+	if rfs.args.PlaintextNames || plainPath == "" {
+		return plainPath, nil
+	}
+	var cipherParts []string
+	plainParts := strings.Split(plainPath, "/")
+	for i, plainName := range plainParts {
+		if len(plainName) > syscall.NAME_MAX {
+			return "", syscall.ENAMETOOLONG
+		}
+		plainDir := filepath.Join(plainParts[:i]...)
+		cipherParts = append(cipherParts, rfs.encryptName(plainDir, plainName))
+	}
+	return filepath.Join(cipherParts...), nil
+}
+
+// DecryptPath implements ctlsock.Interface
+func (rfs *reverseFS) DecryptPath(cipherPath string) (string, error) {
+	return rfs.decryptPath(cipherPath)
+}
@@ -0,0 +1,144 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// reverseFile - an open plaintext file that is read as ciphertext
+type reverseFile struct {
+	// Embed nodefs.defaultFile for a ENOSYS implementation of all methods
+	nodefs.File
+	// Backing plaintext file
+	fd *os.File
+	// File header, derived deterministically from the plaintext path
+	header []byte
+	// File ID, part of the header
+	id []byte
+	// Back pointer for access to the crypto helpers
+	rfs *reverseFS
+}
+
+func (rfs *reverseFS) newFile(plainPath string) (nodefs.File, fuse.Status) {
+	fd, err := os.Open(rfs.abs(plainPath))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	id := rfs.derivePathIV(plainPath, ivPurposeFileID)
+	h := contentenc.FileHeader{
+		Version: contentenc.CurrentVersion,
+		Id:      id,
+	}
+	return &reverseFile{
+		File:   nodefs.NewDefaultFile(),
+		fd:     fd,
+		header: h.Pack(),
+		id:     id,
+		rfs:    rfs,
+	}, fuse.OK
+}
+
+// GetAttr - FUSE call
+// Triggered by fstat() from userspace
+func (rf *reverseFile) GetAttr(a *fuse.Attr) fuse.Status {
+	fi, err := rf.fd.Stat()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	a2 := fuse.ToAttr(fi)
+	*a = *a2
+	a.Size = rf.rfs.contentEnc.PlainSizeToCipherSize(a.Size)
+	return fuse.OK
+}
+
+// encryptBlocks - encrypt "plaintext" into a string of blocks, starting
+// at block number "firstBlockNo".
+func (rf *reverseFile) encryptBlocks(plaintext []byte, firstBlockNo uint64) []byte {
+	inBuf := bytes.NewBuffer(plaintext)
+	var outBuf bytes.Buffer
+	bs := int(rf.rfs.contentEnc.PlainBS())
+	for blockNo := firstBlockNo; inBuf.Len() > 0; blockNo++ {
+		inBlock := inBuf.Next(bs)
+		nonce := rf.rfs.deriveBlockNonce(rf.id, blockNo, inBlock)
+		outBlock := rf.rfs.contentEnc.EncryptBlockNonce(inBlock, blockNo, rf.id, nonce)
+		outBuf.Write(outBlock)
+	}
+	return outBuf.Bytes()
+}
+
+// readBackingFile - read "length" ciphertext bytes from ciphertext offset
+// "off". The ciphertext is generated on the fly from the plaintext file.
+func (rf *reverseFile) readBackingFile(off uint64, length uint64) ([]byte, error) {
+	var out []byte
+	// The first bytes of the ciphertext file are the header
+	if off < contentenc.HEADER_LEN {
+		// Empty files do not get a header
+		fi, err := rf.fd.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() == 0 {
+			return nil, nil
+		}
+		end := contentenc.MinUint64(off+length, contentenc.HEADER_LEN)
+		out = append(out, rf.header[off:end]...)
+		length -= end - off
+		off = end
+	}
+	if length == 0 {
+		return out, nil
+	}
+	blocks := rf.rfs.contentEnc.ExplodeCipherRange(off, length)
+	// Read the backing plaintext in one go
+	alignedOffset, alignedLength := blocks[0].JointPlaintextRange(blocks)
+	plaintext := make([]byte, int(alignedLength))
+	n, err := rf.fd.ReadAt(plaintext, int64(alignedOffset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		// Reading past the end of the file
+		return out, nil
+	}
+	// Truncate plaintext buffer down to actually read bytes
+	plaintext = plaintext[0:n]
+	ciphertext := rf.encryptBlocks(plaintext, blocks[0].BlockNo)
+
+	// Crop down to the relevant part
+	skip := int(blocks[0].Skip)
+	lenHave := len(ciphertext)
+	lenWant := skip + int(length)
+	if lenHave > lenWant {
+		out = append(out, ciphertext[skip:lenWant]...)
+	} else if lenHave > skip {
+		out = append(out, ciphertext[skip:lenHave]...)
+	}
+	return out, nil
+}
+
+// Read - FUSE call
+func (rf *reverseFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	out, err := rf.readBackingFile(uint64(off), uint64(len(buf)))
+	if err != nil {
+		toggledlog.Warn.Printf("reverseFile.Read: %v", err)
+		return nil, fuse.ToStatus(err)
+	}
+	return fuse.ReadResultData(out), fuse.OK
+}
+
+// Release - FUSE call, close file
+func (rf *reverseFile) Release() {
+	rf.fd.Close()
+}
+
+func (rf *reverseFile) String() string {
+	return fmt.Sprintf("reverseFile(%s)", rf.fd.Name())
+}
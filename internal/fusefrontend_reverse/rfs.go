@@ -0,0 +1,255 @@
+// Package fusefrontend_reverse implements "reverse mode": the backing
+// directory contains plaintext files and the FUSE mount presents the
+// encrypted view that fusefrontend would store on disk.
+package fusefrontend_reverse
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+type reverseFS struct {
+	// Embed pathfs.defaultFileSystem to avoid compile failure when the
+	// pathfs.FileSystem interface gets new functions. defaultFileSystem
+	// provides a no-op implementation for all functions.
+	pathfs.FileSystem
+	// Stores configuration arguments
+	args fusefrontend.Args
+	// Cryptographic primitives
+	cryptoCore *cryptocore.CryptoCore
+	// Filename encryption helper
+	nameTransform *nametransform.NameTransform
+	// Content encryption helper
+	contentEnc *contentenc.ContentEnc
+	// Key for deriveIV
+	ivKey []byte
+}
+
+// NewFS returns an encrypted FUSE overlay filesystem.
+// In this case (reverse mode) the backing directory is plain-text and
+// reverseFS provides an encrypted view.
+func NewFS(args fusefrontend.Args) pathfs.FileSystem {
+	cryptoCore := cryptocore.New(args.Masterkey, args.AEADType(), args.GCMIV128, args.HKDF)
+	// Reverse mode only supports version 2 file headers
+	contentEnc := contentenc.New(cryptoCore, args.PlainBS, false, false, false)
+	nameTransform := nametransform.New(cryptoCore, args.EMENames, args.LongNames)
+	ivKey := args.Masterkey
+	if args.HKDF {
+		ivKey = cryptocore.HkdfDerive(args.Masterkey, cryptocore.HKDFInfoReverseIV, cryptocore.KeyLen)
+	}
+
+	return &reverseFS{
+		// pathfs.defaultFileSystem returns ENOSYS for all operations
+		FileSystem:    pathfs.NewDefaultFileSystem(),
+		args:          args,
+		cryptoCore:    cryptoCore,
+		nameTransform: nameTransform,
+		contentEnc:    contentEnc,
+		ivKey:         ivKey,
+	}
+}
+
+// abs - convert relative plaintext path to absolute plaintext path
+func (rfs *reverseFS) abs(relPath string) string {
+	return filepath.Join(rfs.args.Cipherdir, relPath)
+}
+
+// isHidden - the reverse config file is stored in the plaintext root
+// directory but shows up as gocryptfs.conf in the encrypted view
+func (rfs *reverseFS) isHidden(plainPath string) bool {
+	return plainPath == configfile.ConfReverseName
+}
+
+// GetAttr - FUSE call
+func (rfs *reverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	toggledlog.Debug.Printf("reverseFS.GetAttr('%s')", relPath)
+	var absPath string
+	if rfs.isConfig(relPath) {
+		absPath = rfs.configPath()
+	} else if rfs.isVirtual(relPath) {
+		return rfs.virtualGetAttr(relPath)
+	} else {
+		plainPath, err := rfs.decryptPath(relPath)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		if rfs.isHidden(plainPath) {
+			return nil, fuse.ENOENT
+		}
+		absPath = rfs.abs(plainPath)
+	}
+	var st syscall.Stat_t
+	err := syscall.Lstat(absPath, &st)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	a := &fuse.Attr{}
+	a.FromStat(&st)
+	if rfs.isConfig(relPath) {
+		return a, fuse.OK
+	}
+	if a.IsRegular() {
+		a.Size = rfs.contentEnc.PlainSizeToCipherSize(a.Size)
+	} else if a.IsSymlink() {
+		target, status := rfs.Readlink(relPath, context)
+		if status != fuse.OK {
+			return nil, status
+		}
+		a.Size = uint64(len(target))
+	}
+	return a, fuse.OK
+}
+
+// Access - FUSE call
+func (rfs *reverseFS) Access(relPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if mode&2 != 0 {
+		// The encrypted view is read-only (2 = W_OK)
+		return fuse.EROFS
+	}
+	if rfs.isConfig(relPath) {
+		return fuse.ToStatus(syscall.Access(rfs.configPath(), mode))
+	}
+	if rfs.isVirtual(relPath) {
+		_, _, err := rfs.virtualContent(relPath)
+		return fuse.ToStatus(err)
+	}
+	plainPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fuse.ToStatus(syscall.Access(rfs.abs(plainPath), mode))
+}
+
+// Open - FUSE call
+func (rfs *reverseFS) Open(relPath string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, fuse.EROFS
+	}
+	if rfs.isConfig(relPath) {
+		return rfs.openPlain(rfs.configPath())
+	}
+	if rfs.isVirtual(relPath) {
+		return rfs.virtualOpen(relPath)
+	}
+	plainPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if rfs.isHidden(plainPath) {
+		return nil, fuse.ENOENT
+	}
+	return rfs.newFile(plainPath)
+}
+
+// openPlain - open "absPath" and pass it through without encryption
+func (rfs *reverseFS) openPlain(absPath string) (nodefs.File, fuse.Status) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return nodefs.NewReadOnlyFile(nodefs.NewLoopbackFile(f)), fuse.OK
+}
+
+// OpenDir - FUSE call
+func (rfs *reverseFS) OpenDir(relPath string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	toggledlog.Debug.Printf("reverseFS.OpenDir(%s)", relPath)
+	plainPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	fd, err := os.Open(rfs.abs(plainPath))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer fd.Close()
+	fis, err := fd.Readdir(-1)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var entries []fuse.DirEntry
+	// Encrypt names
+	for _, fi := range fis {
+		name := fi.Name()
+		if plainPath == "" && rfs.isHidden(name) {
+			continue
+		}
+		mode := uint32(fi.Mode().Perm())
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			mode = st.Mode
+		}
+		cName := rfs.encryptName(plainPath, name)
+		entries = append(entries, fuse.DirEntry{Name: cName, Mode: mode})
+		if nametransform.IsLongContent(cName) {
+			entries = append(entries, fuse.DirEntry{
+				Name: cName + nametransform.LongNameSuffix,
+				Mode: syscall.S_IFREG | 0400,
+			})
+		}
+	}
+	if !rfs.args.PlaintextNames {
+		entries = append(entries, fuse.DirEntry{
+			Name: nametransform.DirIVFilename,
+			Mode: syscall.S_IFREG | 0400,
+		})
+	}
+	if plainPath == "" {
+		if _, err := os.Stat(rfs.configPath()); err == nil {
+			entries = append(entries, fuse.DirEntry{
+				Name: configfile.ConfDefaultName,
+				Mode: syscall.S_IFREG | 0400,
+			})
+		}
+	}
+	return entries, fuse.OK
+}
+
+// Readlink - FUSE call
+func (rfs *reverseFS) Readlink(relPath string, context *fuse.Context) (string, fuse.Status) {
+	plainPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return "", fuse.ToStatus(err)
+	}
+	target, err := os.Readlink(rfs.abs(plainPath))
+	if err != nil {
+		return "", fuse.ToStatus(err)
+	}
+	if rfs.args.PlaintextNames {
+		return target, fuse.OK
+	}
+	// Symlinks are encrypted like file contents (GCM), see fusefrontend.Symlink.
+	// The nonce is derived from the path and the target so it is stable.
+	fileID := rfs.derivePathIV(plainPath, ivPurposeLink)
+	nonce := rfs.deriveBlockNonce(fileID, 0, []byte(target))
+	cBinTarget := rfs.contentEnc.EncryptBlockNonce([]byte(target), 0, nil, nonce)
+	return base64.URLEncoding.EncodeToString(cBinTarget), fuse.OK
+}
+
+// StatFs - FUSE call
+func (rfs *reverseFS) StatFs(relPath string) *fuse.StatfsOut {
+	var s syscall.Statfs_t
+	err := syscall.Statfs(rfs.args.Cipherdir, &s)
+	if err != nil {
+		return nil
+	}
+	out := &fuse.StatfsOut{}
+	out.FromStatfsT(&s)
+	return out
+}
+
+// String - used by go-fuse in debug output
+func (rfs *reverseFS) String() string {
+	return "reverseFS(" + rfs.args.Cipherdir + ")"
+}
@@ -0,0 +1,124 @@
+package fusefrontend_reverse
+
+// Translate ciphertext paths (as seen by the user) to plaintext paths (as
+// stored on disk)
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// Purpose strings for deterministic IV derivation. They make sure that the
+// IVs for different purposes never collide even if the input is the same.
+const (
+	ivPurposeDirIV  = "DIRIV"
+	ivPurposeFileID = "FILEID"
+	ivPurposeNonce  = "NONCE"
+	ivPurposeLink   = "SYMLINK"
+)
+
+// deriveIV - derive a deterministic IV of length "length" from "purpose" and
+// "data" using HMAC-SHA256 keyed with the master key, or with a subkey of it
+// if HKDF is enabled.
+// The ciphertext must be stable so that rsync & co do not see spurious changes,
+// but the IVs must still not be predictable without the key.
+func (rfs *reverseFS) deriveIV(purpose string, data []byte, length int) []byte {
+	mac := hmac.New(sha256.New, rfs.ivKey)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)[:length]
+}
+
+// derivePathIV - derive the DirIV or file ID for plaintext path "relPath"
+func (rfs *reverseFS) derivePathIV(relPath string, purpose string) []byte {
+	return rfs.deriveIV(purpose, []byte(relPath), nametransform.DirIVLen)
+}
+
+// deriveBlockNonce - derive the GCM nonce for block number "blockNo" of
+// the file with id "fileID".
+// The plaintext is part of the input so the nonce changes whenever the
+// content changes. A nonce is only ever reused for identical plaintext, which
+// yields identical ciphertext and leaks nothing new.
+func (rfs *reverseFS) deriveBlockNonce(fileID []byte, blockNo uint64, plaintext []byte) []byte {
+	data := make([]byte, 8, 8+len(fileID)+len(plaintext))
+	binary.BigEndian.PutUint64(data, blockNo)
+	data = append(data, fileID...)
+	data = append(data, plaintext...)
+	return rfs.deriveIV(ivPurposeNonce, data, rfs.cryptoCore.IVLen)
+}
+
+// encryptName - encrypt the plaintext name "plainName" that is located in
+// plaintext directory "plainDir". Long names are hashed if enabled.
+func (rfs *reverseFS) encryptName(plainDir string, plainName string) string {
+	if rfs.args.PlaintextNames {
+		return plainName
+	}
+	dirIV := rfs.derivePathIV(plainDir, ivPurposeDirIV)
+	cName := rfs.nameTransform.EncryptName(plainName, dirIV)
+	if rfs.args.LongNames && len(cName) > syscall.NAME_MAX {
+		cName = nametransform.HashLongName(cName)
+	}
+	return cName
+}
+
+// findLongnamePlain - find the plaintext name in plaintext directory
+// "plainDir" that hashes to the long name "longname".
+func (rfs *reverseFS) findLongnamePlain(plainDir string, longname string) (string, error) {
+	fd, err := os.Open(filepath.Join(rfs.args.Cipherdir, plainDir))
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	names, err := fd.Readdirnames(-1)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if rfs.encryptName(plainDir, name) == longname {
+			return name, nil
+		}
+	}
+	return "", syscall.ENOENT
+}
+
+// decryptPath - decrypt the relative ciphertext path "relPath" that the user
+// sees into the relative plaintext path that is stored on disk.
+func (rfs *reverseFS) decryptPath(relPath string) (string, error) {
+	if rfs.args.PlaintextNames || relPath == "" {
+		return relPath, nil
+	}
+	var plainParts []string
+	cipherParts := strings.Split(relPath, "/")
+	for _, cName := range cipherParts {
+		plainDir := filepath.Join(plainParts...)
+		var plainName string
+		var err error
+		if rfs.args.LongNames && nametransform.IsLongContent(cName) {
+			plainName, err = rfs.findLongnamePlain(plainDir, cName)
+		} else {
+			dirIV := rfs.derivePathIV(plainDir, ivPurposeDirIV)
+			plainName, err = rfs.nameTransform.DecryptName(cName, dirIV)
+		}
+		if err != nil {
+			// Names that do not decrypt cannot exist
+			toggledlog.Debug.Printf("decryptPath: %q: %v", cName, err)
+			return "", syscall.ENOENT
+		}
+		// A forged name could decrypt to something that escapes the directory
+		if plainName == "." || plainName == ".." || strings.Contains(plainName, "/") {
+			toggledlog.Debug.Printf("decryptPath: %q decrypts to an invalid name", cName)
+			return "", syscall.ENOENT
+		}
+		plainParts = append(plainParts, plainName)
+	}
+	return filepath.Join(plainParts...), nil
+}
@@ -0,0 +1,100 @@
+package fusefrontend_reverse
+
+// Virtual files that only exist in the encrypted view: gocryptfs.diriv,
+// gocryptfs.longname.*.name and gocryptfs.conf
+
+import (
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// isVirtual - is the ciphertext path "relPath" a file that only exists in
+// the encrypted view?
+func (rfs *reverseFS) isVirtual(relPath string) bool {
+	if rfs.args.PlaintextNames {
+		return false
+	}
+	cName := filepath.Base(relPath)
+	if cName == nametransform.DirIVFilename {
+		return true
+	}
+	if rfs.args.LongNames && nametransform.NameType(cName) == nametransform.LongNameFilename {
+		return true
+	}
+	return false
+}
+
+// virtualContent - get the content of the virtual file at ciphertext path
+// "relPath". Also returns the plaintext path of the directory the file is in.
+func (rfs *reverseFS) virtualContent(relPath string) (content []byte, plainDir string, err error) {
+	cDir := filepath.Dir(relPath)
+	if cDir == "." {
+		cDir = ""
+	}
+	plainDir, err = rfs.decryptPath(cDir)
+	if err != nil {
+		return nil, "", err
+	}
+	cName := filepath.Base(relPath)
+	if cName == nametransform.DirIVFilename {
+		return rfs.derivePathIV(plainDir, ivPurposeDirIV), plainDir, nil
+	}
+	// gocryptfs.longname.[sha256].name contains the full encrypted name
+	longname := cName[:len(cName)-len(nametransform.LongNameSuffix)]
+	plainName, err := rfs.findLongnamePlain(plainDir, longname)
+	if err != nil {
+		return nil, "", err
+	}
+	dirIV := rfs.derivePathIV(plainDir, ivPurposeDirIV)
+	return []byte(rfs.nameTransform.EncryptName(plainName, dirIV)), plainDir, nil
+}
+
+// virtualGetAttr - GetAttr for virtual files. Ownership and timestamps
+// are inherited from the plaintext directory the file is in.
+func (rfs *reverseFS) virtualGetAttr(relPath string) (*fuse.Attr, fuse.Status) {
+	content, plainDir, err := rfs.virtualContent(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var st syscall.Stat_t
+	err = syscall.Lstat(filepath.Join(rfs.args.Cipherdir, plainDir), &st)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	a := &fuse.Attr{}
+	a.FromStat(&st)
+	a.Mode = syscall.S_IFREG | 0400
+	a.Nlink = 1
+	a.Size = uint64(len(content))
+	a.Blocks = (a.Size + 511) / 512
+	return a, fuse.OK
+}
+
+// virtualOpen - Open for virtual files
+func (rfs *reverseFS) virtualOpen(relPath string) (nodefs.File, fuse.Status) {
+	content, _, err := rfs.virtualContent(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return nodefs.NewDataFile(content), fuse.OK
+}
+
+// isConfig - is "relPath" the gocryptfs.conf in the root directory of the
+// encrypted view? It is backed by the hidden reverse config file so the
+// encrypted view can be mounted in forward mode.
+func (rfs *reverseFS) isConfig(relPath string) bool {
+	return relPath == configfile.ConfDefaultName
+}
+
+// configPath - absolute path to the backing reverse config file. This is
+// ".gocryptfs.reverse.conf" in the plaintext root directory unless "-config"
+// was passed.
+func (rfs *reverseFS) configPath() string {
+	return rfs.args.ConfigPath
+}
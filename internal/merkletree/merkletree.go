@@ -0,0 +1,148 @@
+// Package merkletree implements a binary hash tree over the ciphertext blocks
+// of a file. The root authenticates every block together with its position
+// and the number of blocks, so replacing a block with an older version of
+// itself, swapping blocks or cutting off blocks changes the root.
+//
+// Leaves and inner nodes are hashed with different prefixes (like RFC 6962)
+// so a leaf can never be mistaken for an inner node. A node without a right
+// sibling is moved up to the next level unchanged.
+package merkletree
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const (
+	// HashLen - length of the leaves and of the root
+	HashLen = sha256.Size
+
+	leafPrefix = 0
+	nodePrefix = 1
+)
+
+// Leaf - hash of ciphertext block "block" at block number "blockNo"
+func Leaf(blockNo uint64, block []byte) []byte {
+	h := sha256.New()
+	var prefix [9]byte
+	prefix[0] = leafPrefix
+	binary.BigEndian.PutUint64(prefix[1:], blockNo)
+	h.Write(prefix[:])
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// node - hash of the inner node with children "left" and "right"
+func node(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Tree - hash tree that is updated incrementally. The zero value is an empty
+// tree. Not safe for concurrent use.
+type Tree struct {
+	// levels[0] are the leaves, the last level holds the root
+	levels [][][]byte
+}
+
+// New - create a tree over "leaves"
+func New(leaves [][]byte) *Tree {
+	t := &Tree{}
+	for i, l := range leaves {
+		t.Set(uint64(i), l)
+	}
+	return t
+}
+
+// Len - number of leaves
+func (t *Tree) Len() uint64 {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return uint64(len(t.levels[0]))
+}
+
+// Leaf - get leaf "i"
+func (t *Tree) Leaf(i uint64) []byte {
+	return t.levels[0][i]
+}
+
+// Root - get the root hash. The root of the empty tree is the hash of the
+// empty string.
+func (t *Tree) Root() []byte {
+	if t.Len() == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Set - set leaf "i" to "leaf". "i" may be at most Len(), which appends a
+// leaf.
+func (t *Tree) Set(i uint64, leaf []byte) {
+	n := t.Len()
+	if i > n {
+		panic("merkletree: Set would leave a gap")
+	}
+	if i == n {
+		n++
+	}
+	t.resize(n)
+	t.levels[0][i] = leaf
+	t.updatePath(i)
+}
+
+// Truncate - drop all leaves starting at "n"
+func (t *Tree) Truncate(n uint64) {
+	if n >= t.Len() {
+		return
+	}
+	t.resize(n)
+	if n > 0 {
+		// The last node of every level may have lost its right sibling
+		t.updatePath(n - 1)
+	}
+}
+
+// resize - set the number of leaves to "n" and adjust the upper levels.
+// New leaves are nil and must be set by the caller.
+func (t *Tree) resize(n uint64) {
+	if n == 0 {
+		t.levels = nil
+		return
+	}
+	level := 0
+	for {
+		if level == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		nodes := t.levels[level]
+		for uint64(len(nodes)) < n {
+			nodes = append(nodes, nil)
+		}
+		t.levels[level] = nodes[:n]
+		if n == 1 {
+			t.levels = t.levels[:level+1]
+			return
+		}
+		n = (n + 1) / 2
+		level++
+	}
+}
+
+// updatePath - recompute the inner nodes above leaf "i"
+func (t *Tree) updatePath(i uint64) {
+	for level := 1; level < len(t.levels); level++ {
+		below := t.levels[level-1]
+		left := i &^ 1
+		i /= 2
+		if left+1 < uint64(len(below)) {
+			t.levels[level][i] = node(below[left], below[left+1])
+		} else {
+			t.levels[level][i] = below[left]
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package merkletree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// rootSlow - compute the root from scratch
+func rootSlow(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return (&Tree{}).Root()
+	}
+	for len(leaves) > 1 {
+		var next [][]byte
+		for i := 0; i < len(leaves); i += 2 {
+			if i+1 < len(leaves) {
+				next = append(next, node(leaves[i], leaves[i+1]))
+			} else {
+				next = append(next, leaves[i])
+			}
+		}
+		leaves = next
+	}
+	return leaves[0]
+}
+
+// Incremental updates must give the same root as a full recomputation
+func TestIncremental(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var tree Tree
+	var leaves [][]byte
+	for i := 0; i < 2000; i++ {
+		switch r.Intn(4) {
+		case 0, 1:
+			// Append
+			l := Leaf(uint64(len(leaves)), []byte{byte(i)})
+			tree.Set(uint64(len(leaves)), l)
+			leaves = append(leaves, l)
+		case 2:
+			// Overwrite
+			if len(leaves) > 0 {
+				j := r.Intn(len(leaves))
+				l := Leaf(uint64(j), []byte{byte(i)})
+				tree.Set(uint64(j), l)
+				leaves[j] = l
+			}
+		case 3:
+			// Truncate
+			if len(leaves) > 0 {
+				n := r.Intn(len(leaves))
+				tree.Truncate(uint64(n))
+				leaves = leaves[:n]
+			}
+		}
+		if tree.Len() != uint64(len(leaves)) {
+			t.Fatalf("step %d: wrong length %d, want %d", i, tree.Len(), len(leaves))
+		}
+		if !bytes.Equal(tree.Root(), rootSlow(leaves)) {
+			t.Fatalf("step %d: wrong root for %d leaves", i, len(leaves))
+		}
+	}
+	if !bytes.Equal(New(leaves).Root(), tree.Root()) {
+		t.Error("New() gives a different root")
+	}
+}
+
+// Swapping two blocks or replacing one must change the root
+func TestTamper(t *testing.T) {
+	blocks := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	var leaves [][]byte
+	for i, b := range blocks {
+		leaves = append(leaves, Leaf(uint64(i), b))
+	}
+	root := New(leaves).Root()
+	swapped := [][]byte{Leaf(0, blocks[1]), Leaf(1, blocks[0]), leaves[2]}
+	if bytes.Equal(New(swapped).Root(), root) {
+		t.Error("swapped blocks were not detected")
+	}
+	if bytes.Equal(New(leaves[:2]).Root(), root) {
+		t.Error("truncation was not detected")
+	}
+	// A block that contains an inner node must not hash to that node
+	inner := node(leaves[0], leaves[1])
+	if bytes.Equal(New([][]byte{Leaf(0, inner), leaves[2]}).Root(), root) {
+		t.Error("inner node accepted as a block")
+	}
+}
@@ -1,43 +1,138 @@
 package nametransform
 
-import "sync"
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
 
-// A simple one-entry DirIV cache
-type dirIVCache struct {
-	// Invalidated?
-	cleared bool
+// Maximum number of directories in the DirIV cache
+const dirIVCacheSize = 100
+
+// dirIVCacheEntry - cached DirIV of one directory
+type dirIVCacheEntry struct {
+	// Plaintext directory, relative to the root
+	dir string
 	// The DirIV
 	iv []byte
-	// Directory the DirIV belongs to
-	dir string
 	// Ecrypted version of "dir"
 	translatedDir string
+}
+
+// A DirIV cache that holds the dirIVCacheSize least recently used directories.
+// It speeds up the translation of whole paths, which is what the control
+// socket needs. The forward FUSE frontend keeps the DirIV in its directory
+// nodes instead.
+type dirIVCache struct {
+	// Entries ordered by last use, most recent first
+	lru *list.List
+	// Plaintext directory -> element of "lru"
+	entries map[string]*list.Element
+	// Hit and miss counters
+	hits   uint64
+	misses uint64
 	// Synchronisation
-	lock sync.RWMutex
+	lock sync.Mutex
+}
+
+// init - allocate the data structures on first use. The caller must hold
+// the lock.
+func (c *dirIVCache) init() {
+	if c.entries == nil {
+		c.lru = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
 }
 
-// lookup - fetch entry for "dir" from the cache
+// lookup - fetch entry for "dir" from the cache and count the hit or miss
 func (c *dirIVCache) lookup(dir string) (bool, []byte, string) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-	if !c.cleared && c.dir == dir {
-		return true, c.iv, c.translatedDir
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e := c.get(dir)
+	if e == nil {
+		c.misses++
+		return false, nil, ""
+	}
+	c.hits++
+	return true, e.iv, e.translatedDir
+}
+
+// peek - fetch entry for "dir" from the cache without touching the counters
+func (c *dirIVCache) peek(dir string) (bool, []byte, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e := c.get(dir)
+	if e == nil {
+		return false, nil, ""
+	}
+	return true, e.iv, e.translatedDir
+}
+
+// get - find the entry for "dir" and mark it as used. The caller must hold
+// the lock.
+func (c *dirIVCache) get(dir string) *dirIVCacheEntry {
+	c.init()
+	el := c.entries[dir]
+	if el == nil {
+		return nil
 	}
-	return false, nil, ""
+	c.lru.MoveToFront(el)
+	return el.Value.(*dirIVCacheEntry)
 }
 
-// store - write entry for "dir" into the caches
+// store - write entry for "dir" into the cache. The least recently used
+// entry is dropped if the cache is full.
 func (c *dirIVCache) store(dir string, iv []byte, translatedDir string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.cleared = false
-	c.iv = iv
-	c.dir = dir
-	c.translatedDir = translatedDir
+	c.init()
+	if el := c.entries[dir]; el != nil {
+		el.Value = &dirIVCacheEntry{dir: dir, iv: iv, translatedDir: translatedDir}
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[dir] = c.lru.PushFront(&dirIVCacheEntry{dir: dir, iv: iv, translatedDir: translatedDir})
+	if c.lru.Len() > dirIVCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dirIVCacheEntry).dir)
+	}
 }
 
+// Clear - drop all entries
 func (c *dirIVCache) Clear() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.cleared = true
+	c.lru = nil
+	c.entries = nil
+}
+
+// ClearSubtree - drop the entries of plaintext directory "dir" and of all
+// directories below it. Call this when "dir" is renamed, deleted or replaced.
+func (c *dirIVCache) ClearSubtree(dir string) {
+	if dir == "" || dir == "." {
+		c.Clear()
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	prefix := dir + "/"
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*dirIVCacheEntry)
+		if e.dir == dir || strings.HasPrefix(e.dir, prefix) {
+			c.lru.Remove(el)
+			delete(c.entries, e.dir)
+		}
+		el = next
+	}
+}
+
+// Stats - number of lookups that were answered from the cache (hits) and
+// that had to read gocryptfs.diriv files (misses)
+func (c *dirIVCache) Stats() (hits uint64, misses uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hits, c.misses
 }
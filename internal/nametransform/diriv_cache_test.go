@@ -0,0 +1,119 @@
+package nametransform
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func TestDirIVCacheLRU(t *testing.T) {
+	var c dirIVCache
+	for i := 0; i < dirIVCacheSize; i++ {
+		c.store(fmt.Sprintf("dir%d", i), []byte{byte(i)}, fmt.Sprintf("cdir%d", i))
+	}
+	// Use dir0 so dir1 becomes the least recently used entry
+	if found, iv, cDir := c.lookup("dir0"); !found || iv[0] != 0 || cDir != "cdir0" {
+		t.Fatalf("dir0 not found")
+	}
+	c.store("new", nil, "cnew")
+	if found, _, _ := c.lookup("dir1"); found {
+		t.Error("dir1 should have been evicted")
+	}
+	for _, d := range []string{"dir0", "dir2", "new"} {
+		if found, _, _ := c.lookup(d); !found {
+			t.Errorf("%s should still be cached", d)
+		}
+	}
+	hits, misses := c.Stats()
+	if hits != 4 || misses != 1 {
+		t.Errorf("wrong counters: hits=%d misses=%d", hits, misses)
+	}
+}
+
+func TestDirIVCacheClearSubtree(t *testing.T) {
+	var c dirIVCache
+	for _, d := range []string{".", "a", "a/b", "a/b/c", "ab", "x"} {
+		c.store(d, nil, d)
+	}
+	c.ClearSubtree("a")
+	for _, d := range []string{"a", "a/b", "a/b/c"} {
+		if found, _, _ := c.peek(d); found {
+			t.Errorf("%s should have been dropped", d)
+		}
+	}
+	for _, d := range []string{".", "ab", "x"} {
+		if found, _, _ := c.peek(d); !found {
+			t.Errorf("%s should still be cached", d)
+		}
+	}
+	c.ClearSubtree("")
+	if found, _, _ := c.peek("x"); found {
+		t.Error("clearing the root should drop everything")
+	}
+}
+
+// A path in a sibling directory must only read the gocryptfs.diriv files that
+// are not cached yet
+func TestEncryptPathDirIVCache(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, false)
+	n := New(cc, true, true)
+	root, err := ioutil.TempDir("", "TestEncryptPathDirIVCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// Create the ciphertext directories "a", "a/b" and "a/c"
+	mkdir := func(plainPath string) {
+		cPath, err := n.EncryptPathDirIV(plainPath, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Mkdir(filepath.Join(root, cPath), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WriteDirIV(filepath.Join(root, cPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = WriteDirIV(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdir("a")
+	mkdir("a/b")
+	mkdir("a/c")
+
+	n.DirIVCache.Clear()
+	hits0, misses0 := n.DirIVCache.Stats()
+	c1, err := n.EncryptPathDirIV("a/b/file", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remove the root DirIV: "a" must come from the cache now
+	os.Remove(filepath.Join(root, DirIVFilename))
+	c2, err := n.EncryptPathDirIV("a/c/file", root)
+	if err != nil {
+		t.Fatalf("the DirIV of \"a\" was not cached: %v", err)
+	}
+	if filepath.Dir(filepath.Dir(c1)) != filepath.Dir(filepath.Dir(c2)) {
+		t.Errorf("different ciphertext for \"a\": %q %q", c1, c2)
+	}
+	c3, err := n.EncryptPathDirIV("a/b/file", root)
+	if err != nil || c3 != c1 {
+		t.Errorf("cached path differs: %q %q %v", c1, c3, err)
+	}
+	// The last lookup was the only hit
+	hits, misses := n.DirIVCache.Stats()
+	hits -= hits0
+	misses -= misses0
+	if hits != 1 || misses != 2 {
+		t.Errorf("wrong counters: hits=%d misses=%d", hits, misses)
+	}
+}
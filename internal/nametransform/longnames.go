@@ -63,6 +63,24 @@ func ReadLongName(path string) (string, error) {
 	return string(content), err
 }
 
+// ReadLongNameAt - read "hashName.name" from the directory that is opened as
+// "dirfd". A symlink in place of the .name file is not followed.
+func ReadLongNameAt(dirfd *os.File, hashName string) (string, error) {
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), hashName+LongNameSuffix,
+		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		toggledlog.Warn.Printf("ReadLongNameAt: %v", err)
+		return "", err
+	}
+	fd := os.NewFile(uintptr(fdRaw), hashName+LongNameSuffix)
+	defer fd.Close()
+	content, err := ioutil.ReadAll(fd)
+	if err != nil {
+		toggledlog.Warn.Printf("ReadLongNameAt: %v", err)
+	}
+	return string(content), err
+}
+
 // DeleteLongName deletes "hashName.name".
 func DeleteLongName(dirfd *os.File, hashName string) error {
 	err := syscall.Unlinkat(int(dirfd.Fd()), hashName+LongNameSuffix)
@@ -87,7 +105,7 @@ func (n *NameTransform) WriteLongName(dirfd *os.File, hashName string, plainName
 
 	// Write the encrypted name into hashName.name
 	fdRaw, err := syscall.Openat(int(dirfd.Fd()), hashName+LongNameSuffix,
-		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600)
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
 	if err != nil {
 		toggledlog.Warn.Printf("WriteLongName: Openat: %v", err)
 		return err
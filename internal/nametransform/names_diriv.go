@@ -13,8 +13,9 @@ import (
 )
 
 const (
-	// identical to AES block size
-	dirIVLen = 16
+	// DirIVLen is identical to AES block size. Exported because reverse mode
+	// synthesizes gocryptfs.diriv files.
+	DirIVLen = 16
 	// dirIV is stored in this file. Exported because we have to ignore this
 	// name in directory listing.
 	DirIVFilename = "gocryptfs.diriv"
@@ -34,8 +35,9 @@ func ReadDirIV(dir string) (iv []byte, err error) {
 
 // ReadDirIVAt reads "gocryptfs.diriv" from the directory that is opened as "dirfd".
 // Using the dirfd makes it immune to concurrent renames of the directory.
+// A symlink in place of "gocryptfs.diriv" is not followed.
 func ReadDirIVAt(dirfd *os.File) (iv []byte, err error) {
-	fdRaw, err := syscall.Openat(int(dirfd.Fd()), DirIVFilename, syscall.O_RDONLY, 0)
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), DirIVFilename, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		toggledlog.Warn.Printf("ReadDirIVAt: opening %q in dir %q failed: %v",
 			DirIVFilename, dirfd.Name(), err)
@@ -44,15 +46,15 @@ func ReadDirIVAt(dirfd *os.File) (iv []byte, err error) {
 	fd := os.NewFile(uintptr(fdRaw), DirIVFilename)
 	defer fd.Close()
 
-	iv = make([]byte, dirIVLen+1)
+	iv = make([]byte, DirIVLen+1)
 	n, err := fd.Read(iv)
 	if err != nil {
 		toggledlog.Warn.Printf("ReadDirIVAt: Read failed: %v", err)
 		return nil, err
 	}
 	iv = iv[0:n]
-	if len(iv) != dirIVLen {
-		toggledlog.Warn.Printf("ReadDirIVAt: wanted %d bytes, got %d", dirIVLen, len(iv))
+	if len(iv) != DirIVLen {
+		toggledlog.Warn.Printf("ReadDirIVAt: wanted %d bytes, got %d", DirIVLen, len(iv))
 		return nil, errors.New("invalid iv length")
 	}
 	return iv, nil
@@ -62,7 +64,7 @@ func ReadDirIVAt(dirfd *os.File) (iv []byte, err error) {
 // This function is exported because it is used from pathfs_frontend, main,
 // and also the automated tests.
 func WriteDirIV(dir string) error {
-	iv := cryptocore.RandBytes(dirIVLen)
+	iv := cryptocore.RandBytes(DirIVLen)
 	file := filepath.Join(dir, DirIVFilename)
 	err := ioutil.WriteFile(file, iv, 0400)
 	if err != nil {
@@ -71,6 +73,26 @@ func WriteDirIV(dir string) error {
 	return err
 }
 
+// WriteDirIVAt - create diriv file inside the directory that is opened as
+// "dirfd"
+func WriteDirIVAt(dirfd *os.File) error {
+	iv := cryptocore.RandBytes(DirIVLen)
+	fdRaw, err := syscall.Openat(int(dirfd.Fd()), DirIVFilename,
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		toggledlog.Warn.Printf("WriteDirIVAt: Openat: %v", err)
+		return err
+	}
+	fd := os.NewFile(uintptr(fdRaw), DirIVFilename)
+	_, err = fd.Write(iv)
+	if err != nil {
+		fd.Close()
+		toggledlog.Warn.Printf("WriteDirIVAt: Write: %v", err)
+		return err
+	}
+	return fd.Close()
+}
+
 // EncryptPathDirIV - encrypt relative plaintext path using EME with DirIV.
 // Components that are longer than 255 bytes are hashed if be.longnames == true.
 func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (cipherPath string, err error) {
@@ -88,41 +110,56 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (cip
 	parentDir := filepath.Dir(plainPath)
 	found, iv, cParentDir := be.DirIVCache.lookup(parentDir)
 	if found {
-		cBaseName := be.EncryptName(baseName, iv)
-		if be.longNames && len(cBaseName) > syscall.NAME_MAX {
-			cBaseName = HashLongName(cBaseName)
-		}
-		cipherPath = cParentDir + "/" + cBaseName
+		cipherPath = cParentDir + "/" + be.EncryptAndHashName(baseName, iv)
 		return cipherPath, nil
 	}
-	// Not cached - walk the directory tree
-	var wd = rootDir
+	// Not cached - walk the directory tree. The DirIVs of all directories on
+	// the way are cached as well, so only the ones that are missing are read
+	// from disk.
 	var encryptedNames []string
 	plainNames := strings.Split(plainPath, "/")
-	for _, plainName := range plainNames {
-		iv, err = ReadDirIV(wd)
-		if err != nil {
-			return "", err
+	for i, plainName := range plainNames {
+		plainDir := filepath.Join(plainNames[:i]...)
+		cDir := filepath.Join(encryptedNames...)
+		if plainDir == "" {
+			plainDir = "."
+			cDir = "."
 		}
-		encryptedName := be.EncryptName(plainName, iv)
-		if be.longNames && len(encryptedName) > syscall.NAME_MAX {
-			encryptedName = HashLongName(encryptedName)
+		found, iv, _ = be.DirIVCache.peek(plainDir)
+		if !found {
+			iv, err = ReadDirIV(filepath.Join(rootDir, cDir))
+			if err != nil {
+				return "", err
+			}
+			be.DirIVCache.store(plainDir, iv, cDir)
 		}
-		encryptedNames = append(encryptedNames, encryptedName)
-		wd = filepath.Join(wd, encryptedName)
+		encryptedNames = append(encryptedNames, be.EncryptAndHashName(plainName, iv))
 	}
 	cipherPath = strings.Join(encryptedNames, "/")
-	// Cache the final DirIV
-	cParentDir = filepath.Dir(cipherPath)
-	be.DirIVCache.store(parentDir, iv, cParentDir)
 	return cipherPath, nil
 }
 
-// DecryptPathDirIV - decrypt path using EME with DirIV
+// EncryptAndHashName - encrypt the single path component "plainName" using
+// "iv". The result is hashed if it is longer than 255 bytes and
+// be.longnames == true.
+func (be *NameTransform) EncryptAndHashName(plainName string, iv []byte) string {
+	cName := be.EncryptName(plainName, iv)
+	if be.longNames && len(cName) > syscall.NAME_MAX {
+		cName = HashLongName(cName)
+	}
+	return cName
+}
+
+// DecryptPathDirIV - decrypt path using EME with DirIV.
+// Hashed long names are resolved using their gocryptfs.longname.*.name files.
 //
-// TODO This has only a single user, Readlink(), and only for compatability with
-// gocryptfs v0.5. Drop?
+// Used by Readlink() for compatability with gocryptfs v0.5 and by the
+// control socket.
 func (be *NameTransform) DecryptPathDirIV(encryptedPath string, rootDir string) (string, error) {
+	// Empty string means root directory
+	if encryptedPath == "" {
+		return encryptedPath, nil
+	}
 	var wd = rootDir
 	var plainNames []string
 	encryptedNames := strings.Split(encryptedPath, "/")
@@ -132,7 +169,14 @@ func (be *NameTransform) DecryptPathDirIV(encryptedPath string, rootDir string)
 		if err != nil {
 			return "", err
 		}
-		plainName, err := be.DecryptName(encryptedName, iv)
+		cName := encryptedName
+		if be.longNames && IsLongContent(encryptedName) {
+			cName, err = ReadLongName(filepath.Join(wd, encryptedName))
+			if err != nil {
+				return "", err
+			}
+		}
+		plainName, err := be.DecryptName(cName, iv)
 		if err != nil {
 			return "", err
 		}
@@ -35,7 +35,7 @@ func (be *NameTransform) translatePathNoIV(path string, op int) (string, error)
 		return path, err
 	}
 
-	zeroIV := make([]byte, dirIVLen)
+	zeroIV := make([]byte, DirIVLen)
 
 	// Run operation on each path component
 	var translatedParts []string
@@ -14,7 +14,7 @@ func TestEncryptPathNoIV(t *testing.T) {
 	s = append(s, "123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890")
 
 	key := make([]byte, cryptocore.KeyLen)
-	cc := cryptocore.New(key, true, true)
+	cc := cryptocore.New(key, cryptocore.BackendOpenSSL, true, false)
 	fs := New(cc, true, false)
 
 	for _, n := range s {
@@ -0,0 +1,130 @@
+package siv_aead
+
+// AES-SIV as specified in RFC 5297, built on AES-CMAC (RFC 4493) and AES-CTR
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+const blockSize = aes.BlockSize
+
+var errAuth = errors.New("siv: message authentication failed")
+
+// dbl - multiply "b" by x in GF(2^128), see RFC 5297 section 2.3
+func dbl(b []byte) []byte {
+	out := make([]byte, blockSize)
+	var carry byte
+	for i := blockSize - 1; i >= 0; i-- {
+		out[i] = b[i]<<1 | carry
+		carry = b[i] >> 7
+	}
+	if carry != 0 {
+		out[blockSize-1] ^= 0x87
+	}
+	return out
+}
+
+// xorInto - dst ^= src
+func xorInto(dst []byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// cmac - compute the AES-CMAC of "msg", see RFC 4493
+func cmac(c cipher.Block, msg []byte) []byte {
+	k1 := make([]byte, blockSize)
+	c.Encrypt(k1, k1)
+	k1 = dbl(k1)
+	k2 := dbl(k1)
+
+	x := make([]byte, blockSize)
+	for len(msg) > blockSize {
+		xorInto(x, msg[:blockSize])
+		c.Encrypt(x, x)
+		msg = msg[blockSize:]
+	}
+	last := make([]byte, blockSize)
+	copy(last, msg)
+	if len(msg) == blockSize {
+		xorInto(last, k1)
+	} else {
+		last[len(msg)] = 0x80
+		xorInto(last, k2)
+	}
+	xorInto(x, last)
+	c.Encrypt(x, x)
+	return x
+}
+
+// s2v - the S2V construction of RFC 5297 section 2.4 over the associated
+// data "ad" followed by the plaintext
+func s2v(c cipher.Block, ad [][]byte, plaintext []byte) []byte {
+	d := cmac(c, make([]byte, blockSize))
+	for _, s := range ad {
+		d = dbl(d)
+		xorInto(d, cmac(c, s))
+	}
+	var t []byte
+	if len(plaintext) >= blockSize {
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		xorInto(t[len(t)-blockSize:], d)
+	} else {
+		t = dbl(d)
+		xorInto(t, plaintext)
+		t[len(plaintext)] ^= 0x80
+	}
+	return cmac(c, t)
+}
+
+// ctr - AES-CTR with the counter derived from the synthetic IV "v"
+func ctr(c cipher.Block, v []byte, in []byte) []byte {
+	q := make([]byte, blockSize)
+	copy(q, v)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	out := make([]byte, len(in))
+	cipher.NewCTR(c, q).XORKeyStream(out, in)
+	return out
+}
+
+// splitKey - the first half of the key is used for S2V, the second half for
+// CTR. Both halves must be valid AES keys.
+func splitKey(key []byte) (macCipher cipher.Block, ctrCipher cipher.Block) {
+	macCipher, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		panic(err)
+	}
+	ctrCipher, err = aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		panic(err)
+	}
+	return macCipher, ctrCipher
+}
+
+// encrypt - AES-SIV encryption. Returns the synthetic IV followed by the
+// ciphertext.
+func encrypt(key []byte, ad [][]byte, plaintext []byte) []byte {
+	macCipher, ctrCipher := splitKey(key)
+	v := s2v(macCipher, ad, plaintext)
+	return append(v, ctr(ctrCipher, v, plaintext)...)
+}
+
+// decrypt - AES-SIV decryption of "in", the synthetic IV followed by the
+// ciphertext
+func decrypt(key []byte, ad [][]byte, in []byte) ([]byte, error) {
+	if len(in) < blockSize {
+		return nil, errAuth
+	}
+	macCipher, ctrCipher := splitKey(key)
+	v := in[:blockSize]
+	plaintext := ctr(ctrCipher, v, in[blockSize:])
+	if subtle.ConstantTimeCompare(v, s2v(macCipher, ad, plaintext)) != 1 {
+		return nil, errAuth
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,78 @@
+package siv_aead
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test vectors from RFC 4493 section 4
+func TestCmac(t *testing.T) {
+	key := decodeHex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	macCipher, _ := splitKey(append(key, key...))
+	vectors := []struct{ msg, mac string }{
+		{"", "bb1d6929e95937287fa37d129b756746"},
+		{"6bc1bee22e409f96e93d7e117393172a", "070a16b46b4d4144f79bdd9dd04a287c"},
+		{"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411",
+			"dfa66747de9ae63030ca32611497c827"},
+	}
+	for _, v := range vectors {
+		mac := cmac(macCipher, decodeHex(t, v.msg))
+		if hex.EncodeToString(mac) != v.mac {
+			t.Errorf("msg %q: got %x, want %s", v.msg, mac, v.mac)
+		}
+	}
+}
+
+// Deterministic authenticated encryption example from RFC 5297 appendix A.1
+func TestSivRfc5297(t *testing.T) {
+	key := decodeHex(t, "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad := decodeHex(t, "101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext := decodeHex(t, "112233445566778899aabbccddee")
+	want := "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c"
+	out := encrypt(key, [][]byte{ad}, plaintext)
+	if hex.EncodeToString(out) != want {
+		t.Fatalf("got %x, want %s", out, want)
+	}
+	plaintext2, err := decrypt(key, [][]byte{ad}, out)
+	if err != nil || !bytes.Equal(plaintext, plaintext2) {
+		t.Errorf("decryption failed: %x %v", plaintext2, err)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	a := New(make([]byte, KeyLen))
+	nonce := make([]byte, a.NonceSize())
+	for _, n := range []int{0, 1, 15, 16, 17, 4096} {
+		plaintext := bytes.Repeat([]byte{'x'}, n)
+		ciphertext := a.Seal([]byte("prefix"), nonce, plaintext, []byte("ad"))
+		if len(ciphertext) != len("prefix")+n+a.Overhead() {
+			t.Fatalf("n=%d: wrong ciphertext length %d", n, len(ciphertext))
+		}
+		ciphertext = ciphertext[len("prefix"):]
+		out, err := a.Open(nil, nonce, ciphertext, []byte("ad"))
+		if err != nil || !bytes.Equal(out, plaintext) {
+			t.Errorf("n=%d: round trip failed: %v", n, err)
+		}
+		// Wrong associated data
+		_, err = a.Open(nil, nonce, ciphertext, []byte("xx"))
+		if err == nil {
+			t.Errorf("n=%d: wrong associated data was accepted", n)
+		}
+		// Wrong nonce
+		nonce2 := make([]byte, a.NonceSize())
+		nonce2[0] = 1
+		_, err = a.Open(nil, nonce2, ciphertext, []byte("ad"))
+		if err == nil {
+			t.Errorf("n=%d: wrong nonce was accepted", n)
+		}
+	}
+}
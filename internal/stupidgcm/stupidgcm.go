@@ -9,6 +9,8 @@ import "C"
 import (
 	"fmt"
 	"log"
+	"runtime"
+	"sync"
 	"unsafe"
 )
 
@@ -19,35 +21,46 @@ const (
 )
 
 // stupidGCM implements the cipher.AEAD interface
+//
+// Setting up an OpenSSL context and expanding the key costs about as much as
+// encrypting a 4 KiB block, so initialized contexts are kept in pools and
+// only get a new IV per call. A context is used by one goroutine at a time,
+// which makes stupidGCM safe for concurrent use.
 type stupidGCM struct {
 	key []byte
+	// Pools of *cipherCtx for encryption and decryption
+	encCtx *sync.Pool
+	decCtx *sync.Pool
 }
 
-func New(key []byte) stupidGCM {
+func New(key []byte) *stupidGCM {
 	if len(key) != keyLen {
 		log.Panicf("Only %d-byte keys are supported", keyLen)
 	}
-	return stupidGCM{key: key}
+	g := &stupidGCM{key: key}
+	g.encCtx = &sync.Pool{New: func() interface{} { return newCtx(g.key, true) }}
+	g.decCtx = &sync.Pool{New: func() interface{} { return newCtx(g.key, false) }}
+	return g
 }
 
-func (g stupidGCM) NonceSize() int {
+func (g *stupidGCM) NonceSize() int {
 	return ivLen
 }
 
-func (g stupidGCM) Overhead() int {
+func (g *stupidGCM) Overhead() int {
 	return tagLen
 }
 
-// Seal - encrypt "in" using "iv" and "authData" and append the result to "dst"
-func (g stupidGCM) Seal(dst, iv, in, authData []byte) []byte {
-	if len(iv) != ivLen {
-		log.Panicf("Only %d-byte IVs are supported", ivLen)
-	}
-	if len(in) == 0 {
-		log.Panic("Zero-length input data is not supported")
-	}
-	buf := make([]byte, len(in)+tagLen)
+// cipherCtx - OpenSSL context that is set up for AES-256-GCM with 16-byte IVs
+// and "key". The context is freed when the object is garbage collected, which
+// happens when sync.Pool drops it.
+type cipherCtx struct {
+	p *C.EVP_CIPHER_CTX
+}
 
+// newCtx - allocate a context for encryption ("encrypt" = true) or
+// decryption and set the key
+func newCtx(key []byte, encrypt bool) *cipherCtx {
 	// https://wiki.openssl.org/index.php/EVP_Authenticated_Encryption_and_Decryption#Authenticated_Encryption_using_GCM_mode
 
 	// Create scratch space "context"
@@ -55,10 +68,14 @@ func (g stupidGCM) Seal(dst, iv, in, authData []byte) []byte {
 	if ctx == nil {
 		panic("EVP_CIPHER_CTX_new failed")
 	}
+	var enc C.int
+	if encrypt {
+		enc = 1
+	}
 
 	// Set cipher to AES-256
-	if C.EVP_EncryptInit_ex(ctx, C.EVP_aes_256_gcm(), nil, nil, nil) != 1 {
-		panic("EVP_EncryptInit_ex I failed")
+	if C.EVP_CipherInit_ex(ctx, C.EVP_aes_256_gcm(), nil, nil, nil, enc) != 1 {
+		panic("EVP_CipherInit_ex I failed")
 	}
 
 	// Use 16-byte IV
@@ -66,14 +83,48 @@ func (g stupidGCM) Seal(dst, iv, in, authData []byte) []byte {
 		panic("EVP_CIPHER_CTX_ctrl EVP_CTRL_GCM_SET_IVLEN failed")
 	}
 
-	// Set key and IV
-	if C.EVP_EncryptInit_ex(ctx, nil, nil, (*C.uchar)(&g.key[0]), (*C.uchar)(&iv[0])) != 1 {
-		panic("EVP_EncryptInit_ex II failed")
+	// Set key. The IV is set for each message.
+	if C.EVP_CipherInit_ex(ctx, nil, nil, (*C.uchar)(&key[0]), nil, enc) != 1 {
+		panic("EVP_CipherInit_ex II failed")
+	}
+
+	c := &cipherCtx{p: ctx}
+	runtime.SetFinalizer(c, (*cipherCtx).free)
+	return c
+}
+
+// free - free the OpenSSL context
+func (c *cipherCtx) free() {
+	C.EVP_CIPHER_CTX_free(c.p)
+	c.p = nil
+}
+
+// Seal - encrypt "in" using "iv" and "authData" and append the result to "dst"
+func (g *stupidGCM) Seal(dst, iv, in, authData []byte) []byte {
+	ctx := g.encCtx.Get().(*cipherCtx)
+	out := seal(ctx, dst, iv, in, authData)
+	g.encCtx.Put(ctx)
+	return out
+}
+
+// seal - encrypt using encryption context "ctx"
+func seal(ctx *cipherCtx, dst, iv, in, authData []byte) []byte {
+	if len(iv) != ivLen {
+		log.Panicf("Only %d-byte IVs are supported", ivLen)
+	}
+	if len(in) == 0 {
+		log.Panic("Zero-length input data is not supported")
+	}
+	buf := make([]byte, len(in)+tagLen)
+
+	// Set IV, keep the key
+	if C.EVP_EncryptInit_ex(ctx.p, nil, nil, nil, (*C.uchar)(&iv[0])) != 1 {
+		panic("EVP_EncryptInit_ex failed")
 	}
 
 	// Provide authentication data
 	var resultLen C.int
-	if C.EVP_EncryptUpdate(ctx, nil, &resultLen, (*C.uchar)(&authData[0]), C.int(len(authData))) != 1 {
+	if C.EVP_EncryptUpdate(ctx.p, nil, &resultLen, (*C.uchar)(&authData[0]), C.int(len(authData))) != 1 {
 		panic("EVP_EncryptUpdate authData failed")
 	}
 	if int(resultLen) != len(authData) {
@@ -81,7 +132,7 @@ func (g stupidGCM) Seal(dst, iv, in, authData []byte) []byte {
 	}
 
 	// Encrypt "in" into "buf"
-	if C.EVP_EncryptUpdate(ctx, (*C.uchar)(&buf[0]), &resultLen, (*C.uchar)(&in[0]), C.int(len(in))) != 1 {
+	if C.EVP_EncryptUpdate(ctx.p, (*C.uchar)(&buf[0]), &resultLen, (*C.uchar)(&in[0]), C.int(len(in))) != 1 {
 		panic("EVP_EncryptUpdate failed")
 	}
 	if int(resultLen) != len(in) {
@@ -91,7 +142,7 @@ func (g stupidGCM) Seal(dst, iv, in, authData []byte) []byte {
 	// Finalise encryption
 	// Because GCM is a stream encryption, this will not write out any data.
 	dummy := make([]byte, 16)
-	if C.EVP_EncryptFinal_ex(ctx, (*C.uchar)(&dummy[0]), &resultLen) != 1 {
+	if C.EVP_EncryptFinal_ex(ctx.p, (*C.uchar)(&dummy[0]), &resultLen) != 1 {
 		panic("EVP_EncryptFinal_ex failed")
 	}
 	if resultLen != 0 {
@@ -99,18 +150,23 @@ func (g stupidGCM) Seal(dst, iv, in, authData []byte) []byte {
 	}
 
 	// Get GMAC tag and append it to the ciphertext in "buf"
-	if C.EVP_CIPHER_CTX_ctrl(ctx, C.EVP_CTRL_GCM_GET_TAG, tagLen, (unsafe.Pointer)(&buf[len(in)])) != 1 {
+	if C.EVP_CIPHER_CTX_ctrl(ctx.p, C.EVP_CTRL_GCM_GET_TAG, tagLen, (unsafe.Pointer)(&buf[len(in)])) != 1 {
 		panic("EVP_CIPHER_CTX_ctrl EVP_CTRL_GCM_GET_TAG failed")
 	}
 
-	// Free scratch space
-	C.EVP_CIPHER_CTX_free(ctx)
-
 	return append(dst, buf...)
 }
 
 // Open - decrypt "in" using "iv" and "authData" and append the result to "dst"
-func (g stupidGCM) Open(dst, iv, in, authData []byte) ([]byte, error) {
+func (g *stupidGCM) Open(dst, iv, in, authData []byte) ([]byte, error) {
+	ctx := g.decCtx.Get().(*cipherCtx)
+	out, err := open(ctx, dst, iv, in, authData)
+	g.decCtx.Put(ctx)
+	return out, err
+}
+
+// open - decrypt using decryption context "ctx"
+func open(ctx *cipherCtx, dst, iv, in, authData []byte) ([]byte, error) {
 	if len(iv) != ivLen {
 		log.Panicf("Only %d-byte IVs are supported", ivLen)
 	}
@@ -121,37 +177,19 @@ func (g stupidGCM) Open(dst, iv, in, authData []byte) ([]byte, error) {
 	ciphertext := in[:len(in)-tagLen]
 	tag := in[len(in)-tagLen:]
 
-	// https://wiki.openssl.org/index.php/EVP_Authenticated_Encryption_and_Decryption#Authenticated_Encryption_using_GCM_mode
-
-	// Create scratch space "context"
-	ctx := C.EVP_CIPHER_CTX_new()
-	if ctx == nil {
-		panic("EVP_CIPHER_CTX_new failed")
-	}
-
-	// Set cipher to AES-256
-	if C.EVP_DecryptInit_ex(ctx, C.EVP_aes_256_gcm(), nil, nil, nil) != 1 {
-		panic("EVP_DecryptInit_ex I failed")
-	}
-
-	// Use 16-byte IV
-	if C.EVP_CIPHER_CTX_ctrl(ctx, C.EVP_CTRL_GCM_SET_IVLEN, ivLen, nil) != 1 {
-		panic("EVP_CIPHER_CTX_ctrl EVP_CTRL_GCM_SET_IVLEN failed")
-	}
-
-	// Set key and IV
-	if C.EVP_DecryptInit_ex(ctx, nil, nil, (*C.uchar)(&g.key[0]), (*C.uchar)(&iv[0])) != 1 {
-		panic("EVP_DecryptInit_ex II failed")
+	// Set IV, keep the key
+	if C.EVP_DecryptInit_ex(ctx.p, nil, nil, nil, (*C.uchar)(&iv[0])) != 1 {
+		panic("EVP_DecryptInit_ex failed")
 	}
 
 	// Set expected GMAC tag
-	if C.EVP_CIPHER_CTX_ctrl(ctx, C.EVP_CTRL_GCM_SET_TAG, tagLen, (unsafe.Pointer)(&tag[0])) != 1 {
+	if C.EVP_CIPHER_CTX_ctrl(ctx.p, C.EVP_CTRL_GCM_SET_TAG, tagLen, (unsafe.Pointer)(&tag[0])) != 1 {
 		panic("EVP_CIPHER_CTX_ctrl failed")
 	}
 
 	// Provide authentication data
 	var resultLen C.int
-	if C.EVP_DecryptUpdate(ctx, nil, &resultLen, (*C.uchar)(&authData[0]), C.int(len(authData))) != 1 {
+	if C.EVP_DecryptUpdate(ctx.p, nil, &resultLen, (*C.uchar)(&authData[0]), C.int(len(authData))) != 1 {
 		panic("EVP_DecryptUpdate authData failed")
 	}
 	if int(resultLen) != len(authData) {
@@ -159,7 +197,7 @@ func (g stupidGCM) Open(dst, iv, in, authData []byte) ([]byte, error) {
 	}
 
 	// Decrypt "ciphertext" into "buf"
-	if C.EVP_DecryptUpdate(ctx, (*C.uchar)(&buf[0]), &resultLen, (*C.uchar)(&ciphertext[0]), C.int(len(ciphertext))) != 1 {
+	if C.EVP_DecryptUpdate(ctx.p, (*C.uchar)(&buf[0]), &resultLen, (*C.uchar)(&ciphertext[0]), C.int(len(ciphertext))) != 1 {
 		panic("EVP_DecryptUpdate failed")
 	}
 	if int(resultLen) != len(ciphertext) {
@@ -168,14 +206,11 @@ func (g stupidGCM) Open(dst, iv, in, authData []byte) ([]byte, error) {
 
 	// Check GMAC
 	dummy := make([]byte, 16)
-	res := C.EVP_DecryptFinal_ex(ctx, (*C.uchar)(&dummy[0]), &resultLen)
+	res := C.EVP_DecryptFinal_ex(ctx.p, (*C.uchar)(&dummy[0]), &resultLen)
 	if resultLen != 0 {
 		log.Panicf("Unexpected length %d", resultLen)
 	}
 
-	// Free scratch space
-	C.EVP_CIPHER_CTX_free(ctx)
-
 	if res != 1 {
 		return nil, fmt.Errorf("stupidgcm: message authentication failed")
 	}
@@ -13,6 +13,8 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -118,11 +120,68 @@ func TestCorruption(t *testing.T) {
 	}
 }
 
+// TestConcurrency encrypts and decrypts from several goroutines at once, like
+// go-fuse does, and compares against Go's built-in GCM. Contexts from the
+// pools must never be shared.
+func TestConcurrency(t *testing.T) {
+	key := randBytes(32)
+	sGCM := New(key)
+	gAES, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gGCM, err := cipher.NewGCMWithNonceSize(gAES, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i < 500; i++ {
+				authData := randBytes(24)
+				iv := randBytes(16)
+				in := randBytes(i * 7)
+				sOut := sGCM.Seal(nil, iv, in, authData)
+				if !bytes.Equal(sOut, gGCM.Seal(nil, iv, in, authData)) {
+					errs <- fmt.Errorf("encryption differs, size %d", len(in))
+					return
+				}
+				// A failed Open must not break the context for the next user
+				sOut[0]++
+				if _, err := sGCM.Open(nil, iv, sOut, authData); err == nil {
+					errs <- fmt.Errorf("corruption not detected, size %d", len(in))
+					return
+				}
+				sOut[0]--
+				out, err := sGCM.Open(nil, iv, sOut, authData)
+				if err != nil || !bytes.Equal(out, in) {
+					errs <- fmt.Errorf("decryption failed, size %d: %v", len(in), err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
 // $ go test -bench .
 // PASS
 // Benchmark4kEncStupidGCM-2	   50000	     25622 ns/op	 159.86 MB/s
 // Benchmark4kEncGoGCM-2    	   10000	    116544 ns/op	  35.15 MB/s
 // ok  	github.com/rfjakob/gocryptfs/internal/stupidgcm	3.775s
+//
+// Reusing the OpenSSL contexts instead of setting up a new one per block:
+// Benchmark4kEncStupidGCM        	  278197	      5841 ns/op	 701.26 MB/s
+// Benchmark4kEncStupidGCMNoPool  	  121069	      9981 ns/op	 410.38 MB/s
+// Benchmark4kDecStupidGCM        	  168598	      6351 ns/op	 644.92 MB/s
+// Benchmark4kDecStupidGCMNoPool  	  139315	      8558 ns/op	 478.59 MB/s
 func Benchmark4kEncStupidGCM(b *testing.B) {
 	key := randBytes(32)
 	authData := randBytes(24)
@@ -159,3 +218,73 @@ func Benchmark4kEncGoGCM(b *testing.B) {
 		gGCM.Seal(iv, iv, in, authData)
 	}
 }
+
+// Benchmark4kEncStupidGCMNoPool sets up a new OpenSSL context for every
+// block like stupidgcm did before the contexts were pooled
+func Benchmark4kEncStupidGCMNoPool(b *testing.B) {
+	key := randBytes(32)
+	authData := randBytes(24)
+	iv := randBytes(16)
+	in := make([]byte, 4096)
+	b.SetBytes(int64(len(in)))
+
+	for i := 0; i < b.N; i++ {
+		ctx := newCtx(key, true)
+		seal(ctx, iv, iv, in, authData)
+		ctx.free()
+	}
+}
+
+func Benchmark4kDecStupidGCM(b *testing.B) {
+	key := randBytes(32)
+	authData := randBytes(24)
+	iv := randBytes(16)
+	b.SetBytes(4096)
+
+	sGCM := New(key)
+	in := sGCM.Seal(nil, iv, make([]byte, 4096), authData)
+
+	for i := 0; i < b.N; i++ {
+		_, err := sGCM.Open(nil, iv, in, authData)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark4kDecStupidGCMNoPool - like Benchmark4kEncStupidGCMNoPool
+func Benchmark4kDecStupidGCMNoPool(b *testing.B) {
+	key := randBytes(32)
+	authData := randBytes(24)
+	iv := randBytes(16)
+	b.SetBytes(4096)
+
+	in := New(key).Seal(nil, iv, make([]byte, 4096), authData)
+
+	for i := 0; i < b.N; i++ {
+		ctx := newCtx(key, false)
+		_, err := open(ctx, nil, iv, in, authData)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ctx.free()
+	}
+}
+
+// Benchmark4kEncStupidGCMParallel encrypts from GOMAXPROCS goroutines at
+// once, each one gets its own context from the pool
+func Benchmark4kEncStupidGCMParallel(b *testing.B) {
+	key := randBytes(32)
+	authData := randBytes(24)
+	iv := randBytes(16)
+	in := make([]byte, 4096)
+	b.SetBytes(int64(len(in)))
+
+	sGCM := New(key)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sGCM.Seal(iv, iv, in, authData)
+		}
+	})
+}
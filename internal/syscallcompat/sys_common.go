@@ -0,0 +1,76 @@
+// Package syscallcompat wraps the *at syscalls that are used to access
+// CIPHERDIR without following symlinks, and emulates the ones that are
+// missing on some platforms.
+package syscallcompat
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// OpenDirNofollow - open the directory "relPath" below "baseDir" and return
+// the file descriptor. "baseDir" is trusted and opened normally. Every
+// component of "relPath" is opened relative to its parent with O_NOFOLLOW, so
+// a directory that is replaced by a symlink cannot redirect us outside of
+// "baseDir". A symlink anywhere in "relPath" results in ELOOP or ENOTDIR.
+func OpenDirNofollow(baseDir string, relPath string) (fd int, err error) {
+	if !filepath.IsAbs(baseDir) {
+		toggledlog.Warn.Printf("OpenDirNofollow: baseDir %q is not an absolute path", baseDir)
+		return -1, syscall.EINVAL
+	}
+	if filepath.IsAbs(relPath) {
+		toggledlog.Warn.Printf("OpenDirNofollow: relPath %q is an absolute path", relPath)
+		return -1, syscall.EINVAL
+	}
+	fd, err = unix.Open(baseDir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return -1, err
+	}
+	relPath = filepath.Clean(relPath)
+	if relPath == "." {
+		return fd, nil
+	}
+	for _, name := range strings.Split(relPath, "/") {
+		if name == ".." {
+			unix.Close(fd)
+			toggledlog.Warn.Printf("OpenDirNofollow: relPath %q leaves baseDir", relPath)
+			return -1, syscall.EINVAL
+		}
+		var childFd int
+		childFd, err = unix.Openat(fd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = childFd
+	}
+	return fd, nil
+}
+
+// Fstatat - like unix.Fstatat, but fills in a syscall.Stat_t, which is what
+// go-fuse works with. Both types are generated from the same C struct.
+func Fstatat(dirfd int, path string, st *syscall.Stat_t, flags int) error {
+	return unix.Fstatat(dirfd, path, (*unix.Stat_t)(unsafe.Pointer(st)), flags)
+}
+
+// Readlinkat - read the target of symlink "name" in directory "dirfd"
+func Readlinkat(dirfd int, name string) (string, error) {
+	// Start with a buffer that fits most targets and grow it if the target
+	// is longer
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package syscallcompat
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestOpenDirNofollow(t *testing.T) {
+	base, err := ioutil.TempDir("", "TestOpenDirNofollow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	err = os.MkdirAll(base+"/a/b", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("a", base+"/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, relPath := range []string{"", ".", "a", "a/b", "a/b/"} {
+		fd, err := OpenDirNofollow(base, relPath)
+		if err != nil {
+			t.Errorf("%q: %v", relPath, err)
+			continue
+		}
+		syscall.Close(fd)
+	}
+	for _, relPath := range []string{"link", "link/b", "a/../link", "/a", "a/../..", "a/nonexisting"} {
+		fd, err := OpenDirNofollow(base, relPath)
+		if err == nil {
+			syscall.Close(fd)
+			t.Errorf("%q should have failed", relPath)
+		}
+	}
+}
+
+// Swap "a" for a symlink to "outside" while opening "a/b". We must always get
+// the real "a/b" or an error, never "outside/b".
+func TestOpenDirNofollowRace(t *testing.T) {
+	base, err := ioutil.TempDir("", "TestOpenDirNofollowRace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	for _, d := range []string{"/dir/a/b", "/outside/b"} {
+		err = os.MkdirAll(base+d, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var outsideSt syscall.Stat_t
+	err = syscall.Stat(base+"/outside/b", &outsideSt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := base + "/dir"
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			os.Rename(dir+"/a", dir+"/a.real")
+			os.Symlink("../outside", dir+"/a")
+			os.Remove(dir + "/a")
+			os.Rename(dir+"/a.real", dir+"/a")
+		}
+	}()
+	var opened int
+	for i := 0; i < 10000; i++ {
+		fd, err := OpenDirNofollow(dir, "a/b")
+		if err != nil {
+			continue
+		}
+		opened++
+		var st syscall.Stat_t
+		err = syscall.Fstat(fd, &st)
+		syscall.Close(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Ino == outsideSt.Ino && st.Dev == outsideSt.Dev {
+			t.Fatalf("iteration %d: followed the symlink to the outside", i)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if opened == 0 {
+		t.Error("OpenDirNofollow never succeeded")
+	}
+}
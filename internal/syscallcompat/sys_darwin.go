@@ -0,0 +1,74 @@
+package syscallcompat
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// O_PATH does not exist on OSX. Opening the file read-only is the closest we
+// can get.
+const O_PATH = unix.O_RDONLY
+
+// HaveOFDLocks - open file description locks do not exist on OSX. Classic
+// POSIX locks all belong to the gocryptfs process and would never conflict
+// with each other, so they are no replacement.
+const HaveOFDLocks = false
+
+// FcntlFlockOFD - not supported on OSX, see HaveOFDLocks
+func FcntlFlockOFD(fd uintptr, cmd int, lk *syscall.Flock_t) error {
+	return syscall.ENOSYS
+}
+
+// ProcFdPath - get a path that refers to the file that is open as "fd"
+func ProcFdPath(fd int) string {
+	return fmt.Sprintf("/dev/fd/%d", fd)
+}
+
+// FchmodatNofollow - chmod "name" in directory "dirfd" without following a
+// symlink
+func FchmodatNofollow(dirfd int, name string, mode uint32) error {
+	return unix.Fchmodat(dirfd, name, mode, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// chdirLock serializes the emulated *at syscalls, which temporarily change
+// the working directory of the whole process
+var chdirLock sync.Mutex
+
+// Mknodat - create a device node, fifo or socket "name" in directory "dirfd".
+// OSX has no mknodat, emulate it using fchdir.
+func Mknodat(dirfd int, name string, mode uint32, dev int) error {
+	chdirLock.Lock()
+	defer chdirLock.Unlock()
+	cwd, err := syscall.Open(".", syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(cwd)
+	err = syscall.Fchdir(dirfd)
+	if err != nil {
+		return err
+	}
+	defer syscall.Fchdir(cwd)
+	return syscall.Mknod(name, mode, dev)
+}
+
+// Extended attributes are not implemented on OSX
+
+func Getxattr(path string, attr string) ([]byte, error) {
+	return nil, syscall.EOPNOTSUPP
+}
+
+func Setxattr(path string, attr string, data []byte, flags int) error {
+	return syscall.EOPNOTSUPP
+}
+
+func Listxattr(path string) ([]byte, error) {
+	return nil, syscall.EOPNOTSUPP
+}
+
+func Removexattr(path string, attr string) error {
+	return syscall.EOPNOTSUPP
+}
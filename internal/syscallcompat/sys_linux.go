@@ -0,0 +1,118 @@
+package syscallcompat
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// O_PATH - get a handle to a file without opening it. The file can be used as
+// a dirfd and with Fstat, and it does not need any permissions on the file.
+const O_PATH = unix.O_PATH
+
+// HaveOFDLocks - FcntlFlockOFD is supported
+const HaveOFDLocks = true
+
+// FcntlFlockOFD - run the fcntl(2) lock command "cmd" (F_GETLK, F_SETLK or
+// F_SETLKW) on "fd" as an open file description lock. Unlike classic POSIX
+// locks, they belong to the open file and not to the process, so locks taken
+// through different fds of the same gocryptfs process conflict with each
+// other.
+func FcntlFlockOFD(fd uintptr, cmd int, lk *syscall.Flock_t) error {
+	switch cmd {
+	case syscall.F_GETLK:
+		cmd = unix.F_OFD_GETLK
+	case syscall.F_SETLK:
+		cmd = unix.F_OFD_SETLK
+	case syscall.F_SETLKW:
+		cmd = unix.F_OFD_SETLKW
+	default:
+		return syscall.EINVAL
+	}
+	// Open file description locks fail with EINVAL unless l_pid is zero
+	lk.Pid = 0
+	return syscall.FcntlFlock(fd, cmd, lk)
+}
+
+// ProcFdPath - get a path that refers to the file that is open as "fd"
+// itself, even if it has been renamed or replaced since
+func ProcFdPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
+
+// FchmodatNofollow - chmod "name" in directory "dirfd" without following a
+// symlink. Linux does not support the AT_SYMLINK_NOFOLLOW flag of fchmodat,
+// and symlinks have no permissions of their own, so ELOOP is returned for
+// them.
+func FchmodatNofollow(dirfd int, name string, mode uint32) error {
+	fd, err := unix.Openat(dirfd, name, O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	var st syscall.Stat_t
+	err = syscall.Fstat(fd, &st)
+	if err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return syscall.ELOOP
+	}
+	// Fchmod does not work on O_PATH handles, go through /proc instead
+	return syscall.Chmod(ProcFdPath(fd), mode)
+}
+
+// Mknodat - create a device node, fifo or socket "name" in directory "dirfd"
+func Mknodat(dirfd int, name string, mode uint32, dev int) error {
+	return unix.Mknodat(dirfd, name, mode, dev)
+}
+
+// Getxattr - read the complete value of extended attribute "attr" of "path"
+func Getxattr(path string, attr string) ([]byte, error) {
+	for {
+		sz, err := syscall.Getxattr(path, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = syscall.Getxattr(path, attr, buf)
+		if err == syscall.ERANGE {
+			// The value grew in between, try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+// Setxattr - set extended attribute "attr" of "path"
+func Setxattr(path string, attr string, data []byte, flags int) error {
+	return syscall.Setxattr(path, attr, data, flags)
+}
+
+// Listxattr - get the NUL-separated list of extended attributes of "path"
+func Listxattr(path string) ([]byte, error) {
+	for {
+		sz, err := syscall.Listxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+// Removexattr - remove extended attribute "attr" of "path"
+func Removexattr(path string, attr string) error {
+	return syscall.Removexattr(path, attr)
+}
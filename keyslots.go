@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+// addKeyslot - add a keyslot labeled "args.keyslotAdd" to the config file.
+// Any existing password unlocks the master key that is stored in the new slot.
+func addKeyslot(args *argContainer) {
+	masterkey, confFile := loadConfig(args)
+	toggledlog.Info.Printf("Please enter the password for the new keyslot %q.", args.keyslotAdd)
+	newPw := readPasswordTwice(args.extpass)
+	err := confFile.AddKeyslot(masterkey, newPw, kdfParams(args), args.keyslotAdd)
+	if err != nil {
+		toggledlog.Fatal.Println(colorRed + err.Error() + colorReset)
+		os.Exit(ERREXIT_USAGE)
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		toggledlog.Fatal.Println(err)
+		os.Exit(ERREXIT_INIT)
+	}
+	toggledlog.Info.Printf("Keyslot %q added.", args.keyslotAdd)
+	os.Exit(0)
+}
+
+// removeKeyslot - remove the keyslot labeled "args.keyslotRemove" from the
+// config file. Asks for any valid password to prevent accidents.
+func removeKeyslot(args *argContainer) {
+	_, confFile := loadConfig(args)
+	err := confFile.RemoveKeyslot(args.keyslotRemove)
+	if err != nil {
+		toggledlog.Fatal.Println(colorRed + err.Error() + colorReset)
+		os.Exit(ERREXIT_USAGE)
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		toggledlog.Fatal.Println(err)
+		os.Exit(ERREXIT_INIT)
+	}
+	toggledlog.Info.Printf("Keyslot %q removed.", args.keyslotRemove)
+	os.Exit(0)
+}
+
+// listKeyslots - print the keyslots of config file "filename" and exit.
+// No password is needed.
+func listKeyslots(filename string) {
+	cf, err := configfile.Load(filename)
+	if err != nil {
+		toggledlog.Fatal.Println(colorRed + err.Error() + colorReset)
+		os.Exit(ERREXIT_LOADCONF)
+	}
+	for i, ks := range cf.Keyslots {
+		fmt.Printf("%d: %s (%s)\n", i, ks.Label, ks.KdfString())
+	}
+	os.Exit(0)
+}
@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"log/syslog"
+	"math"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -25,9 +27,12 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/toggledlog"
 )
 
@@ -40,15 +45,25 @@ const (
 	ERREXIT_LOADCONF   = 8
 	ERREXIT_PASSWORD   = 9
 	ERREXIT_MOUNTPOINT = 10
+	ERREXIT_FSCK       = 11
+	ERREXIT_CTLSOCK    = 12
+	ERREXIT_ROTATE     = 13
 )
 
 type argContainer struct {
 	debug, init, zerokey, fusedebug, openssl, passwd, foreground, version,
 	plaintextnames, quiet, diriv, emenames, gcmiv128, nosyslog, wpanic,
-	longnames, allow_other bool
+	longnames, allow_other, reverse, fsck, info, ro, keyslotList, rotateKey, xattr, xchacha, aessiv, hkdf, headerv3, integrity, compress,
+	kernel_cache, writeback bool
 	masterkey, mountpoint, cipherdir, cpuprofile, config, extpass,
-	memprofile string
-	notifypid, scryptn int
+	memprofile, ctlsock, keyslotAdd, keyslotRemove, kdf string
+	notifypid, scryptn, argon2idTime, argon2idMemory, argon2idThreads int
+	// Plaintext block size, parsed from "-blocksize"
+	blocksize uint64
+	// How long the kernel may cache attributes, names and non-existing names
+	attr_timeout, entry_timeout, negative_timeout time.Duration
+	// Listening control socket, opened by main() if "-ctlsock" was passed
+	ctlsockListener net.Listener
 }
 
 var flagSet *flag.FlagSet
@@ -59,10 +74,35 @@ var GitVersionFuse = "[version not set - please compile using ./build.bash]"
 
 // initDir initializes an empty directory for use as a gocryptfs cipherdir.
 func initDir(args *argContainer) {
-	err := checkDirEmpty(args.cipherdir)
-	if err != nil {
-		toggledlog.Fatal.Printf("Invalid cipherdir: %v\n", err)
-		os.Exit(ERREXIT_INIT)
+	var err error
+	if args.reverse {
+		if args.xattr {
+			toggledlog.Fatal.Printf("-xattr is not supported in reverse mode")
+			os.Exit(ERREXIT_INIT)
+		}
+		if args.headerv3 || args.integrity || args.compress {
+			toggledlog.Fatal.Printf("-headerv3, -integrity and -compress are not supported in reverse mode")
+			os.Exit(ERREXIT_INIT)
+		}
+		// In reverse mode, CIPHERDIR contains the plaintext files. It does
+		// not have to be empty but must not already contain a config.
+		_, err = os.Stat(args.config)
+		if err == nil {
+			toggledlog.Fatal.Printf(colorRed+"Config file %q already exists"+colorReset, args.config)
+			os.Exit(ERREXIT_INIT)
+		}
+	} else {
+		err = checkDirEmpty(args.cipherdir)
+		if err != nil {
+			toggledlog.Fatal.Printf("Invalid cipherdir: %v\n", err)
+			os.Exit(ERREXIT_INIT)
+		}
+	}
+	// The zero padding of compressed blocks can only be deallocated in
+	// whole filesystem blocks, which are usually 4K
+	if args.compress && args.blocksize < 8192 {
+		toggledlog.Info.Printf(colorYellow + "Warning: -compress does not save disk space " +
+			"with a -blocksize below 8K" + colorReset)
 	}
 
 	// Create gocryptfs.conf
@@ -73,13 +113,28 @@ func initDir(args *argContainer) {
 	}
 	password := readPasswordTwice(args.extpass)
 	creator := toggledlog.ProgramName + " " + GitVersion
-	err = configfile.CreateConfFile(args.config, password, args.plaintextnames, args.scryptn, creator)
+	err = configfile.CreateConfFile(&configfile.CreateArgs{
+		Filename:          args.config,
+		Password:          password,
+		Kdf:               kdfParams(args),
+		Creator:           creator,
+		PlaintextNames:    args.plaintextnames,
+		Xattr:             args.xattr,
+		BlockSize:         args.blocksize,
+		XChaCha20Poly1305: args.xchacha,
+		AESSIV:            args.aessiv,
+		HKDF:              args.hkdf,
+		HeaderV3:          args.headerv3,
+		Integrity:         args.integrity,
+		Compress:          args.compress,
+	})
 	if err != nil {
 		toggledlog.Fatal.Println(err)
 		os.Exit(ERREXIT_INIT)
 	}
 
-	if args.diriv && !args.plaintextnames {
+	// Reverse mode synthesizes gocryptfs.diriv files, there is nothing to write
+	if args.diriv && !args.plaintextnames && !args.reverse {
 		// Create gocryptfs.diriv in the root dir
 		err = nametransform.WriteDirIV(args.cipherdir)
 		if err != nil {
@@ -104,7 +159,7 @@ func initDir(args *argContainer) {
 func usageText() {
 	printVersion()
 	fmt.Printf(`
-Usage: %s -init|-passwd [OPTIONS] CIPHERDIR
+Usage: %s -init|-passwd|-fsck|-info|-keyslot-*|-rotate-key [OPTIONS] CIPHERDIR
   or   %s [OPTIONS] CIPHERDIR MOUNTPOINT
 
 Options:
@@ -115,6 +170,12 @@ Options:
 
 // loadConfig - load the config file "filename", prompting the user for the password
 func loadConfig(args *argContainer) (masterkey []byte, confFile *configfile.ConfFile) {
+	masterkey, confFile, _ = unlockConfig(args)
+	return masterkey, confFile
+}
+
+// unlockConfig - like loadConfig, but also returns the password
+func unlockConfig(args *argContainer) (masterkey []byte, confFile *configfile.ConfFile, pw string) {
 	// Check if the file exists at all before prompting for a password
 	_, err := os.Stat(args.config)
 	if err != nil {
@@ -124,7 +185,7 @@ func loadConfig(args *argContainer) (masterkey []byte, confFile *configfile.Conf
 	if args.extpass == "" {
 		fmt.Fprintf(os.Stderr, "Password: ")
 	}
-	pw := readPassword(args.extpass)
+	pw = readPassword(args.extpass)
 	toggledlog.Info.Printf("Decrypting master key... ")
 	masterkey, confFile, err = configfile.LoadConfFile(args.config, pw)
 	if err != nil {
@@ -133,6 +194,27 @@ func loadConfig(args *argContainer) (masterkey []byte, confFile *configfile.Conf
 	}
 	toggledlog.Info.Printf("done.")
 
+	return masterkey, confFile, pw
+}
+
+// getMasterKey - get the master key from "-masterkey", "-zerokey" or by
+// decrypting the config file. confFile is nil if the config file was not used.
+// Calls os.Exit on errors.
+func getMasterKey(args *argContainer) (masterkey []byte, confFile *configfile.ConfFile) {
+	if args.masterkey != "" {
+		// "-masterkey"
+		toggledlog.Info.Printf("Using explicit master key.")
+		masterkey = parseMasterKey(args.masterkey)
+		toggledlog.Info.Printf("THE MASTER KEY IS VISIBLE VIA \"ps -auxwww\", ONLY USE THIS MODE FOR EMERGENCIES.")
+	} else if args.zerokey {
+		// "-zerokey"
+		toggledlog.Info.Printf("Using all-zero dummy master key.")
+		toggledlog.Info.Printf("ZEROKEY MODE PROVIDES NO SECURITY AT ALL AND SHOULD ONLY BE USED FOR TESTING.")
+		masterkey = make([]byte, cryptocore.KeyLen)
+	} else {
+		// Load master key from config file
+		masterkey, confFile = loadConfig(args)
+	}
 	return masterkey, confFile
 }
 
@@ -141,7 +223,12 @@ func changePassword(args *argContainer) {
 	masterkey, confFile := loadConfig(args)
 	toggledlog.Info.Println("Please enter your new password.")
 	newPw := readPasswordTwice(args.extpass)
-	confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.LogN())
+	// Keep the KDF and its cost unless "-kdf" was passed
+	params := confFile.UnlockedKdfParams()
+	if args.kdf != "" {
+		params = kdfParams(args)
+	}
+	confFile.EncryptKey(masterkey, newPw, params)
 	err := confFile.WriteFile()
 	if err != nil {
 		toggledlog.Fatal.Println(err)
@@ -151,6 +238,56 @@ func changePassword(args *argContainer) {
 	os.Exit(0)
 }
 
+// kdfParams - password hashing function and cost for new keyslots, as
+// selected by "-kdf" and the cost options. Calls os.Exit on invalid input.
+func kdfParams(args *argContainer) configfile.KdfParams {
+	switch args.kdf {
+	case "", configfile.KdfScrypt:
+		return configfile.KdfParams{
+			Name:       configfile.KdfScrypt,
+			ScryptLogN: args.scryptn,
+		}
+	case configfile.KdfArgon2id:
+		// The memory cost is stored in KiB as an uint32
+		if args.argon2idTime < 1 || int64(args.argon2idTime) > math.MaxUint32 ||
+			args.argon2idMemory < 1 || int64(args.argon2idMemory) > math.MaxUint32/1024 ||
+			args.argon2idThreads < 1 || args.argon2idThreads > 255 {
+			toggledlog.Fatal.Printf(colorRed + "Invalid argon2id cost parameters" + colorReset)
+			os.Exit(ERREXIT_USAGE)
+		}
+		return configfile.KdfParams{
+			Name:            configfile.KdfArgon2id,
+			Argon2idTime:    uint32(args.argon2idTime),
+			Argon2idMemory:  uint32(args.argon2idMemory) * 1024,
+			Argon2idThreads: uint8(args.argon2idThreads),
+		}
+	}
+	toggledlog.Fatal.Printf(colorRed+"Unknown KDF %q, must be %q or %q"+colorReset,
+		args.kdf, configfile.KdfScrypt, configfile.KdfArgon2id)
+	os.Exit(ERREXIT_USAGE)
+	return configfile.KdfParams{}
+}
+
+// parseBlockSize - parse a block size like "4096", "64K" or "1M" and check
+// that contentenc supports it
+func parseBlockSize(s string) (uint64, error) {
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1024
+	case strings.HasSuffix(s, "M"):
+		mult = 1024 * 1024
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, contentenc.CheckBS(n * mult)
+}
+
 // printVersion - print a version string like
 // "gocryptfs v0.3.1-31-g6736212-dirty; on-disk format 2"
 func printVersion() {
@@ -165,7 +302,7 @@ func main() {
 	setupColors()
 
 	// Parse command line arguments
-	var opensslAuto string
+	var opensslAuto, blocksizeArg string
 	flagSet = flag.NewFlagSet(toggledlog.ProgramName, flag.ExitOnError)
 	flagSet.Usage = usageText
 	flagSet.BoolVar(&args.debug, "d", false, "")
@@ -176,6 +313,12 @@ func main() {
 	// Tri-state true/false/auto
 	flagSet.StringVar(&opensslAuto, "openssl", "auto", "Use OpenSSL instead of built-in Go crypto")
 	flagSet.BoolVar(&args.passwd, "passwd", false, "Change password")
+	flagSet.BoolVar(&args.fsck, "fsck", false, "Check the filesystem for corruption and exit")
+	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR and exit")
+	flagSet.StringVar(&args.keyslotAdd, "keyslot-add", "", "Add a password keyslot with the specified label")
+	flagSet.StringVar(&args.keyslotRemove, "keyslot-remove", "", "Remove the password keyslot with the specified label")
+	flagSet.BoolVar(&args.keyslotList, "keyslot-list", false, "List the password keyslots and exit")
+	flagSet.BoolVar(&args.rotateKey, "rotate-key", false, "Re-encrypt CIPHERDIR with a new master key")
 	flagSet.BoolVar(&args.foreground, "f", false, "Stay in the foreground")
 	flagSet.BoolVar(&args.version, "version", false, "Print version and exit")
 	flagSet.BoolVar(&args.plaintextnames, "plaintextnames", false, "Do not encrypt file names")
@@ -187,17 +330,54 @@ func main() {
 	flagSet.BoolVar(&args.nosyslog, "nosyslog", false, "Do not redirect output to syslog when running in the background")
 	flagSet.BoolVar(&args.wpanic, "wpanic", false, "When encountering a warning, panic and exit immediately")
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 176 bytes in extra files")
+	flagSet.BoolVar(&args.hkdf, "hkdf", false, "Use HKDF to derive separate keys for content and name encryption "+
+		"(default true with -init)")
 	flagSet.BoolVar(&args.allow_other, "allow_other", false, "Allow other users to access the filesystem. "+
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
+	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode: CIPHERDIR contains plaintext files "+
+		"and the mountpoint shows the encrypted view")
+	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
+	flagSet.BoolVar(&args.xattr, "xattr", false, "Enable encrypted extended attributes (only with -init)")
+	flagSet.BoolVar(&args.xchacha, "xchacha", false, "Use XChaCha20-Poly1305 instead of AES-GCM for the "+
+		"file contents (only with -init). Faster on CPUs without AES instructions.")
+	flagSet.BoolVar(&args.aessiv, "aessiv", false, "Use AES-SIV instead of AES-GCM for the file contents "+
+		"(only with -init). Misuse-resistant: a repeated nonce does not leak the key.")
+	flagSet.BoolVar(&args.headerv3, "headerv3", false, "Use file headers that store the authenticated "+
+		"plaintext size (only with -init)")
+	flagSet.BoolVar(&args.integrity, "integrity", false, "Detect stale, reordered and truncated blocks "+
+		"using a per-file hash tree (only with -init). Implies -headerv3.")
+	flagSet.BoolVar(&args.compress, "compress", false, "Compress the file contents before encryption "+
+		"(only with -init). Implies -headerv3.")
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.extpass, "extpass", "", "Use external program for the password prompt")
+	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	flagSet.IntVar(&args.scryptn, "scryptn", configfile.ScryptDefaultLogN, "scrypt cost parameter logN. "+
 		"Setting this to a lower value speeds up mounting but makes the password susceptible to brute-force attacks")
+	flagSet.StringVar(&args.kdf, "kdf", "", "Password hashing function for -init, -passwd and -keyslot-add: "+
+		configfile.KdfScrypt+" (default) or "+configfile.KdfArgon2id)
+	flagSet.IntVar(&args.argon2idTime, "argon2id-time", configfile.Argon2idDefaultTime,
+		"argon2id cost parameter: number of passes over the memory")
+	flagSet.IntVar(&args.argon2idMemory, "argon2id-mem", configfile.Argon2idDefaultMemory/1024,
+		"argon2id cost parameter: memory in MiB")
+	flagSet.IntVar(&args.argon2idThreads, "argon2id-threads", configfile.Argon2idDefaultThreads,
+		"argon2id cost parameter: degree of parallelism")
+	flagSet.StringVar(&blocksizeArg, "blocksize", "4K", "Plaintext block size for -init, "+
+		"a power of two between 4K and 1M")
+	flagSet.DurationVar(&args.attr_timeout, "attr_timeout", time.Second, "How long the kernel caches "+
+		"file attributes")
+	flagSet.DurationVar(&args.entry_timeout, "entry_timeout", time.Second, "How long the kernel caches "+
+		"file names")
+	flagSet.DurationVar(&args.negative_timeout, "negative_timeout", time.Second, "How long the kernel "+
+		"caches that a file name does not exist")
+	flagSet.BoolVar(&args.kernel_cache, "kernel_cache", false, "Keep file contents in the kernel page "+
+		"cache across opens. CIPHERDIR must not be modified behind our back.")
+	flagSet.BoolVar(&args.writeback, "writeback", false, "Let the kernel cache writes and send them "+
+		"in larger batches")
 	flagSet.Parse(os.Args[1:])
 
 	// "-openssl" needs some post-processing
@@ -210,6 +390,30 @@ func main() {
 			os.Exit(ERREXIT_USAGE)
 		}
 	}
+	args.blocksize, err = parseBlockSize(blocksizeArg)
+	if err != nil {
+		toggledlog.Fatal.Printf(colorRed+"Invalid \"-blocksize\" setting: %v\n"+colorReset, err)
+		os.Exit(ERREXIT_USAGE)
+	}
+	// The hash tree root and the exact file size of compressed files are
+	// stored in the version 3 header
+	if args.integrity || args.compress {
+		args.headerv3 = true
+	}
+	// New filesystems use HKDF unless "-hkdf=false" is passed. Mounting with
+	// "-masterkey" or "-zerokey" keeps the direct key of older versions, there
+	// is no config file to tell us otherwise.
+	if args.init {
+		hkdfSet := false
+		flagSet.Visit(func(f *flag.Flag) {
+			if f.Name == "hkdf" {
+				hkdfSet = true
+			}
+		})
+		if !hkdfSet {
+			args.hkdf = true
+		}
+	}
 
 	// Fork a child into the background if "-f" is not set AND we are mounting a filesystem
 	if !args.foreground && flagSet.NArg() == 2 {
@@ -252,6 +456,8 @@ func main() {
 			os.Exit(ERREXIT_INIT)
 		}
 		toggledlog.Info.Printf("Using config file at custom location %s", args.config)
+	} else if args.reverse {
+		args.config = filepath.Join(args.cipherdir, configfile.ConfReverseName)
 	} else {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
 	}
@@ -286,12 +492,14 @@ func main() {
 		toggledlog.Info.Printf("Note: You must unmount gracefully, otherwise the profile file(s) will stay empty!\n")
 	}
 	// "-openssl"
-	if args.openssl == false {
+	if args.xchacha || args.aessiv {
+		toggledlog.Debug.Printf("XChaCha20-Poly1305 or AES-SIV requested, \"-openssl\" does not apply")
+	} else if args.openssl == false {
 		toggledlog.Debug.Printf("OpenSSL disabled, using Go GCM")
 	} else {
 		toggledlog.Debug.Printf("OpenSSL enabled")
 	}
-	// Operation flags: init, passwd or mount
+	// Operation flags: init, passwd, fsck, info, keyslot-*, rotate-key or mount
 	// "-init"
 	if args.init {
 		if flagSet.NArg() > 1 {
@@ -308,6 +516,44 @@ func main() {
 		}
 		changePassword(&args) // does not return
 	}
+	// "-fsck"
+	if args.fsck {
+		if flagSet.NArg() > 1 {
+			toggledlog.Fatal.Printf("Usage: %s -fsck [OPTIONS] CIPHERDIR\n", toggledlog.ProgramName)
+			os.Exit(ERREXIT_USAGE)
+		}
+		fsck(&args) // does not return
+	}
+	// "-info"
+	if args.info {
+		if flagSet.NArg() > 1 {
+			toggledlog.Fatal.Printf("Usage: %s -info [OPTIONS] CIPHERDIR\n", toggledlog.ProgramName)
+			os.Exit(ERREXIT_USAGE)
+		}
+		info(args.config) // does not return
+	}
+	// "-keyslot-add", "-keyslot-remove", "-keyslot-list"
+	if args.keyslotAdd != "" || args.keyslotRemove != "" || args.keyslotList {
+		if flagSet.NArg() > 1 {
+			toggledlog.Fatal.Printf("Usage: %s -keyslot-add|-keyslot-remove LABEL [OPTIONS] CIPHERDIR\n"+
+				"  or   %s -keyslot-list [OPTIONS] CIPHERDIR\n", toggledlog.ProgramName, toggledlog.ProgramName)
+			os.Exit(ERREXIT_USAGE)
+		}
+		if args.keyslotAdd != "" {
+			addKeyslot(&args) // does not return
+		} else if args.keyslotRemove != "" {
+			removeKeyslot(&args) // does not return
+		}
+		listKeyslots(args.config) // does not return
+	}
+	// "-rotate-key"
+	if args.rotateKey {
+		if flagSet.NArg() > 1 {
+			toggledlog.Fatal.Printf("Usage: %s -rotate-key [OPTIONS] CIPHERDIR\n", toggledlog.ProgramName)
+			os.Exit(ERREXIT_USAGE)
+		}
+		rotateKey(&args) // does not return
+	}
 	// Mount
 	// Check mountpoint
 	if flagSet.NArg() != 2 {
@@ -324,27 +570,33 @@ func main() {
 		toggledlog.Fatal.Printf(colorRed+"Invalid mountpoint: %v\n"+colorReset, err)
 		os.Exit(ERREXIT_MOUNTPOINT)
 	}
+	// Half of the files are encrypted with the new key while a key rotation
+	// is in progress
+	if _, err = os.Stat(rotateJournalPath(args.config)); err == nil {
+		toggledlog.Fatal.Printf(colorRed+"A key rotation was interrupted. Run \"%s -rotate-key\" "+
+			"to complete it before mounting."+colorReset, toggledlog.ProgramName)
+		os.Exit(ERREXIT_LOADCONF)
+	}
+	// Open control socket early so we can error out before asking the user
+	// for the password
+	if args.ctlsock != "" {
+		args.ctlsock, err = filepath.Abs(args.ctlsock)
+		if err == nil {
+			args.ctlsockListener, err = net.Listen("unix", args.ctlsock)
+		}
+		if err != nil {
+			toggledlog.Fatal.Printf(colorRed+"ctlsock: %v\n"+colorReset, err)
+			os.Exit(ERREXIT_CTLSOCK)
+		}
+	}
 	// Get master key
-	var masterkey []byte
-	var confFile *configfile.ConfFile
-	if args.masterkey != "" {
-		// "-masterkey"
-		toggledlog.Info.Printf("Using explicit master key.")
-		masterkey = parseMasterKey(args.masterkey)
-		toggledlog.Info.Printf("THE MASTER KEY IS VISIBLE VIA \"ps -auxwww\", ONLY USE THIS MODE FOR EMERGENCIES.")
-	} else if args.zerokey {
-		// "-zerokey"
-		toggledlog.Info.Printf("Using all-zero dummy master key.")
-		toggledlog.Info.Printf("ZEROKEY MODE PROVIDES NO SECURITY AT ALL AND SHOULD ONLY BE USED FOR TESTING.")
-		masterkey = make([]byte, cryptocore.KeyLen)
-	} else {
-		// Load master key from config file
-		masterkey, confFile = loadConfig(&args)
-		printMasterKey(masterkey)
+	masterkey, confFile := getMasterKey(&args)
+	if args.masterkey == "" && !args.zerokey {
+		printMasterKey(masterkey, confFile)
 	}
 	// Initialize FUSE server
 	toggledlog.Debug.Printf("cli args: %v", args)
-	srv := initFuseFrontend(masterkey, args, confFile)
+	srv, fs := initFuseFrontend(masterkey, args, confFile)
 	toggledlog.Info.Println(colorGreen + "Filesystem mounted and ready." + colorReset)
 	// We are ready - send USR1 signal to our parent and switch to syslog
 	if args.notifypid > 0 {
@@ -358,59 +610,71 @@ func main() {
 	}
 	// Wait for SIGINT in the background and unmount ourselves if we get it.
 	// This prevents a dangling "Transport endpoint is not connected" mountpoint.
-	handleSigint(srv, args.mountpoint)
+	handleSigint(srv, &args)
 	// Jump into server loop. Returns when it gets an umount request from the kernel.
 	srv.Serve()
+	if fs != nil {
+		fs.LogCtlSockStats()
+	}
+	// Closing the listener also deletes the socket file
+	if args.ctlsockListener != nil {
+		args.ctlsockListener.Close()
+	}
 	// main exits with code 0
 }
 
-// initFuseFrontend - initialize gocryptfs/fusefrontend
+// initFuseFrontend - initialize gocryptfs/fusefrontend. The forward mode
+// filesystem is returned as well, it is nil in reverse mode.
 // Calls os.Exit on errors
-func initFuseFrontend(key []byte, args argContainer, confFile *configfile.ConfFile) *fuse.Server {
-
-	// Reconciliate CLI and config file arguments into a Args struct that is passed to the
-	// filesystem implementation
-	frontendArgs := fusefrontend.Args{
-		Cipherdir:      args.cipherdir,
-		Masterkey:      key,
-		OpenSSL:        args.openssl,
-		PlaintextNames: args.plaintextnames,
-		DirIV:          args.diriv,
-		EMENames:       args.emenames,
-		GCMIV128:       args.gcmiv128,
-		LongNames:      args.longnames,
-	}
-	// confFile is nil when "-zerokey" or "-masterkey" was used
-	if confFile != nil {
-		// Settings from the config file override command line args
-		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
-		frontendArgs.DirIV = confFile.IsFeatureFlagSet(configfile.FlagDirIV)
-		frontendArgs.EMENames = confFile.IsFeatureFlagSet(configfile.FlagEMENames)
-		frontendArgs.GCMIV128 = confFile.IsFeatureFlagSet(configfile.FlagGCMIV128)
+func initFuseFrontend(key []byte, args argContainer, confFile *configfile.ConfFile) (*fuse.Server, *fusefrontend.FS) {
+	frontendArgs := initFrontendArgs(key, args, confFile)
+
+	var root nodefs.Node
+	var fs *fusefrontend.FS
+	var ctlsockFs ctlsock.Interface
+	if args.reverse {
+		// Reverse mode synthesizes gocryptfs.diriv files and cannot support
+		// the pre-DirIV CBC name encryption
+		if !frontendArgs.PlaintextNames && !frontendArgs.EMENames {
+			toggledlog.Fatal.Printf(colorRed + "Reverse mode requires EME filename encryption" + colorReset)
+			os.Exit(ERREXIT_USAGE)
+		}
+		// The plaintext files in CIPHERDIR change behind our back
+		if args.kernel_cache || args.writeback {
+			toggledlog.Fatal.Printf(colorRed + "-kernel_cache and -writeback are not supported in reverse mode" + colorReset)
+			os.Exit(ERREXIT_USAGE)
+		}
+		reverseFs := fusefrontend_reverse.NewFS(frontendArgs)
+		// Reverse mode has virtual files that share the inode number of their
+		// parent directory, so let go-fuse generate inode numbers.
+		pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: false}
+		root = pathfs.NewPathNodeFs(reverseFs, pathFsOpts).Root()
+		ctlsockFs = reverseFs.(ctlsock.Interface)
+	} else {
+		// The forward frontend implements the inode tree itself. Every
+		// directory node holds an open file descriptor.
+		raiseNofileLimit()
+		fs = fusefrontend.NewFS(frontendArgs)
+		var err error
+		root, err = fs.Root()
+		if err != nil {
+			toggledlog.Fatal.Printf("Cannot open cipherdir: %v", err)
+			os.Exit(ERREXIT_CIPHERDIR)
+		}
+		ctlsockFs = fs
 	}
-	// EMENames implies DirIV, both on the command line and in the config file.
-	if frontendArgs.EMENames {
-		frontendArgs.DirIV = true
+	// Both frontends implement ctlsock.Interface
+	if args.ctlsockListener != nil {
+		go ctlsock.Serve(args.ctlsockListener, ctlsockFs)
 	}
-	// PlainTexnames disables both EMENames and DirIV
-	if frontendArgs.PlaintextNames {
-		frontendArgs.DirIV = false
-		frontendArgs.EMENames = false
-	}
-	jsonBytes, _ := json.MarshalIndent(frontendArgs, "", "\t")
-	toggledlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
-
-	finalFs := fusefrontend.NewFS(frontendArgs)
-	pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: true}
-	pathFs := pathfs.NewPathNodeFs(finalFs, pathFsOpts)
 	fuseOpts := &nodefs.Options{
-		// These options are to be compatible with libfuse defaults,
-		// making benchmarking easier.
-		NegativeTimeout: time.Second,
-		AttrTimeout:     time.Second,
-		EntryTimeout:    time.Second,
+		// The defaults of one second are compatible with libfuse, making
+		// benchmarking easier.
+		NegativeTimeout: args.negative_timeout,
+		AttrTimeout:     args.attr_timeout,
+		EntryTimeout:    args.entry_timeout,
 	}
-	conn := nodefs.NewFileSystemConnector(pathFs.Root(), fuseOpts)
+	conn := nodefs.NewFileSystemConnector(root, fuseOpts)
 	var mOpts fuse.MountOptions
 	mOpts.AllowOther = false
 	if args.allow_other {
@@ -425,6 +689,19 @@ func initFuseFrontend(key []byte, args argContainer, confFile *configfile.ConfFi
 	mOpts.Options = append(mOpts.Options, "fsname="+args.cipherdir)
 	// Second column, "Type", will be shown as "fuse." + Name
 	mOpts.Name = "gocryptfs"
+	if args.reverse {
+		mOpts.Name += "-reverse"
+	}
+	// The encrypted view in reverse mode is always read-only
+	if args.ro || args.reverse {
+		mOpts.Options = append(mOpts.Options, "ro")
+	}
+	mOpts.EnableWriteback = args.writeback
+	// Forward fcntl and flock locks to the backing files so that they are
+	// seen by other mounts of the same CIPHERDIR. Reverse mode is read-only
+	// and keeps the kernel's local locking, as does OSX, which lacks the
+	// open file description locks we need.
+	mOpts.EnableLocks = !args.reverse && syscallcompat.HaveOFDLocks
 
 	srv, err := fuse.NewServer(conn.RawFS(), args.mountpoint, &mOpts)
 	if err != nil {
@@ -432,16 +709,92 @@ func initFuseFrontend(key []byte, args argContainer, confFile *configfile.ConfFi
 		os.Exit(ERREXIT_MOUNT)
 	}
 	srv.SetDebug(args.fusedebug)
+	if args.writeback && srv.KernelSettings().Flags&fuse.CAP_WRITEBACK_CACHE == 0 {
+		toggledlog.Warn.Printf("The kernel does not support writeback caching, continuing without")
+	}
 
 	// All FUSE file and directory create calls carry explicit permission
 	// information. We need an unrestricted umask to create the files and
 	// directories with the requested permissions.
 	syscall.Umask(0000)
 
-	return srv
+	return srv, fs
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
+// initFrontendArgs - reconciliate CLI and config file arguments into a Args
+// struct that is passed to the filesystem implementation
+func initFrontendArgs(key []byte, args argContainer, confFile *configfile.ConfFile) fusefrontend.Args {
+	frontendArgs := fusefrontend.Args{
+		Cipherdir:         args.cipherdir,
+		ConfigPath:        args.config,
+		Masterkey:         key,
+		OpenSSL:           args.openssl,
+		PlaintextNames:    args.plaintextnames,
+		DirIV:             args.diriv,
+		EMENames:          args.emenames,
+		GCMIV128:          args.gcmiv128,
+		LongNames:         args.longnames,
+		ReadOnly:          args.ro,
+		Xattr:             args.xattr,
+		KernelCache:       args.kernel_cache,
+		Writeback:         args.writeback,
+		CtlSock:           args.ctlsock != "",
+		PlainBS:           args.blocksize,
+		XChaCha20Poly1305: args.xchacha,
+		AESSIV:            args.aessiv,
+		HKDF:              args.hkdf,
+		HeaderV3:          args.headerv3,
+		Integrity:         args.integrity,
+		Compress:          args.compress,
+	}
+	// confFile is nil when "-zerokey" or "-masterkey" was used
+	if confFile != nil {
+		// Settings from the config file override command line args
+		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		frontendArgs.DirIV = confFile.IsFeatureFlagSet(configfile.FlagDirIV)
+		frontendArgs.EMENames = confFile.IsFeatureFlagSet(configfile.FlagEMENames)
+		frontendArgs.GCMIV128 = confFile.IsFeatureFlagSet(configfile.FlagGCMIV128)
+		frontendArgs.Xattr = confFile.IsFeatureFlagSet(configfile.FlagXattr)
+		frontendArgs.PlainBS = confFile.PlainBS()
+		frontendArgs.XChaCha20Poly1305 = confFile.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305)
+		frontendArgs.AESSIV = confFile.IsFeatureFlagSet(configfile.FlagAESSIV)
+		frontendArgs.HKDF = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
+		frontendArgs.HeaderV3 = confFile.IsFeatureFlagSet(configfile.FlagHeaderV3)
+		frontendArgs.Integrity = confFile.IsFeatureFlagSet(configfile.FlagIntegrity)
+		frontendArgs.Compress = confFile.IsFeatureFlagSet(configfile.FlagCompress)
+	}
+	// EMENames implies DirIV, both on the command line and in the config file.
+	if frontendArgs.EMENames {
+		frontendArgs.DirIV = true
+	}
+	// PlainTexnames disables both EMENames and DirIV
+	if frontendArgs.PlaintextNames {
+		frontendArgs.DirIV = false
+		frontendArgs.EMENames = false
+	}
+	jsonBytes, _ := json.MarshalIndent(frontendArgs, "", "\t")
+	toggledlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
+	return frontendArgs
+}
+
+// raiseNofileLimit - raise the soft limit on open files to the hard limit.
+// Every directory the kernel has cached holds a file descriptor.
+func raiseNofileLimit() {
+	var lim syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
+	if err != nil || lim.Cur >= lim.Max {
+		return
+	}
+	lim.Cur = lim.Max
+	err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim)
+	if err != nil {
+		toggledlog.Warn.Printf("Could not raise the open file limit: %v", err)
+		return
+	}
+	toggledlog.Debug.Printf("Raised the open file limit to %d", lim.Cur)
+}
+
+func handleSigint(srv *fuse.Server, args *argContainer) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
@@ -451,11 +804,14 @@ func handleSigint(srv *fuse.Server, mountpoint string) {
 		if err != nil {
 			toggledlog.Warn.Print(err)
 			toggledlog.Info.Printf("Trying lazy unmount")
-			cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
+			cmd := exec.Command("fusermount", "-u", "-z", args.mountpoint)
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 			cmd.Run()
 		}
+		if args.ctlsockListener != nil {
+			args.ctlsockListener.Close()
+		}
 		os.Exit(1)
 	}()
 }
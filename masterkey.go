@@ -2,16 +2,20 @@ package main
 
 import (
 	"encoding/hex"
+	"fmt"
 	"os"
 	"strings"
 
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/toggledlog"
 )
 
-// printMasterKey - remind the user that he should store the master key in
-// a safe place
-func printMasterKey(key []byte) {
+// printMasterKey - remind the user that they should store the master key in
+// a safe place, together with the options needed to mount the filesystem
+// described by config file "cf" without the config file
+func printMasterKey(key []byte, cf *configfile.ConfFile) {
 	h := hex.EncodeToString(key)
 	var hChunked string
 
@@ -26,6 +30,12 @@ func printMasterKey(key []byte) {
 		}
 	}
 
+	var options string
+	if flags := masterKeyFlags(cf); len(flags) > 0 {
+		options = fmt.Sprintf("Mounting with -masterkey also needs these options:\n\n    %s\n\n",
+			strings.Join(flags, " "))
+	}
+
 	toggledlog.Info.Printf(`
 Your master key is:
 
@@ -35,7 +45,54 @@ If the gocryptfs.conf file becomes corrupted or you ever forget your password,
 there is only one hope for recovery: The master key. Print it to a piece of
 paper and store it in a drawer.
 
-`, colorGrey+hChunked+colorReset)
+%s`, colorGrey+hChunked+colorReset, options)
+}
+
+// masterKeyFlags - get the command line options that reproduce the settings
+// of config file "cf" when mounting with "-masterkey"
+func masterKeyFlags(cf *configfile.ConfFile) []string {
+	var flags []string
+	isSet := cf.IsFeatureFlagSet
+	if isSet(configfile.FlagPlaintextNames) {
+		flags = append(flags, "-plaintextnames")
+	} else {
+		if !isSet(configfile.FlagDirIV) {
+			flags = append(flags, "-diriv=false")
+		}
+		if !isSet(configfile.FlagEMENames) {
+			flags = append(flags, "-emenames=false")
+		}
+		if !isSet(configfile.FlagLongNames) {
+			flags = append(flags, "-longnames=false")
+		}
+	}
+	if isSet(configfile.FlagXChaCha20Poly1305) {
+		flags = append(flags, "-xchacha")
+	} else if isSet(configfile.FlagAESSIV) {
+		flags = append(flags, "-aessiv")
+	} else if !isSet(configfile.FlagGCMIV128) {
+		flags = append(flags, "-gcmiv128=false")
+	}
+	if isSet(configfile.FlagHKDF) {
+		flags = append(flags, "-hkdf")
+	}
+	if bs := cf.PlainBS(); bs != contentenc.DefaultBS {
+		flags = append(flags, fmt.Sprintf("-blocksize=%dK", bs/1024))
+	}
+	// -integrity and -compress imply -headerv3
+	if isSet(configfile.FlagIntegrity) {
+		flags = append(flags, "-integrity")
+	}
+	if isSet(configfile.FlagCompress) {
+		flags = append(flags, "-compress")
+	}
+	if isSet(configfile.FlagHeaderV3) && !isSet(configfile.FlagIntegrity) && !isSet(configfile.FlagCompress) {
+		flags = append(flags, "-headerv3")
+	}
+	if isSet(configfile.FlagXattr) {
+		flags = append(flags, "-xattr")
+	}
+	return flags
 }
 
 // parseMasterKey - Parse a hex-encoded master key that was passed on the command line
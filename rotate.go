@@ -0,0 +1,720 @@
+package main
+
+// Offline master key rotation: decrypt every file, name, symlink target and
+// extended attribute with the old master key and encrypt it with a new one.
+//
+// Crash safety: the new config file is written before anything else, so the
+// new key is never lost. Every entry is converted by creating the new object
+// next to the old one and then deleting the old one. A "begin" record is
+// written to the journal before an entry is touched and a "done" record
+// afterwards. After a crash, "-rotate-key" picks up where it left off.
+// Once everything is converted, the new config file replaces the old one and
+// the journal is deleted. A journal without the new config file means that
+// we crashed between these two steps.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/merkletree"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/toggledlog"
+)
+
+const (
+	// Suffixes that are appended to the config file path
+	rotateJournalSuffix = ".rotate-journal"
+	rotateNewConfSuffix = ".rotate-new"
+	// Temporary file the new version of an entry is created as. Lives in the
+	// same directory as the entry so it can be renamed into place.
+	rotateTmpName = "gocryptfs.rotate.tmp"
+)
+
+// rotateJournalPath - journal file that belongs to config file "config".
+// If it exists, a key rotation has been interrupted and the filesystem must
+// not be mounted.
+func rotateJournalPath(config string) string {
+	return config + rotateJournalSuffix
+}
+
+// rotateRecord is written to the journal as one line of JSON
+type rotateRecord struct {
+	// "begin" or "done"
+	Op string
+	// New ciphertext path of the parent directory. Directories are renamed
+	// before their contents are converted, so the parent always has its new
+	// name.
+	Dir string
+	// Old and new ciphertext name of the entry
+	Old string
+	New string
+	// Old inode number of a regular file that has hard links. A resumed run
+	// uses it to link the remaining names to the converted file.
+	Ino uint64 `json:",omitempty"`
+}
+
+type rotateObj struct {
+	args fusefrontend.Args
+	// Content and name encryption with the old and the new key
+	oldEnc, newEnc     *contentenc.ContentEnc
+	oldNames, newNames *nametransform.NameTransform
+	// Extended attribute name encryption, see fusefrontend/xattr.go
+	oldXattrNames, newXattrNames *nametransform.NameTransform
+	// Journal, opened for appending
+	journal *os.File
+	// New ciphertext paths of the entries that have been converted
+	done map[string]bool
+	// Hard links: old inode number -> new ciphertext path
+	inodes map[uint64]string
+	// Absolute paths that belong to us and are not converted
+	skip map[string]bool
+	// Number of entries converted in this run
+	converted int
+}
+
+// abs - convert relative ciphertext path to absolute path
+func (ro *rotateObj) abs(relPath string) string {
+	return filepath.Join(ro.args.Cipherdir, relPath)
+}
+
+// loadJournal - read the journal file "path" and open it for appending.
+// A torn record at the end (crash during write) is dropped by rewriting the
+// journal. Returns the last "begin" record that has no "done" record, if any.
+func (ro *rotateObj) loadJournal(path string) (pending *rotateRecord, err error) {
+	var records []rotateRecord
+	fd, err := os.Open(path)
+	if err == nil {
+		dec := json.NewDecoder(fd)
+		for {
+			var rec rotateRecord
+			if dec.Decode(&rec) != nil {
+				break
+			}
+			records = append(records, rec)
+		}
+		fd.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Write the valid records to a new journal and atomically replace the old one
+	tmp := path + ".tmp"
+	fd, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(fd)
+	for i := range records {
+		rec := &records[i]
+		enc.Encode(rec)
+		switch rec.Op {
+		case "begin":
+			pending = rec
+		case "done":
+			ro.done[filepath.Join(rec.Dir, rec.New)] = true
+			if rec.Ino != 0 {
+				ro.inodes[rec.Ino] = filepath.Join(rec.Dir, rec.New)
+			}
+			pending = nil
+		}
+	}
+	err = fd.Sync()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	fd.Close()
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return nil, err
+	}
+	ro.journal, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	return pending, err
+}
+
+// record - append a record to the journal. "begin" records are synced to
+// disk before the entry is touched. "ino" is the old inode number of a
+// regular file with hard links, or zero.
+func (ro *rotateObj) record(op string, dir string, oldName string, newName string, ino uint64) error {
+	js, _ := json.Marshal(rotateRecord{Op: op, Dir: dir, Old: oldName, New: newName, Ino: ino})
+	_, err := ro.journal.Write(append(js, '\n'))
+	if err != nil {
+		return err
+	}
+	if op == "done" {
+		ro.done[filepath.Join(dir, newName)] = true
+		if ino != 0 {
+			ro.inodes[ino] = filepath.Join(dir, newName)
+		}
+		ro.converted++
+		return nil
+	}
+	return ro.journal.Sync()
+}
+
+// decryptsWithNewKey - check if regular file "absPath" is already encrypted
+// with the new key. Version 3 headers are authenticated and decide on their
+// own. Version 2 headers are not, and file holes decrypt with any key, so
+// the first block that is not a hole is checked. A file that only consists
+// of holes is reported as not converted, converting it again is harmless.
+func (ro *rotateObj) decryptsWithNewKey(absPath string) bool {
+	fd, err := os.Open(absPath)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	headerLen := ro.newEnc.HeaderLen()
+	buf := make([]byte, headerLen)
+	n, err := fd.ReadAt(buf, 0)
+	if uint64(n) < headerLen {
+		return false
+	}
+	toggledlog.Warn.Enabled = false
+	defer func() { toggledlog.Warn.Enabled = true }()
+	header, err := ro.newEnc.DecryptHeader(buf)
+	if err != nil {
+		return false
+	}
+	if ro.newEnc.HeaderV3() {
+		return true
+	}
+	cipherBS := ro.newEnc.CipherBS()
+	buf = make([]byte, cipherBS)
+	zeroBlock := make([]byte, cipherBS)
+	for blockNo := uint64(0); ; blockNo++ {
+		n, err = fd.ReadAt(buf, int64(ro.newEnc.BlockNoToCipherOff(blockNo)))
+		if n == 0 || (err != nil && err != io.EOF) {
+			return false
+		}
+		if uint64(n) == cipherBS && bytes.Equal(buf, zeroBlock) {
+			continue
+		}
+		_, err = ro.newEnc.DecryptFileBlock(buf[:n], blockNo, header.Id)
+		return err == nil
+	}
+}
+
+// recover - clean up after the entry that was being converted when the
+// previous run was interrupted.
+func (ro *rotateObj) recover(rec *rotateRecord) error {
+	dir := ro.abs(rec.Dir)
+	os.Remove(filepath.Join(dir, rotateTmpName))
+	oldPath := filepath.Join(dir, rec.Old)
+	newPath := filepath.Join(dir, rec.New)
+	if rec.Old == rec.New {
+		// Plaintext names: the new file replaced the old one if it decrypts
+		// with the new key. Only regular files are converted in place.
+		if ro.decryptsWithNewKey(oldPath) {
+			return ro.record("done", rec.Dir, rec.Old, rec.New, rec.Ino)
+		}
+		return nil
+	}
+	if _, err := os.Lstat(oldPath); err == nil {
+		// The old entry still exists. Delete the (maybe incomplete) new entry,
+		// it is converted again when we walk the directory. A directory
+		// cannot exist under both names as it is renamed atomically.
+		syscall.Unlink(newPath)
+		syscall.Unlink(newPath + nametransform.LongNameSuffix)
+		return nil
+	}
+	// The new entry is complete, only the old .name file may be left over
+	if nametransform.IsLongContent(rec.Old) {
+		syscall.Unlink(oldPath + nametransform.LongNameSuffix)
+	}
+	// The attributes of directories and device nodes are converted after
+	// the rename
+	if fi, err := os.Lstat(newPath); err == nil && fi.Mode()&os.ModeSymlink == 0 && ro.args.Xattr {
+		err = ro.reencryptXattrs(newPath, newPath)
+		if err != nil {
+			return err
+		}
+	}
+	return ro.record("done", rec.Dir, rec.Old, rec.New, rec.Ino)
+}
+
+// writeFileAtomic - write "content" to "path" via a temporary file
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp := filepath.Join(filepath.Dir(path), rotateTmpName)
+	os.Remove(tmp)
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(content)
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reencryptFile - decrypt regular file "oldPath" with the old key and write
+// it, encrypted with the new key, to "tmpPath". File holes and encrypted
+// extended attributes are preserved.
+func (ro *rotateObj) reencryptFile(oldPath string, tmpPath string, fi os.FileInfo) error {
+	in, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	os.Remove(tmpPath)
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := make([]byte, ro.oldEnc.HeaderLen())
+	n, err := in.ReadAt(buf, 0)
+	if n == 0 && err == io.EOF {
+		// Empty file, no header
+	} else if err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	} else {
+		oldHeader, err := ro.oldEnc.DecryptHeader(buf)
+		if err != nil {
+			return err
+		}
+		newHeader := ro.newEnc.NewHeader()
+		newHeader.PlainSize = oldHeader.PlainSize
+		_, err = out.WriteAt(ro.newEnc.EncryptHeader(newHeader), 0)
+		if err != nil {
+			return err
+		}
+		cipherBS := ro.oldEnc.CipherBS()
+		buf = make([]byte, cipherBS)
+		zeroBlock := make([]byte, cipherBS)
+		// Integrity mode: verify the old ciphertext against the old root,
+		// so that stale or reordered blocks are not authenticated by the
+		// new root, and build the hash tree over the new ciphertext
+		var oldTree, tree *merkletree.Tree
+		if oldHeader.Root != nil {
+			oldTree = &merkletree.Tree{}
+		}
+		if ro.newEnc.Integrity() {
+			tree = &merkletree.Tree{}
+		}
+		treeEnd := ro.newEnc.PlainSizeToCipherSize(oldHeader.PlainSize)
+		addLeaf := func(t *merkletree.Tree, blockNo uint64, off int64, block []byte) {
+			if t != nil && uint64(off) < treeEnd {
+				block = block[:contentenc.MinUint64(uint64(len(block)), treeEnd-uint64(off))]
+				t.Set(blockNo, merkletree.Leaf(blockNo, block))
+			}
+		}
+		for blockNo := uint64(0); ; blockNo++ {
+			off := int64(ro.oldEnc.BlockNoToCipherOff(blockNo))
+			n, err := in.ReadAt(buf, off)
+			if n == 0 && err == io.EOF {
+				break
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if uint64(n) == cipherBS && bytes.Equal(buf, zeroBlock) {
+				// File hole, leave it sparse
+				addLeaf(oldTree, blockNo, off, zeroBlock)
+				addLeaf(tree, blockNo, off, zeroBlock)
+				continue
+			}
+			addLeaf(oldTree, blockNo, off, buf[:n])
+			plaintext, err := ro.oldEnc.DecryptFileBlock(buf[:n], blockNo, oldHeader.Id)
+			if err != nil {
+				return fmt.Errorf("block #%d: %v", blockNo, err)
+			}
+			ciphertext := ro.newEnc.EncryptFileBlock(plaintext, blockNo, newHeader.Id)
+			_, err = out.WriteAt(ciphertext, off)
+			if err != nil {
+				return err
+			}
+			addLeaf(tree, blockNo, off, ciphertext)
+		}
+		if oldTree != nil && !bytes.Equal(oldTree.Root(), oldHeader.Root) {
+			return fmt.Errorf("hash tree root mismatch: stale, reordered or missing blocks")
+		}
+		if tree != nil {
+			newHeader.Root = tree.Root()
+			_, err = out.WriteAt(ro.newEnc.EncryptHeader(newHeader), 0)
+			if err != nil {
+				return err
+			}
+		}
+		// Extend the file if it ends in a hole
+		err = out.Truncate(fi.Size())
+		if err != nil {
+			return err
+		}
+	}
+	// Setting attributes needs write permission, so this happens before the
+	// file gets its final permissions
+	if ro.args.Xattr {
+		err = ro.reencryptXattrs(oldPath, tmpPath)
+		if err != nil {
+			return err
+		}
+	}
+	// Preserve metadata
+	err = out.Chmod(fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		// Only works as root, ignore errors
+		out.Chown(int(st.Uid), int(st.Gid))
+	}
+	err = out.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(tmpPath, fi.ModTime(), fi.ModTime())
+}
+
+// reencryptXattrs - re-encrypt the encrypted extended attributes of "src"
+// with the new key and store them on "dst". With src == dst, the attributes
+// are converted in place: the new attribute is written before the old one is
+// removed, and attributes that already decrypt with the new key are left
+// alone, so an interrupted conversion can be repeated.
+func (ro *rotateObj) reencryptXattrs(src string, dst string) error {
+	id, err := syscallcompat.Getxattr(src, fusefrontend.XattrIDName)
+	if err == syscall.ENODATA {
+		// The ID is created together with the first attribute
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if src != dst {
+		err = syscallcompat.Setxattr(dst, fusefrontend.XattrIDName, id, 0)
+		if err != nil {
+			return err
+		}
+	}
+	list, err := syscallcompat.Listxattr(src)
+	if err != nil {
+		return err
+	}
+	for _, a := range bytes.Split(list, []byte{0}) {
+		cAttr := string(a)
+		if !strings.HasPrefix(cAttr, fusefrontend.XattrStorePrefix) || cAttr == fusefrontend.XattrIDName {
+			continue
+		}
+		cData, err := syscallcompat.Getxattr(src, cAttr)
+		if err != nil {
+			return err
+		}
+		toggledlog.Warn.Enabled = false
+		_, err = fusefrontend.XattrDecryptValue(ro.newEnc, cData, id, cAttr)
+		toggledlog.Warn.Enabled = true
+		if err == nil {
+			// Already converted
+			if src != dst {
+				err = syscallcompat.Setxattr(dst, cAttr, cData, 0)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		data, err := fusefrontend.XattrDecryptValue(ro.oldEnc, cData, id, cAttr)
+		if err != nil {
+			return fmt.Errorf("xattr %q: %v", cAttr, err)
+		}
+		attr, err := ro.oldXattrNames.DecryptName(cAttr[len(fusefrontend.XattrStorePrefix):], fusefrontend.XattrNameIV)
+		if err != nil {
+			return fmt.Errorf("xattr %q: cannot decrypt name: %v", cAttr, err)
+		}
+		newCAttr := fusefrontend.XattrStorePrefix + ro.newXattrNames.EncryptName(attr, fusefrontend.XattrNameIV)
+		cData = fusefrontend.XattrEncryptValue(ro.newEnc, data, id, newCAttr)
+		err = syscallcompat.Setxattr(dst, newCAttr, cData, 0)
+		if err != nil {
+			return err
+		}
+		if src == dst && newCAttr != cAttr {
+			err = syscallcompat.Removexattr(src, cAttr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reencryptSymlink - create a copy of symlink "oldPath" at "tmpPath" with
+// the target encrypted using the new key
+func (ro *rotateObj) reencryptSymlink(oldPath string, tmpPath string, fi os.FileInfo) error {
+	cTarget, err := os.Readlink(oldPath)
+	if err != nil {
+		return err
+	}
+	// Since gocryptfs v0.5 symlinks are encrypted like file contents (GCM)
+	cBinTarget, err := base64.URLEncoding.DecodeString(cTarget)
+	if err != nil {
+		return err
+	}
+	target, err := ro.oldEnc.DecryptBlock(cBinTarget, 0, nil)
+	if err != nil {
+		return err
+	}
+	cTarget = base64.URLEncoding.EncodeToString(ro.newEnc.EncryptBlock(target, 0, nil))
+	os.Remove(tmpPath)
+	err = os.Symlink(cTarget, tmpPath)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(tmpPath, int(st.Uid), int(st.Gid))
+	}
+	return nil
+}
+
+// convert - convert the entry "cName" in directory "relDir" (new ciphertext
+// path) from the old to the new key. Returns the new name of the entry.
+func (ro *rotateObj) convert(relDir string, cName string, fi os.FileInfo, iv []byte) (newName string, err error) {
+	dir := ro.abs(relDir)
+	oldPath := filepath.Join(dir, cName)
+	newName = cName
+	var newNameFull string
+	if !ro.args.PlaintextNames {
+		cNameFull := cName
+		if nametransform.IsLongContent(cName) {
+			cNameFull, err = nametransform.ReadLongName(oldPath)
+			if err != nil {
+				return "", err
+			}
+		}
+		plainName, err := ro.oldNames.DecryptName(cNameFull, iv)
+		if err != nil {
+			return "", fmt.Errorf("cannot decrypt name: %v", err)
+		}
+		newNameFull = ro.newNames.EncryptName(plainName, iv)
+		newName = newNameFull
+		if ro.args.LongNames && len(newName) > syscall.NAME_MAX {
+			newName = nametransform.HashLongName(newName)
+		}
+	}
+	newPath := filepath.Join(dir, newName)
+	tmpPath := filepath.Join(dir, rotateTmpName)
+	st, _ := fi.Sys().(*syscall.Stat_t)
+	// The link count drops as the other hard links are converted
+	var ino uint64
+	if fi.Mode().IsRegular() && st != nil && (st.Nlink > 1 || ro.inodes[st.Ino] != "") {
+		ino = st.Ino
+	}
+	err = ro.record("begin", relDir, cName, newName, ino)
+	if err != nil {
+		return "", err
+	}
+	if !ro.args.PlaintextNames && nametransform.IsLongContent(newName) {
+		err = writeFileAtomic(newPath+nametransform.LongNameSuffix, []byte(newNameFull), 0600)
+		if err != nil {
+			return "", err
+		}
+	}
+	// With plaintext names, only the content of regular files changes
+	needsCopy := fi.Mode().IsRegular() || (fi.Mode()&os.ModeSymlink != 0 && !ro.args.PlaintextNames)
+	if needsCopy {
+		if ino != 0 && ro.inodes[ino] != "" {
+			// Another hard link to this file has already been converted. The
+			// link count may have dropped to one in the meantime.
+			os.Remove(tmpPath)
+			err = os.Link(ro.abs(ro.inodes[ino]), tmpPath)
+		} else if fi.Mode().IsRegular() {
+			err = ro.reencryptFile(oldPath, tmpPath, fi)
+		} else {
+			err = ro.reencryptSymlink(oldPath, tmpPath, fi)
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+		err = os.Rename(tmpPath, newPath)
+		if err != nil {
+			return "", err
+		}
+		if newName != cName {
+			err = syscall.Unlink(oldPath)
+		}
+	} else {
+		// Directories and device nodes only need a new name, their
+		// attributes are converted in place
+		if newName != cName {
+			err = os.Rename(oldPath, newPath)
+		}
+		if err == nil && ro.args.Xattr {
+			err = ro.reencryptXattrs(newPath, newPath)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if nametransform.IsLongContent(cName) && newName != cName {
+		err = syscall.Unlink(oldPath + nametransform.LongNameSuffix)
+		if err != nil && err != syscall.ENOENT {
+			return "", err
+		}
+	}
+	return newName, ro.record("done", relDir, cName, newName, ino)
+}
+
+// walk - recursively convert directory "relDir" (new ciphertext path)
+func (ro *rotateObj) walk(relDir string) error {
+	dir := ro.abs(relDir)
+	var iv []byte
+	var err error
+	if ro.args.DirIV {
+		// gocryptfs.diriv is random and does not depend on the key, it stays
+		iv, err = nametransform.ReadDirIV(dir)
+		if err != nil {
+			return err
+		}
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := fd.Readdir(-1)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		cName := fi.Name()
+		relPath := filepath.Join(relDir, cName)
+		if ro.skip[filepath.Join(dir, cName)] || cName == rotateTmpName {
+			continue
+		}
+		if ro.args.DirIV && cName == nametransform.DirIVFilename {
+			continue
+		}
+		if !ro.args.PlaintextNames && nametransform.NameType(cName) == nametransform.LongNameFilename {
+			// Converted together with the content file
+			continue
+		}
+		if !ro.done[relPath] {
+			newName, err := ro.convert(relDir, cName, fi, iv)
+			if err != nil {
+				return fmt.Errorf("%s: %v", relPath, err)
+			}
+			relPath = filepath.Join(relDir, newName)
+		}
+		if fi.IsDir() {
+			err = ro.walk(relPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rotateKey - generate a new master key and re-encrypt CIPHERDIR with it.
+// Resumes an interrupted rotation if the journal exists.
+func rotateKey(args *argContainer) {
+	oldKey, confFile, pw := unlockConfig(args)
+	frontendArgs := initFrontendArgs(oldKey, *args, confFile)
+	if !frontendArgs.DirIV && !frontendArgs.PlaintextNames {
+		toggledlog.Fatal.Printf(colorRed + "Key rotation is not supported for filesystems " +
+			"created by gocryptfs v0.4 or earlier" + colorReset)
+		os.Exit(ERREXIT_ROTATE)
+	}
+	newConfPath := args.config + rotateNewConfSuffix
+	journalPath := rotateJournalPath(args.config)
+	// The new config file is written first so the new key is never lost
+	var newKey []byte
+	_, err := os.Stat(newConfPath)
+	if err != nil {
+		if _, err := os.Stat(journalPath); err == nil {
+			// The journal is created after the new config file and deleted
+			// after the new config file has replaced the old one. We crashed
+			// in between: everything is converted and "oldKey" is the new key.
+			toggledlog.Info.Printf("Key rotation was already complete, removing the leftover journal")
+			err = os.Remove(journalPath)
+			if err != nil {
+				toggledlog.Fatal.Println(err)
+				os.Exit(ERREXIT_ROTATE)
+			}
+			os.Remove(journalPath + ".tmp")
+			printMasterKey(oldKey, confFile)
+			os.Exit(0)
+		}
+	}
+	if err == nil {
+		toggledlog.Info.Printf("Resuming interrupted key rotation")
+		newKey, _, err = configfile.LoadConfFile(newConfPath, pw)
+		if err != nil {
+			toggledlog.Fatal.Printf(colorRed+"Could not load %s: %v"+colorReset, newConfPath, err)
+			os.Exit(ERREXIT_ROTATE)
+		}
+	} else {
+		newKey = cryptocore.RandBytes(cryptocore.KeyLen)
+		dropped := confFile.ResetKeyslots(newKey, pw)
+		for _, label := range dropped {
+			toggledlog.Info.Printf(colorYellow+"Keyslot %q will be removed, its password is not known. "+
+				"Re-add it using -keyslot-add."+colorReset, label)
+		}
+		confFile.SetFilename(newConfPath)
+		// Left over if we crashed while writing the new config file
+		os.Remove(newConfPath + ".tmp")
+		err = confFile.WriteFile()
+		if err != nil {
+			toggledlog.Fatal.Printf(colorRed+"Could not write %s: %v"+colorReset, newConfPath, err)
+			os.Exit(ERREXIT_ROTATE)
+		}
+	}
+	oldCore := cryptocore.New(oldKey, frontendArgs.AEADType(), frontendArgs.GCMIV128, frontendArgs.HKDF)
+	newCore := cryptocore.New(newKey, frontendArgs.AEADType(), frontendArgs.GCMIV128, frontendArgs.HKDF)
+	ro := rotateObj{
+		args:     frontendArgs,
+		oldEnc:   contentenc.New(oldCore, frontendArgs.PlainBS, frontendArgs.HeaderV3, frontendArgs.Integrity, frontendArgs.Compress),
+		newEnc:   contentenc.New(newCore, frontendArgs.PlainBS, frontendArgs.HeaderV3, frontendArgs.Integrity, frontendArgs.Compress),
+		oldNames: nametransform.New(oldCore, frontendArgs.EMENames, frontendArgs.LongNames),
+		newNames: nametransform.New(newCore, frontendArgs.EMENames, frontendArgs.LongNames),
+		done:     make(map[string]bool),
+		inodes:   make(map[uint64]string),
+		skip:     make(map[string]bool),
+	}
+	if frontendArgs.Xattr {
+		ro.oldXattrNames = nametransform.New(oldCore, true, false)
+		ro.newXattrNames = nametransform.New(newCore, true, false)
+	}
+	for _, p := range []string{args.config, args.config + ".tmp", newConfPath, newConfPath + ".tmp",
+		journalPath, journalPath + ".tmp"} {
+		abs, _ := filepath.Abs(p)
+		ro.skip[abs] = true
+	}
+	pending, err := ro.loadJournal(journalPath)
+	if err == nil && pending != nil {
+		err = ro.recover(pending)
+	}
+	if err == nil {
+		err = ro.walk("")
+	}
+	if err != nil {
+		toggledlog.Fatal.Printf(colorRed+"Key rotation failed: %v\n"+
+			"Fix the problem and run -rotate-key again to resume."+colorReset, err)
+		os.Exit(ERREXIT_ROTATE)
+	}
+	ro.journal.Close()
+	// Everything is converted - activate the new config
+	err = os.Rename(newConfPath, args.config)
+	if err != nil {
+		toggledlog.Fatal.Println(err)
+		os.Exit(ERREXIT_ROTATE)
+	}
+	os.Remove(journalPath)
+	toggledlog.Info.Printf("Key rotation complete, %d entries converted.", ro.converted)
+	printMasterKey(newKey, confFile)
+	os.Exit(0)
+}
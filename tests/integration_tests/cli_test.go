@@ -3,11 +3,19 @@ package integration_tests
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
@@ -29,10 +37,14 @@ func TestInit(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = os.Stat(dir + configfile.ConfDefaultName)
+	_, cf, err := configfile.LoadConfFile(dir+configfile.ConfDefaultName, "test")
 	if err != nil {
 		t.Fatal(err)
 	}
+	// New filesystems use HKDF by default
+	if !cf.IsFeatureFlagSet(configfile.FlagHKDF) {
+		t.Error("HKDF flag is not set")
+	}
 
 	// Test -passwd
 	cmd2 := exec.Command(test_helpers.GocryptfsBinary, "-passwd", "-extpass", "echo test", dir)
@@ -118,3 +130,723 @@ func TestInitPlaintextNames(t *testing.T) {
 		t.Error("FlagEMENames and FlagDirIV should be not set")
 	}
 }
+
+// Test -init -blocksize: the block size is stored in the config and used for
+// the file contents
+func TestInitBlockSize(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestInitBlockSize", "-blocksize", "64K")
+	_, cf, err := configfile.LoadConfFile(dir+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.PlainBS() != 64*1024 {
+		t.Errorf("wrong block size %d", cf.PlainBS())
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	err = ioutil.WriteFile(mnt+"file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content2, err := ioutil.ReadFile(mnt + "file")
+	if err != nil || string(content) != string(content2) {
+		t.Fatalf("reading back failed: %v", err)
+	}
+	// Two blocks of 64 KiB plus 32 bytes overhead each, plus the header
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && e.Name() != configfile.ConfDefaultName &&
+			e.Name() != nametransform.DirIVFilename && e.Size() != 100000+2*32+18 {
+			t.Errorf("wrong ciphertext size %d", e.Size())
+		}
+	}
+}
+
+// Test -init -xchacha: file contents are encrypted with XChaCha20-Poly1305,
+// which has 24-byte nonces
+func TestInitXChaCha(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestInitXChaCha", "-xchacha")
+	_, cf, err := configfile.LoadConfFile(dir+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		t.Error("XChaCha20Poly1305 flag is not set")
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	content := []byte("hello xchacha")
+	err = ioutil.WriteFile(mnt+"file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content2, err := ioutil.ReadFile(mnt + "file")
+	if err != nil || string(content) != string(content2) {
+		t.Fatalf("reading back failed: %q %v", content2, err)
+	}
+	// Header, 24 bytes nonce, content, 16 bytes tag
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && e.Name() != configfile.ConfDefaultName &&
+			e.Name() != nametransform.DirIVFilename && e.Size() != int64(18+24+len(content)+16) {
+			t.Errorf("wrong ciphertext size %d", e.Size())
+		}
+	}
+}
+
+// Test -init -aessiv: mounting, writing and reading with AES-SIV
+func TestInitAESSIV(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestInitAESSIV", "-aessiv")
+	_, cf, err := configfile.LoadConfFile(dir+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		t.Error("AESSIV flag is not set")
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	err = ioutil.WriteFile(mnt+"file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content2, err := ioutil.ReadFile(mnt + "file")
+	if err != nil || string(content) != string(content2) {
+		t.Fatalf("reading back failed: %v", err)
+	}
+}
+
+// Test -init -headerv3: the file size comes from the authenticated header
+func TestInitHeaderV3(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestInitHeaderV3", "-headerv3")
+	_, cf, err := configfile.LoadConfFile(dir+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagHeaderV3) {
+		t.Error("HeaderV3 flag is not set")
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	err = ioutil.WriteFile(mnt+"file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{5000, 9000, 0, 4096} {
+		err = os.Truncate(mnt+"file", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(mnt + "file")
+		if err != nil || fi.Size() != size {
+			t.Fatalf("wrong size after truncate to %d: %v %v", size, fi, err)
+		}
+		content2, err := ioutil.ReadFile(mnt + "file")
+		if err != nil || int64(len(content2)) != size {
+			t.Fatalf("reading back failed: %d bytes, %v", len(content2), err)
+		}
+	}
+	test_helpers.Unmount(mnt)
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-q", "-extpass", "echo test", dir).Output()
+	if err != nil {
+		t.Errorf("fsck failed: %v\n%s", err, out)
+	}
+}
+
+// Test that the size of a file with a corrupt version 3 header is not
+// calculated from the ciphertext size
+func TestHeaderV3Corrupt(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestHeaderV3Corrupt", "-headerv3", "-plaintextnames")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := ioutil.WriteFile(mnt+"file", []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+	// Flip a bit in the encrypted metadata
+	c, err := ioutil.ReadFile(dir + "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c[40] ^= 1
+	err = ioutil.WriteFile(dir+"file", c, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	_, err = os.Stat(mnt + "file")
+	if err == nil {
+		t.Error("stat on the corrupt file should have failed")
+	}
+}
+
+// Test -init -integrity: a block that is replaced by an older version of
+// itself must not be accepted
+func TestInitIntegrity(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestInitIntegrity", "-integrity")
+	_, cf, err := configfile.LoadConfFile(dir+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagIntegrity) || !cf.IsFeatureFlagSet(configfile.FlagHeaderV3) {
+		t.Errorf("wrong feature flags: %v", cf.FeatureFlags)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err = ioutil.WriteFile(mnt+"file", make([]byte, 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+
+	// Find the ciphertext file and save its content
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFile string
+	for _, e := range entries {
+		if e.Mode().IsRegular() && e.Name() != configfile.ConfDefaultName &&
+			e.Name() != nametransform.DirIVFilename {
+			cFile = dir + e.Name()
+		}
+	}
+	oldCiphertext, err := ioutil.ReadFile(cFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the first block
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	fd, err := os.OpenFile(mnt+"file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fd.WriteAt([]byte("new data"), 0)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+
+	// Roll back the content blocks but keep the new header. 10000 bytes are
+	// three blocks with 32 bytes of overhead each.
+	newCiphertext, err := ioutil.ReadFile(cFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerLen := len(newCiphertext) - (10000 + 3*32)
+	copy(newCiphertext[headerLen:], oldCiphertext[headerLen:])
+	err = ioutil.WriteFile(cFile, newCiphertext, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-q", "-extpass", "echo test", dir).Output()
+	if !strings.Contains(string(out), `"Problem":"hashtree"`) {
+		t.Errorf("fsck did not find the hash tree mismatch: %s", out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	_, err = ioutil.ReadFile(mnt + "file")
+	if err == nil {
+		t.Error("reading the rolled back file should have failed")
+	}
+}
+
+// Test -init -compress: compressible and incompressible data must survive
+// overwrites and truncation
+func TestInitCompress(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestInitCompress", "-compress", "-blocksize=64K")
+	_, cf, err := configfile.LoadConfFile(dir+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagCompress) || !cf.IsFeatureFlagSet(configfile.FlagHeaderV3) {
+		t.Errorf("wrong feature flags: %v", cf.FeatureFlags)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	text := []byte(strings.Repeat("2016-10-16 12:00:00 INFO request served\n", 10000))
+	random := cryptocore.RandBytes(100000)
+	content := append(append([]byte{}, text...), random...)
+	err = ioutil.WriteFile(mnt+"file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overwrite the text with more text and cut off part of the random data
+	fd, err := os.OpenFile(mnt+"file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fd.WriteAt([]byte("overwritten"), 1000)
+	if err == nil {
+		err = fd.Truncate(int64(len(text) + 5000))
+	}
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(content[1000:], "overwritten")
+	content = content[:len(text)+5000]
+	fi, err := os.Stat(mnt + "file")
+	if err != nil || fi.Size() != int64(len(content)) {
+		t.Fatalf("wrong size: %v %v", fi, err)
+	}
+	content2, err := ioutil.ReadFile(mnt + "file")
+	if err != nil || !bytes.Equal(content, content2) {
+		t.Fatalf("reading back failed: %v", err)
+	}
+	test_helpers.Unmount(mnt)
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-q", "-extpass", "echo test", dir).Output()
+	if err != nil {
+		t.Errorf("fsck failed: %v\n%s", err, out)
+	}
+}
+
+// Test -fsck on a good and on a corrupted filesystem
+func TestFsck(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestFsck")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := ioutil.WriteFile(mnt+"file", make([]byte, 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+
+	fsck := func() ([]byte, error) {
+		return exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-q", "-extpass", "echo test", dir).Output()
+	}
+	out, err := fsck()
+	if err != nil {
+		t.Fatalf("fsck on a good filesystem failed: %v\n%s", err, out)
+	}
+
+	// Corrupt the second block of the only file
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || e.Size() < 5000 {
+			continue
+		}
+		f, err := os.OpenFile(dir+e.Name(), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{0xff, 0xff}, 4200)
+		f.Close()
+	}
+	out, err = fsck()
+	if err == nil {
+		t.Fatal("fsck on a corrupted filesystem should have failed")
+	}
+	if !strings.Contains(string(out), `"Problem":"block"`) {
+		t.Errorf("corrupt block not reported: %s", out)
+	}
+}
+
+// Test -ctlsock: encrypt and decrypt paths on a live mount
+func TestCtlSock(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestCtlSock")
+	sock := test_helpers.TmpDir + "TestCtlSock.sock"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-ctlsock", sock)
+	defer test_helpers.Unmount(mnt)
+	longName := strings.Repeat("x", 200)
+	err := os.MkdirAll(mnt+"a/b", 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"a/b/"+longName, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainPath := "a/b/" + longName
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: plainPath})
+	if resp.ErrNo != 0 {
+		t.Fatalf("EncryptPath failed: %s", resp.ErrText)
+	}
+	cipherPath := resp.Result
+	if !nametransform.IsLongContent(filepath.Base(cipherPath)) {
+		t.Errorf("expected a hashed long name, got %q", cipherPath)
+	}
+	if _, err = os.Stat(dir + cipherPath); err != nil {
+		t.Errorf("EncryptPath result does not exist in CIPHERDIR: %v", err)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{DecryptPath: cipherPath})
+	if resp.ErrNo != 0 {
+		t.Fatalf("DecryptPath failed: %s", resp.ErrText)
+	}
+	if resp.Result != plainPath {
+		t.Errorf("DecryptPath: want %q, got %q", plainPath, resp.Result)
+	}
+	// Paths that do not exist in CIPHERDIR cannot be decrypted
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{DecryptPath: "does/not/exist"})
+	if resp.ErrNo == 0 {
+		t.Errorf("DecryptPath of a non-existing path should have failed, got %q", resp.Result)
+	}
+}
+
+// Test -ro: reading works, modifications fail with EROFS
+func TestRo(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestRo")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := ioutil.WriteFile(mnt+"file", []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-ro")
+	defer test_helpers.Unmount(mnt)
+	content, err := ioutil.ReadFile(mnt + "file")
+	if err != nil || string(content) != "content" {
+		t.Errorf("reading failed: %q, %v", content, err)
+	}
+	isErofs := func(err error) bool {
+		pe, ok := err.(*os.PathError)
+		if !ok {
+			le, ok := err.(*os.LinkError)
+			return ok && le.Err == syscall.EROFS
+		}
+		return pe.Err == syscall.EROFS
+	}
+	_, err = os.OpenFile(mnt+"file", os.O_WRONLY, 0)
+	if !isErofs(err) {
+		t.Errorf("open for writing: want EROFS, got %v", err)
+	}
+	err = ioutil.WriteFile(mnt+"file2", nil, 0600)
+	if !isErofs(err) {
+		t.Errorf("create: want EROFS, got %v", err)
+	}
+	err = os.Mkdir(mnt+"dir", 0700)
+	if !isErofs(err) {
+		t.Errorf("mkdir: want EROFS, got %v", err)
+	}
+	err = os.Rename(mnt+"file", mnt+"file3")
+	if !isErofs(err) {
+		t.Errorf("rename: want EROFS, got %v", err)
+	}
+	err = os.Remove(mnt + "file")
+	if !isErofs(err) {
+		t.Errorf("unlink: want EROFS, got %v", err)
+	}
+}
+
+// Test -rotate-key: contents, long names and symlinks survive and the
+// config file holds a new key
+func TestRotateKey(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestRotateKey")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	longName := strings.Repeat("l", 200)
+	err := os.Mkdir(mnt+"dir", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"file", "dir/" + longName} {
+		err = ioutil.WriteFile(mnt+f, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Symlink("dir/"+longName, mnt+"link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+	cf1, err := configfile.Load(dir + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-rotate-key", "-q", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("rotate-key failed: %v\n%s", err, out)
+	}
+	cf2, err := configfile.Load(dir + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cf1.EncryptedKey) == string(cf2.EncryptedKey) {
+		t.Error("config file has not been rewritten")
+	}
+	if test_helpers.VerifyExistence(dir + configfile.ConfDefaultName + ".rotate-journal") {
+		t.Error("journal file has not been deleted")
+	}
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	for _, f := range []string{"file", "dir/" + longName, "link"} {
+		c, err := ioutil.ReadFile(mnt + f)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(c) != string(content) {
+			t.Errorf("%s: content mismatch after key rotation", f)
+		}
+	}
+}
+
+// Test -rotate-key after a crash between activating the new config file and
+// deleting the journal. The rotation is complete and must not be started
+// again with yet another key.
+func TestRotateKeyCrashAfterActivation(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestRotateKeyCrashAfterActivation")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := ioutil.WriteFile(mnt+"file", []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+	rotate := func() {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-rotate-key", "-q", "-extpass", "echo test", dir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("rotate-key failed: %v\n%s", err, out)
+		}
+	}
+	rotate()
+	cf1, err := configfile.Load(dir + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Recreate what the crash leaves behind: the new config file is in place,
+	// the journal still exists
+	journal := dir + configfile.ConfDefaultName + ".rotate-journal"
+	err = ioutil.WriteFile(journal, []byte(`{"Op":"begin","Dir":"","Old":"a","New":"b"}`+"\n"+
+		`{"Op":"done","Dir":"","Old":"a","New":"b"}`+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test_helpers.Mount(dir, mnt, "-extpass", "echo test") == nil {
+		test_helpers.Unmount(mnt)
+		t.Fatal("mount should fail while the journal exists")
+	}
+	rotate()
+	cf2, err := configfile.Load(dir + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cf1.EncryptedKey) != string(cf2.EncryptedKey) {
+		t.Error("a completed rotation has been started again")
+	}
+	if test_helpers.VerifyExistence(journal) {
+		t.Error("journal file has not been deleted")
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	c, err := ioutil.ReadFile(mnt + "file")
+	if err != nil || string(c) != "content" {
+		t.Errorf("reading back failed: %q, %v", c, err)
+	}
+}
+
+// Test resuming -rotate-key after a crash right after a file that starts
+// with a hole has been converted in place (-plaintextnames). The hole
+// decrypts with both keys and must not make the file look unconverted.
+func TestRotateKeyResumeHole(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestRotateKeyResumeHole", "-plaintextnames")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	fd, err := os.Create(mnt + "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks 0 and 1 are holes
+	_, err = fd.WriteAt([]byte("data after the hole"), 10000)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+	conf := dir + configfile.ConfDefaultName
+	oldConf, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotate := func() {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-rotate-key", "-q", "-extpass", "echo test", dir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("rotate-key failed: %v\n%s", err, out)
+		}
+	}
+	rotate()
+	newConf, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Recreate what the crash leaves behind: the old config file is still
+	// active, the file is converted but the journal has no "done" record
+	os.Remove(conf)
+	err = ioutil.WriteFile(conf, oldConf, 0400)
+	if err == nil {
+		err = ioutil.WriteFile(conf+".rotate-new", newConf, 0400)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(conf+".rotate-journal",
+			[]byte(`{"Op":"begin","Dir":"","Old":"file","New":"file"}`+"\n"), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotate()
+	conf2, err := ioutil.ReadFile(conf)
+	if err != nil || !bytes.Equal(conf2, newConf) {
+		t.Errorf("the new config file has not been activated: %v", err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	c, err := ioutil.ReadFile(mnt + "file")
+	if err != nil || len(c) != 10019 || string(c[10000:]) != "data after the hole" {
+		t.Errorf("reading back failed: %v", err)
+	}
+}
+
+// Test resuming -rotate-key after a crash between converting two hard links
+// to the same file. The second one must be linked to the converted file
+// instead of becoming a copy.
+func TestRotateKeyResumeHardLink(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestRotateKeyResumeHardLink", "-plaintextnames")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := ioutil.WriteFile(mnt+"a", []byte("content"), 0600)
+	if err == nil {
+		err = os.Link(mnt+"a", mnt+"b")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+	// Keep the unconverted file around under a third name
+	backup := dir[:len(dir)-1] + ".b"
+	err = os.Link(dir+"b", backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(backup)
+	var st syscall.Stat_t
+	err = syscall.Stat(backup, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := dir + configfile.ConfDefaultName
+	oldConf, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotate := func() {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-rotate-key", "-q", "-extpass", "echo test", dir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("rotate-key failed: %v\n%s", err, out)
+		}
+	}
+	rotate()
+	newConf, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Recreate what the crash leaves behind: "a" is converted, "b" is not
+	os.Remove(dir + "b")
+	err = os.Link(backup, dir+"b")
+	if err == nil {
+		os.Remove(conf)
+		err = ioutil.WriteFile(conf, oldConf, 0400)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(conf+".rotate-new", newConf, 0400)
+	}
+	if err == nil {
+		rec := fmt.Sprintf(`"Dir":"","Old":"a","New":"a","Ino":%d}`, st.Ino)
+		err = ioutil.WriteFile(conf+".rotate-journal",
+			[]byte(`{"Op":"begin",`+rec+"\n"+`{"Op":"done",`+rec+"\n"), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotate()
+	var stA, stB syscall.Stat_t
+	err = syscall.Stat(dir+"a", &stA)
+	if err == nil {
+		err = syscall.Stat(dir+"b", &stB)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stA.Ino != stB.Ino {
+		t.Error("hard links have been split")
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	c, err := ioutil.ReadFile(mnt + "b")
+	if err != nil || string(c) != "content" {
+		t.Errorf("reading back failed: %q, %v", c, err)
+	}
+}
+
+// Test that -rotate-key does not authenticate a rolled back block with the
+// new hash tree root
+func TestRotateKeyIntegrityRollback(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestRotateKeyIntegrityRollback", "-integrity", "-plaintextnames")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	// Two full blocks
+	err := ioutil.WriteFile(mnt+"file", make([]byte, 8192), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := ioutil.ReadFile(dir + "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.OpenFile(mnt+"file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fd.WriteAt([]byte("new content"), 5000)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.Unmount(mnt)
+	// Roll back block #1 but keep the new header. 8192 bytes are two blocks
+	// with 32 bytes of overhead each.
+	cur, err := ioutil.ReadFile(dir + "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerLen := len(cur) - (8192 + 2*32)
+	block1 := headerLen + 4096 + 32
+	copy(cur[block1:], old[block1:])
+	err = ioutil.WriteFile(dir+"file", cur, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-rotate-key", "-q", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Error("rotate-key should have failed")
+	} else if !strings.Contains(string(out), "hash tree") {
+		t.Errorf("unexpected error: %v\n%s", err, out)
+	}
+}
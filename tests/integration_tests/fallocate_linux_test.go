@@ -0,0 +1,61 @@
+package integration_tests
+
+// fallocate(2) is Linux-only
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x01
+	FALLOC_FL_PUNCH_HOLE = 0x02
+)
+
+func TestFallocate(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "fallocate"
+	file, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fd := int(file.Fd())
+	data := bytes.Repeat([]byte{'x'}, 10000)
+	_, err = file.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mode 0 grows the file
+	err = syscall.Fallocate(fd, 0, 0, 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.VerifySize(t, fn, 20000)
+	// KEEP_SIZE does not
+	err = syscall.Fallocate(fd, FALLOC_FL_KEEP_SIZE, 0, 50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.VerifySize(t, fn, 20000)
+	// Punch a hole that covers a complete block and two partial blocks
+	err = syscall.Fallocate(fd, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, 100, 9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.VerifySize(t, fn, 20000)
+	want := make([]byte, 20000)
+	copy(want, data[:100])
+	copy(want[9100:], data[9100:])
+	have, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("wrong content")
+	}
+}
@@ -0,0 +1,119 @@
+package integration_tests
+
+// Locks taken through one mount must be seen by a second mount of the same
+// CIPHERDIR and on the ciphertext file itself. Open file description locks
+// are Linux-only.
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// openRW - open "path" read-write or fail the test
+func openRW(t *testing.T, path string) *os.File {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestLocking(t *testing.T) {
+	// With -plaintextnames the ciphertext name of the file is known
+	dir, mnt1 := test_helpers.InitFS(t, "TestLocking", "-plaintextnames")
+	mnt2 := test_helpers.TmpDir + "TestLocking.mnt2/"
+	err := os.Mkdir(mnt2, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt1, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt1)
+	test_helpers.MountOrFatal(t, dir, mnt2, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt2)
+
+	err = ioutil.WriteFile(mnt1+"file", []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1 := openRW(t, mnt1+"file")
+	defer f1.Close()
+	f2 := openRW(t, mnt2+"file")
+	defer f2.Close()
+	c := openRW(t, dir+"file")
+	defer c.Close()
+
+	// flock(2)
+	err = syscall.Flock(int(f1.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Flock(int(f2.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != syscall.EWOULDBLOCK {
+		t.Errorf("flock through second mount: want EWOULDBLOCK, got %v", err)
+	}
+	err = syscall.Flock(int(c.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err != syscall.EWOULDBLOCK {
+		t.Errorf("flock on ciphertext file: want EWOULDBLOCK, got %v", err)
+	}
+	err = syscall.Flock(int(f1.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Flock(int(f2.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		t.Errorf("flock after unlock: %v", err)
+	}
+	syscall.Flock(int(f2.Fd()), syscall.LOCK_UN)
+
+	// fcntl(2) byte-range locks
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Start: 0, Len: 100}
+	err = syscall.FcntlFlock(f1.Fd(), syscall.F_SETLK, &lk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := syscall.Flock_t{Type: syscall.F_RDLCK, Start: 50, Len: 10}
+	err = syscall.FcntlFlock(f2.Fd(), syscall.F_GETLK, &get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get.Type != syscall.F_WRLCK {
+		t.Errorf("F_GETLK through second mount: want F_WRLCK, got %d", get.Type)
+	}
+	rd := syscall.Flock_t{Type: syscall.F_RDLCK, Start: 0, Len: 10}
+	err = syscall.FcntlFlock(c.Fd(), syscall.F_SETLK, &rd)
+	if err != syscall.EAGAIN && err != syscall.EACCES {
+		t.Errorf("F_SETLK on ciphertext file: want EAGAIN, got %v", err)
+	}
+	// Locks of the same process do not conflict, even through another file
+	// handle
+	f1b := openRW(t, mnt1+"file")
+	defer f1b.Close()
+	lk2 := syscall.Flock_t{Type: syscall.F_WRLCK, Start: 50, Len: 10}
+	err = syscall.FcntlFlock(f1b.Fd(), syscall.F_SETLK, &lk2)
+	if err != nil {
+		t.Errorf("F_SETLK through second handle of the same process: %v", err)
+	}
+	// Ranges that do not overlap do not conflict
+	rd.Start = 200
+	err = syscall.FcntlFlock(f2.Fd(), syscall.F_SETLK, &rd)
+	if err != nil {
+		t.Errorf("F_SETLK on disjoint range: %v", err)
+	}
+	lk.Type = syscall.F_UNLCK
+	err = syscall.FcntlFlock(f1.Fd(), syscall.F_SETLK, &lk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get = syscall.Flock_t{Type: syscall.F_WRLCK, Start: 0, Len: 100}
+	err = syscall.FcntlFlock(c.Fd(), syscall.F_GETLK, &get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get.Type != syscall.F_UNLCK {
+		t.Errorf("F_GETLK on ciphertext file after unlock: want F_UNLCK, got %d", get.Type)
+	}
+}
@@ -160,6 +160,49 @@ func TestTruncate(t *testing.T) {
 	}
 }
 
+// Same as TestTruncate, but using truncate(2) on the path instead of
+// ftruncate(2) on an open file
+func TestTruncateByPath(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "truncateByPath"
+	file, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	// Grow to two blocks
+	if err = os.Truncate(fn, 7000); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.VerifySize(t, fn, 7000)
+	if test_helpers.Md5fn(fn) != "95d4ec7038e3e4fdbd5f15c34c3f0b34" {
+		t.Errorf("wrong content")
+	}
+	// Shrink - needs RMW
+	if err = os.Truncate(fn, 6999); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.VerifySize(t, fn, 6999)
+	if test_helpers.Md5fn(fn) != "35fd15873ec6c35380064a41b9b9683b" {
+		t.Errorf("wrong content")
+	}
+	// Shrink to one partial block
+	if err = os.Truncate(fn, 465); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.VerifySize(t, fn, 465)
+	if test_helpers.Md5fn(fn) != "a1534d6e98a6b21386456a8f66c55260" {
+		t.Errorf("wrong content")
+	}
+	// Grow to exactly one block
+	if err = os.Truncate(fn, 4096); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.VerifySize(t, fn, 4096)
+	if test_helpers.Md5fn(fn) != "620f0b67a91f7f74151bc5be745b7110" {
+		t.Errorf("wrong content")
+	}
+}
+
 func TestAppend(t *testing.T) {
 	fn := test_helpers.DefaultPlainDir + "append"
 	file, err := os.Create(fn)
@@ -453,3 +496,80 @@ func TestLchown(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Rename the parent of a directory that is in use. Operations relative to the
+// open directory must land in its new location.
+func TestRenameOpenDir(t *testing.T) {
+	wd := test_helpers.DefaultPlainDir
+	err := os.MkdirAll(wd+"RenameOpenDir1/sub", 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.Open(wd + "RenameOpenDir1/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	err = os.Rename(wd+"RenameOpenDir1", wd+"RenameOpenDir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Openat(int(dir.Fd()), "file", syscall.O_CREAT|syscall.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = syscall.Write(fd, []byte("hello"))
+	syscall.Close(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(wd + "RenameOpenDir2/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("wrong content: %q", content)
+	}
+	if test_helpers.VerifyExistence(wd + "RenameOpenDir1/sub/file") {
+		t.Error("file shows up under the old name")
+	}
+}
+
+// Both names of a hard link must be the same file
+func TestHardlink(t *testing.T) {
+	wd := test_helpers.DefaultPlainDir
+	err := ioutil.WriteFile(wd+"hardlink1", []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(wd+"hardlink1", wd+"hardlink2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st1, st2 syscall.Stat_t
+	err = syscall.Stat(wd+"hardlink1", &st1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Stat(wd+"hardlink2", &st2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st1.Ino != st2.Ino {
+		t.Errorf("different inode numbers: %d %d", st1.Ino, st2.Ino)
+	}
+	if st2.Nlink != 2 {
+		t.Errorf("wrong link count: %d", st2.Nlink)
+	}
+	err = ioutil.WriteFile(wd+"hardlink2", []byte("barbaz"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(wd + "hardlink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "barbaz" {
+		t.Errorf("wrong content: %q", content)
+	}
+}
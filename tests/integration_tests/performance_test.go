@@ -3,12 +3,17 @@ package integration_tests
 // Benchmarks
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"testing"
 
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
 
@@ -129,3 +134,101 @@ func BenchmarkCreate4kB(t *testing.B) {
 func BenchmarkCreate10kB(t *testing.B) {
 	createFiles(t, t.N, 10*1024)
 }
+
+// benchmarkBlocks - encrypt or decrypt requests of 128 KiB, the size FUSE
+// uses, with GOMAXPROCS set to "procs". GOMAXPROCS=1 gives the serial path,
+// the parallel path needs more than one CPU.
+func benchmarkBlocks(t *testing.B, decrypt bool, procs int) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, true, true)
+	ce := contentenc.New(cc, contentenc.DefaultBS, false, false, false)
+	fileID := cryptocore.RandBytes(contentenc.HEADER_ID_LEN)
+	plaintexts := make([][]byte, 128*1024/contentenc.DefaultBS)
+	for i := range plaintexts {
+		plaintexts[i] = make([]byte, contentenc.DefaultBS)
+	}
+	ciphertext := bytes.Join(ce.EncryptBlocks(plaintexts, 0, fileID), nil)
+	t.SetBytes(128 * 1024)
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		if decrypt {
+			_, err := ce.DecryptBlocks(ciphertext, 0, fileID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			ce.EncryptBlocks(plaintexts, 0, fileID)
+		}
+	}
+}
+
+func BenchmarkEncryptBlocksSerial(t *testing.B) {
+	benchmarkBlocks(t, false, 1)
+}
+
+func BenchmarkEncryptBlocksParallel(t *testing.B) {
+	benchmarkBlocks(t, false, 4)
+}
+
+func BenchmarkDecryptBlocksSerial(t *testing.B) {
+	benchmarkBlocks(t, true, 1)
+}
+
+func BenchmarkDecryptBlocksParallel(t *testing.B) {
+	benchmarkBlocks(t, true, 4)
+}
+
+// benchmarkReread - mount a new filesystem with "extraArgs" and read the same
+// 1 MiB file over and over again, opening it every time. Without
+// -kernel_cache, the kernel drops the cached contents on every open and
+// gocryptfs has to decrypt the file again.
+func benchmarkReread(t *testing.B, extraArgs ...string) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "BenchmarkReread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cDir := dir + "/cipher"
+	pDir := dir + "/plain"
+	for _, d := range []string{cDir, pDir} {
+		err = os.Mkdir(d, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = nametransform.WriteDirIV(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = test_helpers.Mount(cDir, pDir, append(extraArgs, "-zerokey")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer test_helpers.Unmount(pDir)
+
+	fn := pDir + "/file"
+	buf := make([]byte, 1024*1024)
+	err = ioutil.WriteFile(fn, buf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.SetBytes(int64(len(buf)))
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		content, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) != len(buf) {
+			t.Fatalf("short read: %d", len(content))
+		}
+	}
+}
+
+func BenchmarkReread(t *testing.B) {
+	benchmarkReread(t)
+}
+
+func BenchmarkRereadKernelCache(t *testing.B) {
+	benchmarkReread(t, "-kernel_cache", "-attr_timeout=1m", "-entry_timeout=1m")
+}
@@ -0,0 +1,133 @@
+package integration_tests
+
+// Another user who can write to CIPHERDIR must not be able to redirect
+// gocryptfs to the outside by swapping directories for symlinks. Uses the
+// Linux-only xattr syscalls.
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Replace "dir/sub" with a symlink to "../outside" and back until "stop" is
+// closed
+func swapSymlinkLoop(dir string, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		os.Rename(dir+"sub", dir+"sub.real")
+		os.Symlink("../outside", dir+"sub")
+		os.Remove(dir + "sub")
+		os.Rename(dir+"sub.real", dir+"sub")
+	}
+}
+
+// Run all kinds of operations on "mnt/sub" while "sub" in CIPHERDIR is swapped
+// for a symlink. Most of them fail during the race, which is fine. None of
+// them may touch the directory the symlink points to.
+func TestSymlinkRace(t *testing.T) {
+	base := test_helpers.TmpDir + "TestSymlinkRace/"
+	dir := base + "cipher/"
+	outside := base + "outside/"
+	// The mountpoint is not next to "outside", so the symlink does not lead
+	// there when the kernel follows it in the plaintext view
+	mnt := test_helpers.TmpDir + "TestSymlinkRace.mnt/"
+	for _, d := range []string{base, dir, outside, mnt} {
+		err := os.Mkdir(d, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// With -plaintextnames the ciphertext name of "sub" is known
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-init", "-plaintextnames",
+		"-xattr", "-extpass", "echo test", "-scryptn=10", dir)
+	if testing.Verbose() {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	err := cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+
+	sub := mnt + "sub/"
+	err = os.Mkdir(sub, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(sub+"file", []byte("inside"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The outside directory looks just like "sub"
+	err = ioutil.WriteFile(outside+"file", []byte("outside"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi0, err := os.Stat(outside + "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go swapSymlinkLoop(dir, stop, &wg)
+	old := time.Unix(1000, 0)
+	for i := 0; i < 1000; i++ {
+		os.Chmod(sub+"file", 0644)
+		os.Chtimes(sub+"file", old, old)
+		os.Truncate(sub+"file", 0)
+		syscall.Access(sub+"file", 4)
+		syscall.Setxattr(sub+"file", "user.foo", []byte("bar"), 0)
+		ioutil.WriteFile(sub+"file", []byte("x"), 0600)
+		ioutil.WriteFile(sub+"new", []byte("x"), 0600)
+		os.Mkdir(sub+"newdir", 0700)
+		os.Symlink("target", sub+"newlink")
+		os.Link(sub+"file", sub+"newhardlink")
+		syscall.Mkfifo(sub+"newfifo", 0600)
+		os.Rename(sub+"new", sub+"new2")
+		for _, n := range []string{"new", "new2", "newdir", "newlink", "newhardlink", "newfifo", "file"} {
+			os.Remove(sub + n)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	entries, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		for _, e := range entries {
+			t.Errorf("outside was modified: found %q", e.Name())
+		}
+	}
+	fi, err := os.Stat(outside + "file")
+	if err != nil {
+		t.Fatalf("outside was modified: %v", err)
+	}
+	if fi.Mode() != fi0.Mode() || !fi.ModTime().Equal(fi0.ModTime()) || fi.Size() != fi0.Size() {
+		t.Errorf("outside file was modified: mode %v, mtime %v, size %d",
+			fi.Mode(), fi.ModTime(), fi.Size())
+	}
+	if buf, _ := ioutil.ReadFile(outside + "file"); string(buf) != "outside" {
+		t.Errorf("outside file content was modified: %q", buf)
+	}
+	if sz, _ := syscall.Listxattr(outside+"file", nil); sz > 0 {
+		t.Error("outside file got extended attributes")
+	}
+}
@@ -0,0 +1,223 @@
+package integration_tests
+
+// Extended attributes use Linux-only syscalls
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Test -xattr: attributes can be set, read, listed and removed, and neither
+// the name nor the value show up in CIPHERDIR
+func TestXattr(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestXattr", "-xattr")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	fn := mnt + "file"
+	err := ioutil.WriteFile(fn, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attr := "user.secretname"
+	val := []byte("secretvalue")
+	err = syscall.Setxattr(fn, attr, val, 0)
+	if err == syscall.EOPNOTSUPP {
+		t.Skip("backing filesystem does not support user xattrs")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1000)
+	sz, err := syscall.Getxattr(fn, attr, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:sz], val) {
+		t.Errorf("wrong value: %q", buf[:sz])
+	}
+	sz, err = syscall.Listxattr(fn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:sz]) != attr+"\000" {
+		t.Errorf("wrong list: %q", buf[:sz])
+	}
+	// The plaintext must not show up in the backing file's attributes
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		sz, err = syscall.Listxattr(dir+e.Name(), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf[:sz], []byte("secretname")) {
+			t.Errorf("attribute name leaked: %q", buf[:sz])
+		}
+	}
+	err = syscall.Removexattr(fn, attr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = syscall.Getxattr(fn, attr, buf)
+	if err != syscall.ENODATA {
+		t.Errorf("want ENODATA, got %v", err)
+	}
+}
+
+// Test -xattr: an encrypted value that is copied to another file in CIPHERDIR
+// must be rejected
+func TestXattrSwap(t *testing.T) {
+	// With -plaintextnames the backing files are easy to find
+	dir, mnt := test_helpers.InitFS(t, "TestXattrSwap", "-xattr", "-plaintextnames")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	attr := "user.foo"
+	for _, f := range []string{"a", "b"} {
+		err := ioutil.WriteFile(mnt+f, nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = syscall.Setxattr(mnt+f, attr, []byte("value of "+f), 0)
+		if err == syscall.EOPNOTSUPP {
+			t.Skip("backing filesystem does not support user xattrs")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Copy the encrypted value from "a" to "b"
+	buf := make([]byte, 1000)
+	sz, err := syscall.Listxattr(dir+"a", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cAttr string
+	for _, a := range strings.Split(string(buf[:sz]), "\000") {
+		if strings.HasPrefix(a, "user.gocryptfs.") && a != "user.gocryptfs.id" {
+			cAttr = a
+		}
+	}
+	if cAttr == "" {
+		t.Fatalf("encrypted attribute not found: %q", buf[:sz])
+	}
+	sz, err = syscall.Getxattr(dir+"a", cAttr, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Setxattr(dir+"b", cAttr, buf[:sz], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = syscall.Getxattr(mnt+"b", attr, buf)
+	if err != syscall.EIO {
+		t.Errorf("swapped value: want EIO, got %v", err)
+	}
+	sz, err = syscall.Getxattr(mnt+"a", attr, buf)
+	if err != nil {
+		t.Errorf("reading the original value failed: %v", err)
+	} else if string(buf[:sz]) != "value of a" {
+		t.Errorf("wrong original value: %q", buf[:sz])
+	}
+}
+
+// Test that empty values are authenticated as well: blanking the encrypted
+// values on the backing file must not produce valid empty values
+func TestXattrBlank(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestXattrBlank", "-xattr", "-plaintextnames")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	err := ioutil.WriteFile(mnt+"a", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := []string{"user.empty", "user.foo"}
+	for i, v := range []string{"", "value"} {
+		err = syscall.Setxattr(mnt+"a", attrs[i], []byte(v), 0)
+		if err == syscall.EOPNOTSUPP {
+			t.Skip("backing filesystem does not support user xattrs")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 1000)
+	sz, err := syscall.Getxattr(mnt+"a", "user.empty", buf)
+	if err != nil || sz != 0 {
+		t.Errorf("reading the empty value: size %d, %v", sz, err)
+	}
+	sz, err = syscall.Listxattr(dir+"a", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range strings.Split(string(buf[:sz]), "\000") {
+		if strings.HasPrefix(a, "user.gocryptfs.") && a != "user.gocryptfs.id" {
+			err = syscall.Setxattr(dir+"a", a, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, attr := range attrs {
+		_, err = syscall.Getxattr(mnt+"a", attr, buf)
+		if err != syscall.EIO {
+			t.Errorf("%s: blanked value: want EIO, got %v", attr, err)
+		}
+	}
+}
+
+// Test -rotate-key with -xattr: attributes of files and directories can be
+// read with the new key
+func TestXattrRotateKey(t *testing.T) {
+	dir, mnt := test_helpers.InitFS(t, "TestXattrRotateKey", "-xattr")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := ioutil.WriteFile(mnt+"file", []byte("content"), 0400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(mnt+"dir", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"file", "dir"} {
+		err = syscall.Setxattr(mnt+f, "user.foo", []byte("value of "+f), 0)
+		if err == syscall.EOPNOTSUPP {
+			test_helpers.Unmount(mnt)
+			t.Skip("backing filesystem does not support user xattrs")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.Unmount(mnt)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-rotate-key", "-q", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("rotate-key failed: %v\n%s", err, out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.Unmount(mnt)
+	buf := make([]byte, 1000)
+	for _, f := range []string{"file", "dir"} {
+		sz, err := syscall.Getxattr(mnt+f, "user.foo", buf)
+		if err != nil {
+			t.Errorf("%s: reading the attribute failed: %v", f, err)
+		} else if string(buf[:sz]) != "value of "+f {
+			t.Errorf("%s: wrong value: %q", f, buf[:sz])
+		}
+		sz, err = syscall.Listxattr(mnt+f, buf)
+		if err != nil {
+			t.Errorf("%s: listing the attributes failed: %v", f, err)
+		} else if string(buf[:sz]) != "user.foo\000" {
+			t.Errorf("%s: wrong list: %q", f, buf[:sz])
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package reverse
+
+// Test reverse mode by mounting the encrypted view in forward mode again
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Plaintext files
+var dirA = test_helpers.TmpDir + "a/"
+
+// Encrypted view of dirA, provided by reverse mode
+var dirB = test_helpers.TmpDir + "b/"
+
+// Decrypted view of dirB, provided by forward mode
+var dirC = test_helpers.TmpDir + "c/"
+
+func TestMain(m *testing.M) {
+	test_helpers.ResetTmpDir(false)
+	for _, d := range []string{dirA, dirB, dirC} {
+		err := os.Mkdir(d, 0700)
+		if err != nil {
+			panic(err)
+		}
+	}
+	test_helpers.MountOrExit(dirA, dirB, "-zerokey", "-reverse")
+	test_helpers.MountOrExit(dirB, dirC, "-zerokey")
+	r := m.Run()
+	test_helpers.Unmount(dirC)
+	test_helpers.Unmount(dirB)
+	os.Exit(r)
+}
+
+// Files written to the plaintext directory must show up unchanged after
+// a round trip through reverse and forward mode
+func TestRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 4095, 4096, 4097, 1024*1024 + 3}
+	for _, size := range sizes {
+		name := fmt.Sprintf("file%d", size)
+		content := bytes.Repeat([]byte{byte(size)}, size)
+		err := ioutil.WriteFile(dirA+name, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test_helpers.VerifySize(t, dirC+name, size)
+		content2, err := ioutil.ReadFile(dirC + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, content2) {
+			t.Errorf("size %d: content mismatch", size)
+		}
+	}
+}
+
+// The ciphertext must be stable so that rsync does not see changes
+func TestStableCiphertext(t *testing.T) {
+	err := ioutil.WriteFile(dirA+"stable", []byte("hello world"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			continue
+		}
+		c1, err := ioutil.ReadFile(dirB + e.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := ioutil.ReadFile(dirB + e.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c1, c2) {
+			t.Errorf("ciphertext of %q changed between reads", e.Name())
+		}
+	}
+}
+
+func TestLongnames(t *testing.T) {
+	name := string(bytes.Repeat([]byte("x"), 255))
+	err := ioutil.WriteFile(dirA+name, []byte("longname"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test_helpers.VerifyExistence(dirC + name) {
+		t.Errorf("long name is not visible through the reverse mount")
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	target := "/target/does/not/exist"
+	err := os.Symlink(target, dirA+"symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target2, err := os.Readlink(dirC + "symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != target2 {
+		t.Errorf("wrong symlink target: want=%q have=%q", target, target2)
+	}
+}
+
+// With "-config", the custom config file must show up as gocryptfs.conf in
+// the encrypted view
+func TestConfigCustomLocation(t *testing.T) {
+	plain := test_helpers.TmpDir + "TestConfigCustomLocation/"
+	mnt := test_helpers.TmpDir + "TestConfigCustomLocation.mnt/"
+	conf := test_helpers.TmpDir + "TestConfigCustomLocation.conf"
+	for _, d := range []string{plain, mnt} {
+		err := os.Mkdir(d, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-init", "-reverse", "-q",
+		"-extpass", "echo test", "-scryptn=10", "-config", conf, plain)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("init failed: %v\n%s", err, out)
+	}
+	test_helpers.MountOrFatal(t, plain, mnt, "-reverse", "-extpass", "echo test", "-config", conf)
+	defer test_helpers.Unmount(mnt)
+	c1, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ioutil.ReadFile(mnt + "gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c1, c2) {
+		t.Error("gocryptfs.conf does not match the custom config file")
+	}
+}
@@ -3,14 +3,18 @@ package test_helpers
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 )
 
@@ -105,6 +109,33 @@ func Unmount(p string) error {
 	return err
 }
 
+// InitFS - create the CIPHERDIR "TmpDir/name/" and the empty mountpoint
+// "TmpDir/name.mnt/", and run "-init" on the CIPHERDIR with "extraArgs".
+// The password is "test".
+func InitFS(t *testing.T, name string, extraArgs ...string) (cipherDir string, plainDir string) {
+	cipherDir = TmpDir + name + "/"
+	plainDir = TmpDir + name + ".mnt/"
+	for _, d := range []string{cipherDir, plainDir} {
+		err := os.Mkdir(d, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{"-init", "-extpass", "echo test", "-scryptn=10"}
+	args = append(args, extraArgs...)
+	args = append(args, cipherDir)
+	cmd := exec.Command(GocryptfsBinary, args...)
+	if testing.Verbose() {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	err := cmd.Run()
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	return cipherDir, plainDir
+}
+
 // Return md5 string for file "filename"
 func Md5fn(filename string) string {
 	buf, err := ioutil.ReadFile(filename)
@@ -237,3 +268,23 @@ func VerifyExistence(path string) bool {
 	}
 	return false
 }
+
+// QueryCtlSock - send a request to the control socket at "socketPath" and
+// return the response
+func QueryCtlSock(t *testing.T, socketPath string, req ctlsock.RequestStruct) (response ctlsock.ResponseStruct) {
+	conn, err := net.DialTimeout("unix", socketPath, 1*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}